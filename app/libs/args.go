@@ -0,0 +1,274 @@
+package tun2socks
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// parseCommandLine splits argStr into arguments the way a POSIX shell would:
+// words are separated by whitespace, single quotes preserve everything up to
+// the closing quote, double quotes allow backslash escapes of ", \, $ and `,
+// and an unquoted backslash escapes whitespace, a quote or another backslash.
+// Any other backslash, including a trailing one, is kept, so Windows paths like
+// C:\Users\me need no quoting. Both --flag=value and --flag value are left for
+// the flag package to interpret; it takes the word after a non-boolean flag as
+// its value even when it starts with a dash, so "-rtt -1" and "-e -host-" work
+// as expected.
+func parseCommandLine(argStr string) ([]string, error) {
+	var (
+		args    []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	runes := []rune(argStr)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch {
+			case r == '"':
+				quote = 0
+			case r == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`", runes[i+1]):
+				i++
+				word.WriteRune(runes[i])
+			default:
+				word.WriteRune(r)
+			}
+		case r == '\\' && i+1 < len(runes) && (unicode.IsSpace(runes[i+1]) || strings.ContainsRune("\"'\\", runes[i+1])):
+			escaped, inWord = true, true
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case unicode.IsSpace(r):
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in arguments", quote)
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// ParseArgString parses a command-line style flag string into a Config.
+// Problems with the arguments are reported as an *ArgsError.
+func ParseArgString(argStr string) (*Config, error) {
+	cfg := NewConfig()
+	fs := flag.NewFlagSet("tun2socks", flag.ContinueOnError)
+	// Keep the flag package from printing usage to stderr; the error says it all.
+	var usage bytes.Buffer
+	fs.SetOutput(&usage)
+	fs.BoolVar(&cfg.Verbose, "v", cfg.Verbose, "verbose")
+	fs.StringVar(&cfg.BindAddress, "b", cfg.BindAddress, "socks bind address")
+	fs.StringVar(&cfg.HTTPProxyAddress, "http-bind", cfg.HTTPProxyAddress, "http proxy bind address, off if empty")
+	fs.StringVar(&cfg.HTTPProxyAddress, "http-proxy", cfg.HTTPProxyAddress, "alias for -http-bind")
+	fs.Var(dohFlag{&cfg.DOHServer}, "doh", "resolve dns over https through warp; -doh alone uses "+defaultDOHServer+", -doh=url another server")
+	fs.BoolVar(&cfg.DOHFallback, "doh-fallback", cfg.DOHFallback, "use plain dns through warp until the doh server first answers")
+	fs.StringVar(&cfg.DNSListenAddr, "dns-bind", cfg.DNSListenAddr, "local dns server address for -doh, e.g. 127.0.0.1:5353; off if empty")
+	fs.IntVar(&cfg.FWMark, "fwmark", cfg.FWMark, "fwmark (SO_MARK) for direct flows and webhooks, 0 for none; warp's own sockets are not marked")
+	fs.StringVar(&cfg.OutInterface, "out-interface", cfg.OutInterface, "network interface to bind direct flows and webhooks to, e.g. rmnet0; warp's own sockets are not bound")
+	fs.StringVar(&cfg.ManagementAddr, "management", cfg.ManagementAddr, "management api bind address, off if empty")
+	fs.StringVar(&cfg.MetricsAddr, "metrics", cfg.MetricsAddr, "prometheus metrics bind address, off if empty")
+	fs.StringVar(&cfg.WebhookURL, "webhook", cfg.WebhookURL, "url to post connection events to, off if empty")
+	fs.StringVar(&cfg.WebhookSecret, "webhook-secret", cfg.WebhookSecret, "hmac-sha256 key for the webhook signature")
+	fs.StringVar(&cfg.Endpoint, "e", cfg.Endpoint, "warp clean ip")
+	fs.StringVar(&cfg.License, "k", cfg.License, "license key")
+	fs.Func("license-keys", "comma-separated license keys to rotate through when one is refused, instead of -k", func(v string) error {
+		for _, key := range strings.Split(v, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				cfg.LicenseKeys = append(cfg.LicenseKeys, key)
+			}
+		}
+		return nil
+	})
+	fs.Func("country", "psiphon country code in ISO 3166-1 alpha-2 format, or a comma-separated priority list, e.g. NL,DE,FR", func(v string) error {
+		for _, code := range strings.Split(v, ",") {
+			if code = strings.TrimSpace(code); code == "" {
+				continue
+			}
+			if err := validatePsiphonRegion(code); err != nil {
+				return err
+			}
+		}
+		cfg.Country = strings.ToUpper(v)
+		return nil
+	})
+	fs.IntVar(&cfg.RegionTimeoutSecs, "region-timeout", cfg.RegionTimeoutSecs, "seconds a psiphon region gets to connect before the next -country is tried, 0 for 30")
+	fs.BoolVar(&cfg.PsiphonEnabled, "cfon", cfg.PsiphonEnabled, "enable psiphonEnabled over warp")
+	fs.BoolVar(&cfg.Gool, "gool", cfg.Gool, "enable warp gooling")
+	fs.BoolVar(&cfg.Scan, "scan", cfg.Scan, "enable warp scanner(experimental)")
+	fs.BoolVar(&cfg.Rescan, "rescan", cfg.Rescan, "scan even if an endpoint from an earlier scan is cached")
+	fs.IntVar(&cfg.RTT, "rtt", cfg.RTT, "scanner rtt threshold in ms, -1 for none, default 1000")
+	fs.StringVar(&cfg.WireGuardConfigFile, "wgconf", cfg.WireGuardConfigFile, "wireguard config file to take the endpoint and mtu from")
+	fs.BoolVar(&cfg.ScanIPv6, "scan-ipv6", cfg.ScanIPv6, "only use ipv6 endpoints, probing warp's ipv6 ranges as well")
+	fs.Func("scan-ports", "comma-separated ports the scanned endpoint must use, e.g. 2408,500,4500,908", func(v string) error {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f == "" {
+				continue
+			}
+			p, err := strconv.Atoi(f)
+			if err != nil || p < 1 || p > 65535 {
+				return fmt.Errorf("invalid port %q: must be a number between 1 and 65535", f)
+			}
+			cfg.ScanPorts = append(cfg.ScanPorts, p)
+		}
+		return nil
+	})
+	fs.StringVar(&cfg.FakeIPRange, "fakeip", cfg.FakeIPRange, "fake dns ip range in CIDR notation, e.g. "+recommendedFakeIPRange)
+	fs.StringVar(&cfg.FakeIPRange, "fake-ip-range", cfg.FakeIPRange, "alias for -fakeip")
+	fs.IntVar(&cfg.MTU, "mtu", cfg.MTU, "tun device mtu (576-65535), 0 for engine default")
+	fs.BoolVar(&cfg.AllowLan, "allow-lan", cfg.AllowLan, "allow lan traffic in the tun stack")
+	bypass := func(v string) error {
+		for _, cidr := range strings.Split(v, ",") {
+			if cidr = strings.TrimSpace(cidr); cidr != "" {
+				cfg.BypassCIDRs = append(cfg.BypassCIDRs, cidr)
+			}
+		}
+		return nil
+	}
+	fs.Func("bypass", "comma-separated CIDRs to reach directly instead of through warp, repeatable", bypass)
+	fs.Func("bypass-cidr", "alias for -bypass", bypass)
+	fs.Func("bypass-domains", "comma-separated domain suffixes to reach directly, e.g. ir,example.com; needs -fakeip", func(v string) error {
+		for _, d := range strings.Split(v, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				cfg.BypassDomains = append(cfg.BypassDomains, d)
+			}
+		}
+		return nil
+	})
+	fs.Func("route-domains", "comma-separated domain suffixes to only tunnel through warp; needs -fakeip", func(v string) error {
+		for _, d := range strings.Split(v, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				cfg.RouteDomains = append(cfg.RouteDomains, d)
+			}
+		}
+		return nil
+	})
+	fs.Func("route-cidr", "comma-separated CIDRs to only tunnel through warp, repeatable; the rest goes direct", func(v string) error {
+		for _, cidr := range strings.Split(v, ",") {
+			if cidr = strings.TrimSpace(cidr); cidr != "" {
+				cfg.RouteCIDRs = append(cfg.RouteCIDRs, cidr)
+			}
+		}
+		return nil
+	})
+	fs.IntVar(&cfg.IdleTimeoutSecs, "idle-timeout", cfg.IdleTimeoutSecs, "restart warp after this many seconds without tun traffic, 0 to disable")
+	fs.Func("dns", "comma-separated resolvers (ip or ip:port) for all dns in the tunnel", func(v string) error {
+		for _, server := range strings.Split(v, ",") {
+			if server = strings.TrimSpace(server); server == "" {
+				continue
+			}
+			if _, err := normalizeDNSServer(server); err != nil {
+				return err
+			}
+			cfg.DNSServers = append(cfg.DNSServers, server)
+		}
+		return nil
+	})
+	fs.BoolVar(&cfg.DupFd, "dup-fd", cfg.DupFd, "duplicate the tun fd so the caller may close its copy")
+	fs.BoolVar(&cfg.SelfTest, "selftest", cfg.SelfTest, "check that traffic leaves through warp once up and fail otherwise")
+	fs.BoolVar(&cfg.UserspaceMode, "userspace", cfg.UserspaceMode, "run without a tun device, only serving the local proxies")
+	fs.StringVar(&cfg.StatsFile, "stats-file", cfg.StatsFile, "append a json line per warp handshake to this file")
+	fs.StringVar(&cfg.PCAPFile, "pcap", cfg.PCAPFile, "write tun packets to this pcap file for debugging")
+	fs.BoolVar(&cfg.EnableIPv6, "ipv6", cfg.EnableIPv6, "enable ipv6 in the tun stack")
+	fs.StringVar(&cfg.Socks5User, "socks5-user", cfg.Socks5User, "require this socks5 user name")
+	fs.StringVar(&cfg.Socks5Pass, "socks5-pass", cfg.Socks5Pass, "require this socks5 password")
+	fs.BoolVar(&cfg.StrictBindCheck, "strict-bind", cfg.StrictBindCheck, "refuse to start when -b is reachable from other devices without socks5 credentials")
+	fs.StringVar(&cfg.Socks5User, "socks-user", cfg.Socks5User, "alias for -socks5-user")
+	fs.StringVar(&cfg.Socks5Pass, "socks-pass", cfg.Socks5Pass, "alias for -socks5-pass")
+	ipv4Only := fs.Bool("4", false, "ipv4 only, same as -ipv6=false")
+
+	args, err := parseCommandLine(argStr)
+	if err != nil {
+		return nil, newArgsError(fs, err.Error())
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, newArgsError(fs, err.Error())
+	}
+	if fs.NArg() > 0 {
+		return nil, newArgsError(fs, fmt.Sprintf("unexpected argument %q", fs.Arg(0)))
+	}
+	if *ipv4Only {
+		cfg.EnableIPv6 = false
+	}
+	return cfg, nil
+}
+
+// dohFlag is -doh. It parses like a bool flag so it may be given without a
+// value, which selects defaultDOHServer; a url must then be passed as
+// -doh=url.
+type dohFlag struct{ url *string }
+
+func (f dohFlag) String() string {
+	if f.url == nil {
+		return ""
+	}
+	return *f.url
+}
+
+func (f dohFlag) Set(v string) error {
+	switch v {
+	case "true":
+		v = defaultDOHServer
+	case "false":
+		v = ""
+	}
+	*f.url = v
+	return nil
+}
+
+func (f dohFlag) IsBoolFlag() bool { return true }
+
+// ErrInvalidArgs is matched by every *ArgsError, so callers can use
+// errors.Is(err, ErrInvalidArgs).
+var ErrInvalidArgs = errors.New("invalid arguments")
+
+// ArgsError describes a flag string RunWarp could not parse. Its message is
+// short enough for a toast; Flags is there for callers that want to list the
+// valid flags.
+type ArgsError struct {
+	// Msg is the problem as reported by the flag package or tokenizer.
+	Msg string
+	// Flags lists the valid flag names, e.g. "-b".
+	Flags []string
+}
+
+func newArgsError(fs *flag.FlagSet, msg string) *ArgsError {
+	e := &ArgsError{Msg: msg}
+	fs.VisitAll(func(f *flag.Flag) {
+		e.Flags = append(e.Flags, "-"+f.Name)
+	})
+	return e
+}
+
+func (e *ArgsError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrInvalidArgs, e.Msg)
+}
+
+func (e *ArgsError) Unwrap() error {
+	return ErrInvalidArgs
+}
@@ -0,0 +1,258 @@
+package tun2socks
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseArgStringFlags(t *testing.T) {
+	tests := []struct {
+		args  string
+		check func(*Config) bool
+	}{
+		{"-v", func(c *Config) bool { return c.Verbose }},
+		{"-b 0.0.0.0:1080", func(c *Config) bool { return c.BindAddress == "0.0.0.0:1080" }},
+		{"-http-bind 127.0.0.1:8118", func(c *Config) bool { return c.HTTPProxyAddress == "127.0.0.1:8118" }},
+		{"-http-proxy 127.0.0.1:8118", func(c *Config) bool { return c.HTTPProxyAddress == "127.0.0.1:8118" }},
+		{"-doh", func(c *Config) bool { return c.DOHServer == defaultDOHServer }},
+		{"-doh=https://dns.example/dns-query", func(c *Config) bool { return c.DOHServer == "https://dns.example/dns-query" }},
+		{"-doh-fallback", func(c *Config) bool { return c.DOHFallback }},
+		{"-dns-bind 127.0.0.1:5353", func(c *Config) bool { return c.DNSListenAddr == "127.0.0.1:5353" }},
+		{"-fwmark 255", func(c *Config) bool { return c.FWMark == 255 }},
+		{"-out-interface rmnet0", func(c *Config) bool { return c.OutInterface == "rmnet0" }},
+		{"-management 127.0.0.1:9090", func(c *Config) bool { return c.ManagementAddr == "127.0.0.1:9090" }},
+		{"-metrics :2112", func(c *Config) bool { return c.MetricsAddr == ":2112" }},
+		{"-webhook https://hook.example/x", func(c *Config) bool { return c.WebhookURL == "https://hook.example/x" }},
+		{"-webhook-secret s3cret", func(c *Config) bool { return c.WebhookSecret == "s3cret" }},
+		{"-e 162.159.192.1:2408", func(c *Config) bool { return c.Endpoint == "162.159.192.1:2408" }},
+		{"-k abc-def", func(c *Config) bool { return c.License == "abc-def" }},
+		{"-license-keys a,b,,c", func(c *Config) bool { return reflect.DeepEqual(c.LicenseKeys, []string{"a", "b", "c"}) }},
+		{"-cfon -country nl,de", func(c *Config) bool { return c.PsiphonEnabled && c.Country == "NL,DE" }},
+		{"-region-timeout 15", func(c *Config) bool { return c.RegionTimeoutSecs == 15 }},
+		{"-gool", func(c *Config) bool { return c.Gool }},
+		{"-scan", func(c *Config) bool { return c.Scan }},
+		{"-rescan", func(c *Config) bool { return c.Rescan }},
+		{"-rtt 500", func(c *Config) bool { return c.RTT == 500 }},
+		{"-rtt=500", func(c *Config) bool { return c.RTT == 500 }},
+		{"-wgconf /etc/wg0.conf", func(c *Config) bool { return c.WireGuardConfigFile == "/etc/wg0.conf" }},
+		{"-scan-ipv6", func(c *Config) bool { return c.ScanIPv6 }},
+		{"-scan-ports 2408,500", func(c *Config) bool { return reflect.DeepEqual(c.ScanPorts, []int{2408, 500}) }},
+		{"-fakeip 198.18.0.0/15", func(c *Config) bool { return c.FakeIPRange == "198.18.0.0/15" }},
+		{"-fake-ip-range 198.18.0.0/15", func(c *Config) bool { return c.FakeIPRange == "198.18.0.0/15" }},
+		{"-mtu 1280", func(c *Config) bool { return c.MTU == 1280 }},
+		{"-allow-lan=false", func(c *Config) bool { return !c.AllowLan }},
+		{"-bypass 10.0.0.0/8 -bypass 192.168.0.0/16", func(c *Config) bool {
+			return reflect.DeepEqual(c.BypassCIDRs, []string{"10.0.0.0/8", "192.168.0.0/16"})
+		}},
+		{"-bypass-cidr 10.0.0.0/8", func(c *Config) bool { return reflect.DeepEqual(c.BypassCIDRs, []string{"10.0.0.0/8"}) }},
+		{"-bypass-domains ir,example.com", func(c *Config) bool { return reflect.DeepEqual(c.BypassDomains, []string{"ir", "example.com"}) }},
+		{"-route-domains example.org", func(c *Config) bool { return reflect.DeepEqual(c.RouteDomains, []string{"example.org"}) }},
+		{"-route-cidr 1.1.1.0/24", func(c *Config) bool { return reflect.DeepEqual(c.RouteCIDRs, []string{"1.1.1.0/24"}) }},
+		{"-idle-timeout 300", func(c *Config) bool { return c.IdleTimeoutSecs == 300 }},
+		{"-dns 1.1.1.1,8.8.8.8:53", func(c *Config) bool { return reflect.DeepEqual(c.DNSServers, []string{"1.1.1.1", "8.8.8.8:53"}) }},
+		{"-dup-fd=false", func(c *Config) bool { return !c.DupFd }},
+		{"-selftest", func(c *Config) bool { return c.SelfTest }},
+		{"-userspace", func(c *Config) bool { return c.UserspaceMode }},
+		{"-stats-file /tmp/stats.jsonl", func(c *Config) bool { return c.StatsFile == "/tmp/stats.jsonl" }},
+		{"-pcap /tmp/tun.pcap", func(c *Config) bool { return c.PCAPFile == "/tmp/tun.pcap" }},
+		{"-ipv6=false", func(c *Config) bool { return !c.EnableIPv6 }},
+		{"-4", func(c *Config) bool { return !c.EnableIPv6 }},
+		{"-socks5-user u -socks5-pass p", func(c *Config) bool { return c.Socks5User == "u" && c.Socks5Pass == "p" }},
+		{"-socks-user u -socks-pass p", func(c *Config) bool { return c.Socks5User == "u" && c.Socks5Pass == "p" }},
+		{"-strict-bind", func(c *Config) bool { return c.StrictBindCheck }},
+	}
+
+	covered := make(map[string]bool)
+	for _, tt := range tests {
+		cfg, err := ParseArgString(tt.args)
+		if err != nil {
+			t.Errorf("ParseArgString(%q): %v", tt.args, err)
+			continue
+		}
+		if !tt.check(cfg) {
+			t.Errorf("ParseArgString(%q) = %+v", tt.args, cfg)
+		}
+		for _, arg := range strings.Fields(tt.args) {
+			if strings.HasPrefix(arg, "-") {
+				covered[strings.SplitN(arg, "=", 2)[0]] = true
+			}
+		}
+	}
+
+	// Every flag the FlagSet defines must be exercised above.
+	_, err := ParseArgString("-no-such-flag")
+	var argsErr *ArgsError
+	if !errors.As(err, &argsErr) {
+		t.Fatalf("ParseArgString(-no-such-flag) = %v, want an *ArgsError", err)
+	}
+	for _, name := range argsErr.Flags {
+		if !covered[name] {
+			t.Errorf("flag %s has no parse test", name)
+		}
+	}
+}
+
+func TestParseArgStringDefaults(t *testing.T) {
+	cfg, err := ParseArgString("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, NewConfig()) {
+		t.Errorf("ParseArgString(\"\") = %+v, want NewConfig()", cfg)
+	}
+}
+
+func TestParseCommandLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"only spaces", "   \t ", nil, false},
+		{"trailing spaces", "-b 0.0.0.0:8086   ", []string{"-b", "0.0.0.0:8086"}, false},
+		{"leading spaces", "  -v", []string{"-v"}, false},
+		{"double quoted value", `-b "0.0.0.0:8086"`, []string{"-b", "0.0.0.0:8086"}, false},
+		{"quoted values together", `--country "US" -e "engage.cloudflareclient.com:2408"`,
+			[]string{"--country", "US", "-e", "engage.cloudflareclient.com:2408"}, false},
+		{"equals form", "--rtt=500", []string{"--rtt=500"}, false},
+		{"quoted equals form", `--k="abc=def"`, []string{"--k=abc=def"}, false},
+		{"space inside quotes", `-k "a b  c"`, []string{"-k", "a b  c"}, false},
+		{"escaped quote", `-k "say \"hi\""`, []string{"-k", `say "hi"`}, false},
+		{"single quotes keep backslashes", `-k 'a\"b'`, []string{"-k", `a\"b`}, false},
+		{"unicode value", "-k ключ-日本", []string{"-k", "ключ-日本"}, false},
+		{"value that looks like a flag", `-k "-v"`, []string{"-k", "-v"}, false},
+		{"empty quoted value", `-k ""`, []string{"-k", ""}, false},
+		{"unterminated double quote", `-k "abc`, nil, true},
+		{"unterminated single quote", `-k 'abc`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCommandLine(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCommandLine(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCommandLine(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseArgStringUnterminatedQuote(t *testing.T) {
+	_, err := ParseArgString(`-e "engage.cloudflareclient.com:2408`)
+	if !errors.Is(err, ErrInvalidArgs) {
+		t.Errorf("ParseArgString with an unterminated quote = %v, want ErrInvalidArgs", err)
+	}
+}
+
+func TestParseArgStringErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args string
+		msg  string // expected in ArgsError.Msg
+	}{
+		{"unknown flag", "-gol", "flag provided but not defined: -gol"},
+		{"missing value", "-b", "flag needs an argument: -b"},
+		{"wrong type", "-rtt abc", `invalid value "abc" for flag -rtt`},
+		{"wrong bool", "-scan=maybe", `invalid boolean value "maybe" for -scan`},
+		{"bad port list", "-scan-ports 2408,http", `invalid port "http"`},
+		{"stray argument", "-v extra", `unexpected argument "extra"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseArgString(tt.args)
+			var argsErr *ArgsError
+			if !errors.As(err, &argsErr) {
+				t.Fatalf("ParseArgString(%q) = %v, want an *ArgsError", tt.args, err)
+			}
+			if !errors.Is(err, ErrInvalidArgs) {
+				t.Errorf("error %v does not match ErrInvalidArgs", err)
+			}
+			if !strings.Contains(argsErr.Msg, tt.msg) {
+				t.Errorf("Msg = %q, want it to contain %q", argsErr.Msg, tt.msg)
+			}
+			if len(argsErr.Flags) == 0 {
+				t.Error("Flags is empty")
+			}
+			// It goes into a toast as is, so no flag list.
+			if want := "invalid arguments: " + argsErr.Msg; err.Error() != want {
+				t.Errorf("Error() = %q, want %q", err, want)
+			}
+		})
+	}
+}
+
+func TestParseArgStringDashValues(t *testing.T) {
+	tests := []struct {
+		args  string
+		check func(*Config) bool
+	}{
+		{"-rtt=-1", func(c *Config) bool { return c.RTT == -1 }},
+		{"-rtt -1", func(c *Config) bool { return c.RTT == -1 }},
+		{"-rtt -1 -scan", func(c *Config) bool { return c.RTT == -1 && c.Scan }},
+		{"-e engage-1.cloudflare-client.com:2408", func(c *Config) bool { return c.Endpoint == "engage-1.cloudflare-client.com:2408" }},
+		{"-e -host-:2408", func(c *Config) bool { return c.Endpoint == "-host-:2408" }},
+		{"-e=-host-:2408 -v", func(c *Config) bool { return c.Endpoint == "-host-:2408" && c.Verbose }},
+		{`-k "-abc-def-"`, func(c *Config) bool { return c.License == "-abc-def-" }},
+		{"-k -- -v", func(c *Config) bool { return c.License == "--" && c.Verbose }},
+	}
+	for _, tt := range tests {
+		cfg, err := ParseArgString(tt.args)
+		if err != nil {
+			t.Errorf("ParseArgString(%q): %v", tt.args, err)
+			continue
+		}
+		if !tt.check(cfg) {
+			t.Errorf("ParseArgString(%q) = %+v", tt.args, cfg)
+		}
+	}
+}
+
+// TestParseCommandLineShellWords covers the POSIX word rules the tokenizer
+// follows, with the backslash exception for Windows paths.
+func TestParseCommandLineShellWords(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`a b`, []string{"a", "b"}},
+		{"a\tb\nc", []string{"a", "b", "c"}},
+		{`a\ b`, []string{"a b"}},
+		{`\"quoted\"`, []string{`"quoted"`}},
+		{`\'`, []string{"'"}},
+		{`a\\b`, []string{`a\b`}},
+		{`C:\Users\me\wg0.conf`, []string{`C:\Users\me\wg0.conf`}},
+		{`-wgconf C:\Program\ Files\wg0.conf`, []string{"-wgconf", `C:\Program Files\wg0.conf`}},
+		{`-wgconf "C:\Program Files\wg0.conf"`, []string{"-wgconf", `C:\Program Files\wg0.conf`}},
+		{`-wgconf 'C:\Program Files\wg0.conf'`, []string{"-wgconf", `C:\Program Files\wg0.conf`}},
+		{`\\server\share`, []string{`\server\share`}},
+		{`trailing\`, []string{`trailing\`}},
+		{`"a\\b"`, []string{`a\b`}},
+		{`"a\nb"`, []string{`a\nb`}},
+		{`"\$HOME"`, []string{"$HOME"}},
+		{"\"\\`cmd\\`\"", []string{"`cmd`"}},
+		{`'it'\''s'`, []string{"it's"}},
+		{`"say \"hi\""`, []string{`say "hi"`}},
+		{`--k="abc=def"`, []string{"--k=abc=def"}},
+		{`--k='a "b" c'`, []string{`--k=a "b" c`}},
+		{`a"b c"d`, []string{"ab cd"}},
+		{`'' ""`, []string{"", ""}},
+		{`--k=`, []string{"--k="}},
+		{`--k= -v`, []string{"--k=", "-v"}},
+		{`$HOME`, []string{"$HOME"}},
+	}
+	for _, tt := range tests {
+		got, err := parseCommandLine(tt.in)
+		if err != nil {
+			t.Errorf("parseCommandLine(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCommandLine(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
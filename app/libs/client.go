@@ -0,0 +1,1331 @@
+package tun2socks
+
+import (
+	"bufio"
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tun2socks/lwip"
+	"tun2socks/wgconf"
+
+	"github.com/bepass-org/wireguard-go/app"
+	L "github.com/xjasonlyu/tun2socks/v2/log"
+)
+
+// protectorWarned is set once Start has warned that the socket protector does
+// not reach warp's own sockets.
+var protectorWarned atomic.Bool
+
+var (
+	// ErrShutdownTimeout is returned when the server does not stop within the given timeout.
+	ErrShutdownTimeout = errors.New("timed out waiting for server to shut down")
+	// ErrAlreadyRunning is returned by Start and SetTunStack when the client is
+	// already running.
+	ErrAlreadyRunning = errors.New("client is already running")
+	// ErrRestartRequired is returned by Reconfigure when a setting used by the
+	// tun2socks layer changed.
+	ErrRestartRequired = errors.New("changed settings require a full restart")
+	// ErrNotConnected is returned by WaitUntilConnected when the client stops,
+	// or was never started, without reaching StateConnected.
+	ErrNotConnected = errors.New("client stopped before connecting")
+	// ErrNotRunning is returned by UpdateTunFd when there is no active run.
+	ErrNotRunning = errors.New("client is not running")
+	// ErrInvalidTunFd is reported when the tun fd is not an open descriptor.
+	ErrInvalidTunFd = errors.New("invalid tun fd")
+	// ErrExposedBind is returned by Start when an unauthenticated listener
+	// would be reachable from other devices and Config.StrictBindCheck is
+	// set, or the HTTP proxy would be while the SOCKS5 credentials are.
+	ErrExposedBind = errors.New("listener is exposed without authentication")
+	// ErrSelfTestFailed ends a run with Config.SelfTest set when the
+	// Cloudflare trace cannot be fetched through warp.
+	ErrSelfTestFailed = errors.New("self-test failed")
+)
+
+// runWarp is app.RunWarp; tests replace it so they never reach Cloudflare.
+var runWarp = app.RunWarp
+
+// Client owns the state of one warp stack. The standard logger, stdout/stderr
+// and the lwip stack are process-wide, so they follow the most recently
+// started client.
+type Client struct {
+	logs  *logWriter
+	errs  chan error
+	state *stateTracker
+	stack TunStack
+
+	webhook atomic.Pointer[webhook] // nil when Config.WebhookURL is empty
+
+	reconnects atomic.Uint64 // transitions to StateReconnecting
+	latency    atomic.Int64  // last successful Ping in ms, -1 before one
+
+	mu      sync.Mutex
+	cfg     Config
+	run     *run   // current run, or the last one once it has finished
+	session string // ID of run, see SessionID
+	path    string // absolute path of the latest Start
+
+	// scanMu guards scan apart from mu: Reconfigure holds mu while waiting
+	// for warp, which may be scanning.
+	scanMu sync.Mutex
+	scan   []EndpointResult // latest scan, see ScanResults
+}
+
+// run holds the state of a single Start/Stop cycle so a client can be started
+// again once the previous run has fully stopped.
+type run struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	errCh  chan error
+	done   chan struct{}
+	err    error // set before done is closed
+
+	started time.Time
+
+	// warpAddr is where warp's SOCKS5 listener binds: BindAddress, or a
+	// loopback address behind the auth front-end when the SOCKS5 credentials
+	// are set. That listener never authenticates.
+	warpAddr  string
+	logFile   string // Config.LogFile, see useLogFile
+	auth      *socksAuthServer
+	httpProxy *httpProxy
+	doh       *dohResolver // Config.DOHServer, nil when unset
+	dns       *dnsProxy    // Config.DNSListenAddr, nil when unset
+	mgmt      *managementServer
+	metrics   *metricsServer
+	stats     *statsFile // Config.StatsFile, nil when unset
+
+	// stdout/stderr pipes set up by captureOutput, and what they replaced.
+	pipes          []*os.File
+	pipeWG         sync.WaitGroup
+	stdout, stderr *os.File
+
+	// Guarded by Client.mu.
+	closing    bool
+	warpCancel context.CancelFunc
+	warpDone   chan struct{}
+	fd         int              // tun fd in use, negative in proxy-only mode
+	paused     bool             // warp stopped by Pause
+	routes     routingRules     // from routingRulesFile, see ReloadRoutingRules
+	wgFile     *wgconf.WGConfig // Config.WireGuardConfigFile, nil when unset
+
+	attempt   atomic.Int32           // latest warp retry attempt, see RetryAttempt
+	endpoint  atomic.Pointer[string] // see ActiveEndpoint
+	license   atomic.Pointer[string] // see CurrentLicense
+	selfTest  atomic.Pointer[SelfTestResult]
+	region    atomic.Pointer[string] // see PsiphonRegion
+	handshake atomic.Int64           // unix nanoseconds, see LastHandshake
+}
+
+func (r *run) finished() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewClient returns a client for cfg. The config is copied, so later changes to
+// cfg do not affect the client.
+func NewClient(cfg *Config) *Client {
+	c := &Client{}
+	if cfg != nil {
+		c.cfg = *cfg
+	}
+	c.logs = newLogWriter(c.cfg.LogBufferSize, c.cfg.LogChannelSize)
+	c.errs = make(chan error, 1)
+	c.state = newStateTracker()
+	c.latency.Store(-1)
+	c.state.onChange = func(s State) {
+		if s == StateReconnecting {
+			c.reconnects.Add(1)
+		}
+		if w := c.webhook.Load(); w != nil {
+			w.notify(s)
+		}
+	}
+	c.stack = lwipStack{}
+	return c
+}
+
+// Start validates the config and starts the stack in the background. Use Wait
+// to block until it stops. fd is the tun device; a negative fd, or
+// Config.UserspaceMode, runs only warp and the local proxies, without the tun
+// stack.
+func (c *Client) Start(path string, fd int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.run != nil && !c.run.finished() {
+		return ErrAlreadyRunning
+	}
+	if c.cfg.UserspaceMode && fd >= 0 {
+		log.Println("Userspace mode: ignoring tun fd", fd)
+		fd = -1
+	}
+	wgFile, err := loadWireGuardFile(c.cfg.WireGuardConfigFile)
+	if err != nil {
+		return err
+	}
+	// c.cfg itself is left as given, so the next Start reads the file again.
+	cfg := c.cfg
+	used := applyWireGuardFile(&cfg, wgFile)
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if err := checkFakeIPRange(cfg.FakeIPRange); err != nil {
+		return err
+	}
+	if err := checkBindExposure(&cfg); err != nil {
+		return err
+	}
+	if len(used) > 0 {
+		log.Printf("Using %s from %s", strings.Join(used, ", "), cfg.WireGuardConfigFile)
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		c.path = abs
+	} else {
+		c.path = path
+	}
+	routes, err := loadRoutingRules(c.path)
+	if err != nil {
+		return err
+	}
+	if c.cfg.FakeIPRange == "" && len(routes.BypassDomains)+len(routes.RouteDomains) > 0 {
+		return fmt.Errorf("%s: domain rules need a fake ip range", routingRulesFile)
+	}
+	c.ResetStats()
+	c.session = newSessionID()
+	c.logs.setSession(c.session)
+	c.webhook.Store(newWebhook(&c.cfg, c.session))
+	if c.cfg.Verbose {
+		setLogLevel(L.DebugLevel)
+	}
+	useLogPath(path)
+	if c.cfg.LogFile != "" {
+		if err := useLogFile(c.cfg.LogFile, c.cfg.LogMaxSizeMB); err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+	}
+
+	// Setup context with cancellation.
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &run{
+		ctx:      ctx,
+		cancel:   cancel,
+		errCh:    make(chan error, 2),
+		done:     make(chan struct{}),
+		warpAddr: c.cfg.BindAddress,
+		logFile:  c.cfg.LogFile,
+		fd:       fd,
+		routes:   routes,
+		wgFile:   wgFile,
+		started:  time.Now(),
+	}
+	// fail undoes everything Start set up so far.
+	fail := func(err error) error {
+		cancel()
+		r.closeListeners()
+		r.closePipes()
+		r.stats.close()
+		releaseLogFile(r.logFile)
+		return err
+	}
+	if c.cfg.Socks5User != "" {
+		addr, err := freeLoopbackAddr()
+		if err != nil {
+			return fail(fmt.Errorf("failed to reserve warp socks address: %w", err))
+		}
+		r.auth, err = listenSocksAuth(c.cfg.BindAddress, addr, c.cfg.Socks5User, c.cfg.Socks5Pass)
+		if err != nil {
+			return fail(fmt.Errorf("failed to listen on %s: %w", c.cfg.BindAddress, err))
+		}
+		r.warpAddr = addr
+	}
+	if c.cfg.HTTPProxyAddress != "" {
+		upstream := strings.Replace(r.warpAddr, "0.0.0.0", "127.0.0.1", -1)
+		p, err := listenHTTPProxy(c.cfg.HTTPProxyAddress, upstream)
+		if err != nil {
+			return fail(fmt.Errorf("failed to listen on %s: %w", c.cfg.HTTPProxyAddress, err))
+		}
+		r.httpProxy = p
+	}
+	if c.cfg.DOHServer != "" {
+		upstream := strings.Replace(r.warpAddr, "0.0.0.0", "127.0.0.1", -1)
+		var fallback []string
+		if c.cfg.DOHFallback {
+			for _, server := range cfg.DNSServers {
+				if server, err := normalizeDNSServer(server); err == nil {
+					fallback = append(fallback, server)
+				}
+			}
+			if len(fallback) == 0 {
+				fallback = []string{connectivityDNSServer}
+			}
+		}
+		r.doh = newDOHResolver(c.cfg.DOHServer, upstream, fallback)
+	}
+	if r.doh != nil && c.cfg.DNSListenAddr != "" {
+		p, err := listenDNSProxy(c.cfg.DNSListenAddr, r.doh)
+		if err != nil {
+			return fail(fmt.Errorf("failed to listen on %s: %w", c.cfg.DNSListenAddr, err))
+		}
+		r.dns = p
+	}
+	if c.cfg.ManagementAddr != "" {
+		m, err := listenManagement(c, c.cfg.ManagementAddr)
+		if err != nil {
+			return fail(fmt.Errorf("failed to listen on %s: %w", c.cfg.ManagementAddr, err))
+		}
+		r.mgmt = m
+	}
+	if c.cfg.MetricsAddr != "" {
+		m, err := listenMetrics(c, c.cfg.MetricsAddr)
+		if err != nil {
+			return fail(fmt.Errorf("failed to listen on %s: %w", c.cfg.MetricsAddr, err))
+		}
+		r.metrics = m
+	}
+	if c.cfg.StatsFile != "" {
+		warnStaleStats(c.cfg.StatsFile)
+		f, err := openStatsFile(c.cfg.StatsFile)
+		if err != nil {
+			return fail(fmt.Errorf("failed to open stats file: %w", err))
+		}
+		r.stats = f
+	}
+	c.captureOutput(r)
+	if lwip.SocketProtectorSet() && !protectorWarned.Swap(true) {
+		log.Println("Warning: the socket protector covers bypassed flows and webhooks only; " +
+			"warp's WireGuard, scanner and API sockets are not protected, so exclude the app from the VPN")
+	}
+	if c.cfg.OutInterface != "" {
+		log.Printf("Binding direct flows and webhooks to %s; warp's WireGuard, scanner and API sockets use the default network", c.cfg.OutInterface)
+	}
+	if c.cfg.FWMark != 0 {
+		log.Printf("Marking direct flows and webhooks with fwmark %d (%#x); warp's WireGuard, scanner and API sockets are not marked", c.cfg.FWMark, c.cfg.FWMark)
+	}
+	if c.cfg.FakeIPRange == legacyFakeIPRange {
+		log.Printf("Warning: fake ip range %s is publicly routed and will stop being the default; use -fakeip %s to switch now",
+			legacyFakeIPRange, recommendedFakeIPRange)
+	}
+	if err := os.Chdir(path); err != nil {
+		return fail(fmt.Errorf("error changing to 'main' directory: %w", err))
+	}
+	if r.fd >= 0 && c.cfg.DupFd {
+		r.fd = ownTunFd(r.fd)
+	}
+	c.run = r
+	c.state.set(StateConnecting)
+	r.wg.Add(1)
+	if r.auth != nil {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.auth.serve(ctx)
+		}()
+	}
+	if r.httpProxy != nil {
+		log.Println("HTTP proxy listening on", c.cfg.HTTPProxyAddress)
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.httpProxy.serve(ctx)
+		}()
+	}
+	if r.dns != nil {
+		log.Printf("DNS proxy listening on %s, resolving via %s", r.dns.tcp.Addr(), c.cfg.DOHServer)
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.dns.serve(ctx)
+		}()
+	}
+	if r.mgmt != nil {
+		log.Println("Management API listening on", c.cfg.ManagementAddr)
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.mgmt.serve(ctx)
+		}()
+	}
+	if r.metrics != nil {
+		log.Println("Metrics listening on", c.cfg.MetricsAddr)
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.metrics.serve(ctx)
+		}()
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		c.watchIdle(r)
+	}()
+
+	go c.runServer(r)
+	go c.wait(r)
+	return nil
+}
+
+// captureOutput routes the standard logger, the tun2socks logger and
+// stdout/stderr into the client's log buffer, each under its own source tag.
+// The stdout/stderr pipes belong to r and are closed by r.closePipes.
+func (c *Client) captureOutput(r *run) {
+	logger := c.logs
+	log.SetFlags(0) // lines are timestamped by the logWriter
+	log.SetOutput(logger)
+
+	L.SetLevel(L.Level(logLevel.Load()))
+	L.SetOutput(logger.source(sourceT2S))
+
+	r.stdout, r.stderr = os.Stdout, os.Stderr
+	os.Stdout = r.pipeTo(logger.source(sourceStdout))
+	os.Stderr = r.pipeTo(logger.source(sourceStderr))
+}
+
+// closeListeners closes the proxy listeners opened by Start before they are
+// served.
+func (r *run) closeListeners() {
+	if r.auth != nil {
+		r.auth.ln.Close()
+	}
+	if r.httpProxy != nil {
+		r.httpProxy.ln.Close()
+	}
+	if r.dns != nil {
+		r.dns.close()
+	}
+	if r.mgmt != nil {
+		r.mgmt.ln.Close()
+	}
+	if r.metrics != nil {
+		r.metrics.ln.Close()
+	}
+}
+
+// closePipes restores stdout/stderr if they still point at r's pipes, closes
+// the pipes and waits for their readers to drain them.
+func (r *run) closePipes() {
+	for _, pw := range r.pipes {
+		if os.Stdout == pw {
+			os.Stdout = r.stdout
+		}
+		if os.Stderr == pw {
+			os.Stderr = r.stderr
+		}
+		pw.Close()
+	}
+	r.pipes = nil
+	r.pipeWG.Wait()
+}
+
+// pipeTo returns the write end of a pipe whose lines are copied into w.
+func (r *run) pipeTo(w io.Writer) *os.File {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		log.Println("Failed to create output pipe:", err)
+		return os.Stderr
+	}
+	r.pipes = append(r.pipes, pw)
+	r.pipeWG.Add(1)
+	go func(reader io.ReadCloser) {
+		defer r.pipeWG.Done()
+		defer reader.Close()
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			w.Write(scanner.Bytes())
+		}
+		if err := scanner.Err(); err != nil {
+			log.Println("There was an error with the scanner", err)
+		}
+	}(pr)
+	return pw
+}
+
+// wait records the outcome of r once every server goroutine is gone.
+func (c *Client) wait(r *run) {
+	r.wg.Wait()
+	select {
+	case err := <-r.errCh:
+		log.Println("Server stopped:", err)
+		r.err = err
+		select {
+		case c.errs <- err:
+		default:
+			// The previous error was never read; keep it.
+		}
+		events.error(err)
+		c.state.fail(err)
+	default:
+		log.Println("Server shut down gracefully.")
+		c.state.set(StateDisconnected)
+	}
+	r.cancel()
+	if r.doh != nil {
+		r.doh.client.CloseIdleConnections()
+	}
+	r.closePipes()
+	flushLogFile()
+	close(r.done)
+}
+
+// Err delivers the error that stopped a run. Only the first unread error is
+// kept; Wait returns the error of the latest run regardless.
+func (c *Client) Err() <-chan error {
+	return c.errs
+}
+
+func (c *Client) currentRun() *run {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.run
+}
+
+// Wait blocks until the running stack stops and returns the error that stopped
+// it, if any. It returns immediately if the client was never started.
+func (c *Client) Wait() error {
+	r := c.currentRun()
+	if r == nil {
+		return nil
+	}
+	<-r.done
+	return r.err
+}
+
+// Stop cancels the running stack and waits for it to exit.
+func (c *Client) Stop() error {
+	return c.StopWithTimeout(0)
+}
+
+// StopWithTimeout is like Stop but gives up waiting after d and returns
+// ErrShutdownTimeout. A non-positive d waits indefinitely.
+func (c *Client) StopWithTimeout(d time.Duration) error {
+	r := c.currentRun()
+	if r == nil || r.finished() {
+		return nil
+	}
+	c.state.set(StateDisconnecting)
+	r.cancel()
+
+	if d <= 0 {
+		<-r.done
+		return nil
+	}
+	select {
+	case <-r.done:
+		return nil
+	case <-time.After(d):
+		return ErrShutdownTimeout
+	}
+}
+
+// RetryAttempt returns the number of the latest warp retry of the current
+// run, e.g. 3 while StateReconnecting means "reconnecting (attempt 3)". It is
+// zero until warp first fails and starts over once warp has been stable.
+func (c *Client) RetryAttempt() int {
+	r := c.currentRun()
+	if r == nil {
+		return 0
+	}
+	return int(r.attempt.Load())
+}
+
+// ActiveEndpoint returns the WireGuard endpoint warp is running on, e.g. the
+// one picked by the scanner or taken from the endpoint cache. app.RunWarp
+// reports no handshake, so it is set when a warp attempt starts on a known
+// endpoint and cleared when the attempt fails. It is empty when the client is
+// not running or RunWarp is left to scan for an endpoint itself.
+func (c *Client) ActiveEndpoint() string {
+	r := c.currentRun()
+	if r == nil || r.finished() {
+		return ""
+	}
+	if ep := r.endpoint.Load(); ep != nil {
+		return *ep
+	}
+	return ""
+}
+
+// SessionID returns the random ID generated by the latest Start. Every log
+// line of that run carries it, which lets bug reports spanning several
+// sessions be told apart. It is empty before the first Start.
+func (c *Client) SessionID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+// newSessionID returns 16 random bytes in hex.
+func newSessionID() string {
+	var b [16]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// State returns the current connection state.
+func (c *Client) State() State {
+	return c.state.get()
+}
+
+// IsRunning reports whether a run has been started and has not yet finished.
+func (c *Client) IsRunning() bool {
+	r := c.currentRun()
+	return r != nil && !r.finished()
+}
+
+// LastError returns the error that moved the client to StateError, if any.
+func (c *Client) LastError() error {
+	return c.state.lastError()
+}
+
+// StateChangeCh delivers every state transition. When the reader falls behind,
+// the oldest queued transitions are dropped; State always has the latest.
+func (c *Client) StateChangeCh() <-chan State {
+	return c.state.changes
+}
+
+// WaitUntilConnected blocks until the client reaches StateConnected and
+// returns nil. It returns ctx.Err() if ctx ends first, the run's error if it
+// fails, or ErrNotConnected if it stops cleanly. It reads StateChangeCh and
+// Err, so it should not be combined with other readers of those channels.
+func (c *Client) WaitUntilConnected(ctx context.Context) error {
+	for {
+		switch c.State() {
+		case StateConnected:
+			return nil
+		case StateError:
+			if err := c.LastError(); err != nil {
+				return err
+			}
+			return ErrNotConnected
+		case StateIdle, StateDisconnected:
+			if !c.IsRunning() {
+				return ErrNotConnected
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-c.Err():
+			return err
+		case <-c.StateChangeCh():
+		}
+	}
+}
+
+// Logs returns the log lines captured since the previous call.
+func (c *Client) Logs() string {
+	return c.logs.drain()
+}
+
+// SetLogBufferSize sets how many lines Logs keeps between calls; older lines
+// are dropped once the limit is reached.
+func (c *Client) SetLogBufferSize(n int) {
+	c.logs.setBufferSize(n)
+}
+
+// LogCh delivers captured log lines as they arrive. When the reader falls
+// behind, the oldest queued events are dropped and counted in Stats.
+func (c *Client) LogCh() <-chan LogEvent {
+	return c.logs.events
+}
+
+// Stats holds counters about a client.
+type Stats struct {
+	// DroppedLogs is the number of events discarded because LogCh was full.
+	DroppedLogs uint64
+	// DroppedLogCount is the number of lines overwritten in the Logs buffer
+	// before they were read.
+	DroppedLogCount uint64
+
+	// HTTPProxyRequests counts requests to the HTTP proxy in the current or
+	// last run; HTTPProxyRx and HTTPProxyTx are the bytes it received from and
+	// sent through warp. Tun traffic is reported by BytesTransferred.
+	HTTPProxyRequests uint64
+	HTTPProxyRx       uint64
+	HTTPProxyTx       uint64
+}
+
+// Stats returns a snapshot of the client's counters.
+func (c *Client) Stats() Stats {
+	s := Stats{
+		DroppedLogs:     c.logs.dropped.Load(),
+		DroppedLogCount: c.logs.bufferDropped.Load(),
+	}
+	if r := c.currentRun(); r != nil && r.httpProxy != nil {
+		s.HTTPProxyRequests = r.httpProxy.requests.Load()
+		s.HTTPProxyRx = r.httpProxy.rx.Load()
+		s.HTTPProxyTx = r.httpProxy.tx.Load()
+	}
+	return s
+}
+
+// AllowLan reports whether LAN traffic bypasses the tunnel under the client's
+// current config.
+func (c *Client) AllowLan() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg.AllowLan
+}
+
+// BytesTransferred returns the bytes received from (rx) and sent into (tx) the
+// tunnel through the tun device. The counters reset on each Start and on
+// ResetStats; they are zero when the TunStack does not count traffic.
+func (c *Client) BytesTransferred() (rx, tx uint64) {
+	if tc, ok := c.stack.(trafficCounter); ok {
+		return tc.BytesTransferred()
+	}
+	return 0, 0
+}
+
+// TrafficStats is a snapshot of the tun traffic counters. The fields are
+// int64 so gomobile can bind them.
+type TrafficStats struct {
+	BytesSent       int64 `json:"bytesSent"`
+	BytesReceived   int64 `json:"bytesReceived"`
+	PacketsSent     int64 `json:"packetsSent"`
+	PacketsReceived int64 `json:"packetsReceived"`
+	UptimeSeconds   int64 `json:"uptimeSeconds"`
+}
+
+// TrafficStats returns the tun traffic counters and how long the current run
+// has been up. It only reads atomics, so polling it every second is cheap.
+func (c *Client) TrafficStats() TrafficStats {
+	var s TrafficStats
+	if tc, ok := c.stack.(trafficCounter); ok {
+		rx, tx := tc.BytesTransferred()
+		prx, ptx := tc.PacketsTransferred()
+		s.BytesReceived, s.BytesSent = int64(rx), int64(tx)
+		s.PacketsReceived, s.PacketsSent = int64(prx), int64(ptx)
+	}
+	if r := c.currentRun(); r != nil && !r.finished() {
+		s.UptimeSeconds = int64(time.Since(r.started) / time.Second)
+	}
+	return s
+}
+
+// Connection is an open flow through the tun stack.
+type Connection struct {
+	Protocol    string `json:"protocol"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// Host is the domain behind a fake destination IP, when known.
+	Host       string `json:"host,omitempty"`
+	BytesIn    uint64 `json:"bytesIn"`
+	BytesOut   uint64 `json:"bytesOut"`
+	AgeSeconds int64  `json:"ageSeconds"`
+}
+
+// Connections returns up to limit open flows through the tun stack, oldest
+// first; limit <= 0 returns all of them.
+func (c *Client) Connections(limit int) []Connection {
+	fl, ok := c.stack.(flowLister)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	var conns []Connection
+	for _, f := range fl.Flows(limit) {
+		conns = append(conns, Connection{
+			Protocol:    f.Protocol,
+			Source:      f.Source,
+			Destination: f.Destination,
+			Host:        f.Host,
+			BytesIn:     f.BytesIn,
+			BytesOut:    f.BytesOut,
+			AgeSeconds:  int64(now.Sub(f.Started) / time.Second),
+		})
+	}
+	return conns
+}
+
+// ResetStats sets the tun traffic counters back to zero.
+func (c *Client) ResetStats() {
+	if tc, ok := c.stack.(trafficCounter); ok {
+		tc.ResetCounters()
+	}
+}
+
+// ownTunFd returns a duplicate of fd for the tun stack to own and close, so
+// the caller may close fd even while the tunnel runs, e.g. when Android
+// collects the ParcelFileDescriptor wrapping it. If fd cannot be duplicated
+// it is used as is.
+func ownTunFd(fd int) int {
+	d, err := dupTunFd(fd)
+	if err != nil {
+		log.Printf("Warning: could not duplicate tun fd %d, using it directly: %v", fd, err)
+		return fd
+	}
+	log.Printf("Using tun fd %d, a duplicate of %d", d, fd)
+	return d
+}
+
+// UpdateTunFd moves the running stack to a new tun fd, e.g. after Android
+// re-established the VpnService interface on a network change. The tun stack
+// is restarted with the same options while warp keeps its session. A negative
+// fd stops the tun stack and leaves the client in proxy-only mode. It returns
+// ErrNotRunning when there is no active run and ErrInvalidTunFd, leaving the
+// current fd in use, when fd is not an open descriptor.
+func (c *Client) UpdateTunFd(fd int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.run
+	if r == nil || r.finished() || r.closing {
+		return ErrNotRunning
+	}
+	if c.cfg.UserspaceMode && fd >= 0 {
+		log.Println("Userspace mode: ignoring tun fd", fd)
+		fd = -1
+	}
+	if fd >= 0 {
+		if err := validateTunFd(fd); err != nil {
+			return err
+		}
+	}
+	log.Printf("Updating tun fd from %d to %d", r.fd, fd)
+	if fd >= 0 && c.cfg.DupFd {
+		fd = ownTunFd(fd)
+	}
+	if r.fd >= 0 {
+		if err := c.stack.Stop(); err != nil {
+			log.Printf("tun2socks stop: %v", err)
+		}
+	}
+	r.fd = fd
+	if fd < 0 {
+		log.Println("Proxy-only mode: tun stack stopped")
+		return nil
+	}
+	cfg := c.config(r)
+	if err := c.startTun(r, &cfg); err != nil {
+		err = fmt.Errorf("tun2socks: %w", err)
+		select {
+		case r.errCh <- err:
+		default:
+			// The run already failed for another reason.
+		}
+		r.cancel()
+		return err
+	}
+	return nil
+}
+
+// NetworkChanged restarts the warp layer so it binds new sockets and
+// handshakes again on the new default network instead of waiting for the
+// keepalive to time out. The tun stack is left untouched. It is a no-op when
+// the client is not running. app.RunWarp has no rebind hook, so a restart is
+// the closest equivalent.
+func (c *Client) NetworkChanged() {
+	r := c.currentRun()
+	if r == nil || !c.IsRunning() {
+		return
+	}
+	log.Println("Network changed, restarting warp")
+	if !c.restartWarp(r) {
+		return
+	}
+	c.state.set(StateConnected)
+	log.Println("Warp restarted on the new network")
+}
+
+// NetworkLost marks a running client as reconnecting until NetworkChanged
+// reports a new network. It is a no-op when the client is not running or is
+// paused.
+func (c *Client) NetworkLost() {
+	if !c.IsRunning() || c.State() == StatePaused {
+		return
+	}
+	log.Println("Network lost, waiting for a new one")
+	c.state.set(StateReconnecting)
+}
+
+// Pause stops warp but keeps the tun device and lwip stack up, so the OS
+// still sees the VPN; packets arriving meanwhile get an ICMP destination
+// unreachable. The client moves to StatePaused. It returns ErrNotRunning when
+// there is no active run and is a no-op when already paused.
+func (c *Client) Pause() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.run
+	if r == nil || r.finished() || r.closing {
+		return ErrNotRunning
+	}
+	if r.paused {
+		return nil
+	}
+	log.Println("Pausing: warp stopped, tun traffic rejected")
+	r.paused = true
+	if p, ok := c.stack.(pauser); ok && r.fd >= 0 {
+		p.SetPaused(true)
+	}
+	r.warpCancel()
+	<-r.warpDone
+	c.state.set(StatePaused)
+	return nil
+}
+
+// Resume starts warp again after Pause and lets tun traffic through once it
+// is started. It returns ErrNotRunning when there is no active run and is a
+// no-op when not paused.
+func (c *Client) Resume() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.run
+	if r == nil || r.finished() || r.closing {
+		return ErrNotRunning
+	}
+	if !r.paused {
+		return nil
+	}
+	log.Println("Resuming warp")
+	r.paused = false
+	c.startWarpLocked(r)
+	if p, ok := c.stack.(pauser); ok {
+		p.SetPaused(false)
+	}
+	c.state.set(StateConnected)
+	return nil
+}
+
+// Reconfigure replaces the client's config. While running, only the warp layer
+// is restarted; the tun fd and lwip stack stay up. Settings used by lwip (see
+// Config) cannot change live and make Reconfigure return ErrRestartRequired.
+// When the client is not running the new config is used by the next Start.
+func (c *Client) Reconfigure(cfg *Config) error {
+	if cfg == nil {
+		return errors.New("config must not be nil")
+	}
+	wgFile, err := loadWireGuardFile(cfg.WireGuardConfigFile)
+	if err != nil {
+		return err
+	}
+	applied := *cfg
+	used := applyWireGuardFile(&applied, wgFile)
+	if err := applied.Validate(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.run
+	if r == nil || r.finished() || r.closing {
+		c.cfg = *cfg
+		return nil
+	}
+	if current := c.config(r); !sameTunSettings(&current, &applied) {
+		return ErrRestartRequired
+	}
+	c.cfg = *cfg
+	r.wgFile = wgFile
+	c.webhook.Store(newWebhook(&applied, c.session))
+	if len(used) > 0 {
+		log.Printf("Using %s from %s", strings.Join(used, ", "), cfg.WireGuardConfigFile)
+	}
+	if r.paused {
+		// Resume starts warp with the new config.
+		return nil
+	}
+
+	log.Println("Reconfiguring warp, endpoint:", applied.Endpoint)
+	r.warpCancel()
+	<-r.warpDone
+	c.startWarpLocked(r)
+	return nil
+}
+
+// sameTunSettings reports whether a and b agree on everything lwip uses.
+func sameTunSettings(a, b *Config) bool {
+	return a.BindAddress == b.BindAddress &&
+		a.FakeIPRange == b.FakeIPRange &&
+		a.MTU == b.MTU &&
+		a.AllowLan == b.AllowLan &&
+		strings.Join(a.BypassCIDRs, ",") == strings.Join(b.BypassCIDRs, ",") &&
+		strings.Join(a.RouteCIDRs, ",") == strings.Join(b.RouteCIDRs, ",") &&
+		strings.Join(a.BypassDomains, ",") == strings.Join(b.BypassDomains, ",") &&
+		strings.Join(a.RouteDomains, ",") == strings.Join(b.RouteDomains, ",") &&
+		a.PCAPFile == b.PCAPFile &&
+		strings.Join(a.DNSServers, ",") == strings.Join(b.DNSServers, ",") &&
+		a.EnableIPv6 == b.EnableIPv6 &&
+		a.HTTPProxyAddress == b.HTTPProxyAddress &&
+		a.DOHServer == b.DOHServer &&
+		a.DNSListenAddr == b.DNSListenAddr &&
+		a.DOHFallback == b.DOHFallback &&
+		a.UserspaceMode == b.UserspaceMode &&
+		a.Socks5User == b.Socks5User &&
+		a.Socks5Pass == b.Socks5Pass
+}
+
+// startWarpLocked starts app.RunWarp for r with the current config and keeps
+// restarting it with backoff when it fails. It must be called with c.mu held.
+func (c *Client) startWarpLocked(r *run) {
+	cfg := c.config(r)
+	dir := c.path
+	lwip.SetOutboundInterface(cfg.OutInterface)
+	lwip.SetOutboundMark(cfg.FWMark)
+	ctx, cancel := context.WithCancel(r.ctx)
+	done := make(chan struct{})
+	r.warpCancel, r.warpDone = cancel, done
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer close(done)
+		tryCache := cfg.Scan && !cfg.Rescan
+		// Every start of warp begins again with the first of LicenseKeys.
+		key := 0
+		// Failed psiphon regions fall back to the next one without backoff;
+		// ordinary retries start over with the first.
+		regions := cfg.regions()
+		region := 0
+		for attempt := 1; ; attempt++ {
+			started := time.Now()
+			scan, endpoint := cfg.Scan, cfg.Endpoint
+			cached := false
+			if tryCache {
+				tryCache = false
+				if ec, ok := loadEndpointCache(dir); ok {
+					scan, endpoint, cached = false, ec.Endpoint, true
+					log.Printf("[scanner] trying cached endpoint %s from %s", endpoint, ec.Verified.Format(time.RFC3339))
+				}
+			}
+			if scan {
+				// Scan here rather than inside RunWarp so the results reach
+				// ScanResults; fall back to RunWarp's own scan on failure.
+				results, err := c.scanEndpoints(ctx, &cfg)
+				if err == nil && len(results) == 0 {
+					err = ErrNoEndpointFound
+				}
+				switch {
+				case err == nil:
+					scan, endpoint = false, results[0].Endpoint()
+					log.Println("[scanner] Scan selected endpoint:", endpoint)
+					if err := saveEndpointCache(dir, endpoint); err != nil {
+						log.Println("Failed to cache endpoint:", err)
+					}
+				case ctx.Err() != nil:
+					return
+				case len(cfg.ScanPorts) > 0 || cfg.ScanIPv6:
+					// RunWarp's own scan may pick any port or an IPv4
+					// endpoint, so scan again instead.
+					if !errors.Is(err, ErrNoEndpointFound) {
+						err = fmt.Errorf("%w: %v", ErrNoEndpointFound, err)
+					}
+					err = fmt.Errorf("scan with -scan-ports or -scan-ipv6: %w", err)
+					log.Println("[scanner]", err)
+					if !c.waitRetry(ctx, r, &cfg, attempt, err) {
+						return
+					}
+					continue
+				default:
+					log.Println("[scanner] scan failed, letting warp scan:", err)
+				}
+			}
+			if !scan && endpoint != "" && endpoint != "notset" {
+				ep := endpoint
+				r.endpoint.Store(&ep)
+			}
+			license := cfg.License
+			if len(cfg.LicenseKeys) > 0 {
+				license = "notset"
+				if key < len(cfg.LicenseKeys) {
+					license = cfg.LicenseKeys[key]
+				}
+			}
+			r.license.Store(&license)
+			country := cfg.Country
+			// A region that cannot carry a ping in time is given up on
+			// while there are more to try, and so is a cached endpoint.
+			var timeout time.Duration
+			if cfg.PsiphonEnabled && len(regions) > 0 {
+				country = regions[region]
+				c.setRegion(r, country)
+				if region+1 < len(regions) {
+					timeout = cfg.regionTimeout()
+				}
+			} else {
+				r.region.Store(nil)
+			}
+			if cached && (timeout == 0 || timeout > cachedEndpointTimeout) {
+				timeout = cachedEndpointTimeout
+			}
+			warpCtx, warpCancel := context.WithCancel(ctx)
+			var timedOut atomic.Bool
+			// The probe pings through the tunnel every second until one gets
+			// through, so only run it when its outcome is used.
+			if r.stats != nil || timeout > 0 {
+				warpStarted := time.Now()
+				r.wg.Add(1)
+				go func(endpoint string) {
+					defer r.wg.Done()
+					if c.waitWarpUp(warpCtx, timeout) {
+						c.recordHandshake(r, endpoint, time.Since(warpStarted))
+						if cached {
+							if err := saveEndpointCache(dir, endpoint); err != nil {
+								log.Println("Failed to cache endpoint:", err)
+							}
+						}
+					} else if timeout > 0 && warpCtx.Err() == nil {
+						timedOut.Store(true)
+						warpCancel()
+					}
+				}(endpoint)
+			}
+			err := runWarp(cfg.PsiphonEnabled, cfg.Gool, scan, cfg.Verbose, country, r.warpAddr, endpoint, license, warpCtx, cfg.rttThreshold())
+			warpCancel()
+			r.endpoint.Store(nil)
+			if timedOut.Load() && ctx.Err() == nil {
+				if cached {
+					err = fmt.Errorf("cached endpoint %s did not connect within %v", endpoint, timeout)
+				} else {
+					err = fmt.Errorf("psiphon region %s did not connect within %v", country, timeout)
+				}
+			}
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			log.Println(err)
+			if cached && timedOut.Load() {
+				// The endpoint is dead rather than warp failing; scan
+				// right away.
+				log.Println("[scanner] dropping the cached endpoint and scanning again")
+				removeEndpointCache(dir)
+				attempt = 0
+				continue
+			}
+			if key < len(cfg.LicenseKeys) && c.licenseRefused(err, started) {
+				key++
+				if key < len(cfg.LicenseKeys) {
+					log.Printf("License key %s was refused, trying the next one", redactLicense(license))
+				} else {
+					log.Printf("License key %s was refused and no keys are left, using the free tier", redactLicense(license))
+				}
+				// The endpoint was not at fault; try it again with the new key.
+				tryCache = cached
+				attempt = 0
+				continue
+			}
+			if cfg.PsiphonEnabled && region+1 < len(regions) {
+				region++
+				log.Printf("[psiphon] region %s failed, falling back to %s", country, regions[region])
+				tryCache = cached
+				attempt = 0
+				continue
+			}
+			region = 0
+			if cached {
+				log.Println("[scanner] cached endpoint failed, scanning again")
+				removeEndpointCache(dir)
+			}
+			if time.Since(started) >= stableWarpPeriod {
+				// It was up long enough; treat this as a fresh failure.
+				attempt = 1
+			}
+			// With Scan set, the next RunWarp scans for a new endpoint.
+			if !c.waitRetry(ctx, r, &cfg, attempt, err) {
+				return
+			}
+		}
+	}()
+}
+
+// waitRetry takes err as the failure of warp attempt n and waits out the
+// backoff before the next one. It returns false when warp should not be
+// retried: ctx is done, or cfg.MaxRetries is used up and err ends the run.
+func (c *Client) waitRetry(ctx context.Context, r *run, cfg *Config, n int, err error) bool {
+	if cfg.MaxRetries < 0 || (cfg.MaxRetries > 0 && n > cfg.MaxRetries) {
+		r.errCh <- fmt.Errorf("warp: %w", err)
+		r.cancel()
+		return false
+	}
+	delay := retryDelay(cfg.RetryBackoff, n)
+	log.Printf("Warp failed, retrying in %v (attempt %d)", delay, n)
+	r.attempt.Store(int32(n))
+	c.state.set(StateReconnecting)
+	timer := time.NewTimer(delay)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return false
+	case <-timer.C:
+	}
+	c.state.set(StateConnected)
+	return true
+}
+
+const (
+	// stableWarpPeriod is how long warp must stay up for the retry counter
+	// and backoff to start over.
+	stableWarpPeriod    = time.Minute
+	defaultRetryBackoff = time.Second
+	maxRetryBackoff     = time.Minute
+)
+
+// retryDelay returns the wait before retry attempt n (starting at 1): base
+// doubled for every attempt, capped at maxRetryBackoff, plus up to 20% jitter.
+func retryDelay(base time.Duration, n int) time.Duration {
+	if base <= 0 {
+		base = defaultRetryBackoff
+	}
+	d := base
+	for i := 1; i < n && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// runServer reports fatal errors on r.errCh and cancels the run when one occurs.
+// A negative r.fd selects proxy-only mode: only warp and the proxy listeners run.
+func (c *Client) runServer(r *run) {
+	// Ensuring a cleanup operation even in the case of an error
+	defer func() {
+		// Perform cleanup and exit.
+		c.mu.Lock()
+		if r.fd >= 0 {
+			if err := c.stack.Stop(); err != nil {
+				log.Printf("tun2socks stop: %v", err)
+			}
+		}
+		if r.paused {
+			r.paused = false
+			if p, ok := c.stack.(pauser); ok {
+				p.SetPaused(false)
+			}
+		}
+		c.mu.Unlock()
+		log.Println("Cleanup done, exiting runServer goroutine.")
+		releaseLogFile(r.logFile)
+		r.stats.close()
+
+		defer r.wg.Done()
+	}()
+
+	c.mu.Lock()
+	fd := r.fd
+	c.mu.Unlock()
+	if fd >= 0 {
+		if err := validateTunFd(fd); err != nil {
+			c.mu.Lock()
+			r.fd = -1 // nothing to stop on cleanup
+			c.mu.Unlock()
+			r.errCh <- err
+			r.cancel()
+			return
+		}
+	}
+
+	// Start wireguard-go and gvisor-tun2socks.
+	c.mu.Lock()
+	cfg := c.config(r)
+	c.startWarpLocked(r)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		r.closing = true
+		c.mu.Unlock()
+	}()
+
+	if r.auth != nil {
+		log.Printf("SOCKS5 on %s requires authentication; warp listens without it on %s, reachable by local processes", cfg.BindAddress, r.warpAddr)
+	}
+	if fd < 0 {
+		log.Println("Proxy-only mode: no tun fd, serving SOCKS5 on", cfg.BindAddress)
+		c.state.set(StateConnected)
+	} else if err := c.startTunLocked(r, &cfg); err != nil {
+		r.errCh <- fmt.Errorf("tun2socks: %w", err)
+		r.cancel()
+	} else {
+		c.state.set(StateConnected)
+	}
+	if cfg.SelfTest && r.ctx.Err() == nil {
+		log.Println("Running self-test through", r.warpAddr)
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			c.selfTest(r)
+		}()
+	}
+
+	// Wait for context cancellation.
+	<-r.ctx.Done()
+}
+
+// startTunLocked starts the TunStack on r.fd, forwarding to r's warp
+// listener. It takes c.mu so it does not overlap with UpdateTunFd.
+func (c *Client) startTunLocked(r *run, cfg *Config) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.startTun(r, cfg)
+}
+
+// startTun is startTunLocked for callers that already hold c.mu.
+func (c *Client) startTun(r *run, cfg *Config) error {
+	fd := r.fd
+	routes := r.routes.merged(cfg)
+	tun2socksStartOptions := &lwip.Tun2socksStartOptions{
+		TunFd:         fd,
+		Socks5Server:  strings.Replace(r.warpAddr, "0.0.0.0", "127.0.0.1", -1),
+		FakeIPRange:   cfg.FakeIPRange,
+		MTU:           cfg.MTU,
+		EnableIPv6:    cfg.EnableIPv6,
+		AllowLan:      cfg.AllowLan,
+		BypassCIDRs:   routes.BypassCIDRs,
+		RouteCIDRs:    routes.RouteCIDRs,
+		BypassDomains: routes.BypassDomains,
+		RouteDomains:  routes.RouteDomains,
+		PCAPFile:      cfg.PCAPFile,
+	}
+	if doh := r.doh; doh != nil {
+		tun2socksStartOptions.ResolveDNS = func(query []byte) []byte {
+			return doh.resolve(r.ctx, query)
+		}
+	} else {
+		for _, server := range cfg.DNSServers {
+			if addr, err := normalizeDNSServer(server); err == nil {
+				tun2socksStartOptions.DNSServers = append(tun2socksStartOptions.DNSServers, addr)
+			}
+		}
+	}
+	log.Println("Tun mode: routing tun fd", fd, "through warp")
+	if cfg.AllowLan {
+		log.Println("LAN traffic bypasses the tunnel:", strings.Join(lanRanges, ", "))
+	} else {
+		log.Println("LAN traffic goes through the tunnel")
+	}
+	logRoutingRules(routes)
+	if r.doh != nil && cfg.FakeIPRange != "" {
+		log.Println("Tunnel DNS: A and AAAA from the fake DNS, other queries over DoH to:", cfg.DOHServer)
+	} else if r.doh != nil {
+		log.Println("Tunnel DNS goes over DoH to:", cfg.DOHServer)
+	} else if len(tun2socksStartOptions.DNSServers) > 0 {
+		log.Println("Tunnel DNS goes to:", strings.Join(tun2socksStartOptions.DNSServers, ", "))
+	}
+	if cfg.EnableIPv6 {
+		log.Println("Tun stack mode: dual-stack")
+	} else {
+		log.Println("Tun stack mode: ipv4 only, AAAA queries get empty answers")
+	}
+	if cfg.MTU > 0 {
+		log.Printf("Using tun mtu %d", cfg.MTU)
+	} else {
+		log.Println("Using the engine default tun mtu")
+	}
+	return c.stack.Start(tun2socksStartOptions)
+}
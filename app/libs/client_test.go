@@ -0,0 +1,141 @@
+package tun2socks
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestClientRestart starts and stops the same client ten times on a fake
+// tun fd. Run with -race.
+func TestClientRestart(t *testing.T) {
+	fakeWarp(t)
+	dir := testDir(t)
+	fd := testTunFd(t)
+	c := NewClient(NewConfig())
+	stack := &MockTunStack{}
+	c.SetTunStack(stack)
+	for i := 0; i < 10; i++ {
+		if err := c.Start(dir, fd); err != nil {
+			t.Fatalf("start %d: %v", i, err)
+		}
+		waitConnected(t, c)
+		if err := c.Stop(); err != nil {
+			t.Fatalf("stop %d: %v", i, err)
+		}
+		if err := c.Wait(); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+		if got := c.State(); got != StateDisconnected {
+			t.Fatalf("state after stop %d = %v, want disconnected", i, got)
+		}
+	}
+	if starts, stops := stack.calls(); starts != 10 || stops != 10 {
+		t.Errorf("stack started %d and stopped %d times, want 10 and 10", starts, stops)
+	}
+}
+
+// TestRunWarpRestart does the same through the package-level RunWarp and
+// Shutdown, which replace the default client on every run.
+func TestRunWarpRestart(t *testing.T) {
+	fakeWarp(t)
+	dir := testDir(t)
+	var prev *Client
+	for i := 0; i < 10; i++ {
+		done := make(chan error, 1)
+		go func() { done <- RunWarp("-b 127.0.0.1:8086 -rtt 500", dir, -1) }()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if c := currentClient(); c != nil && c != prev && c.State() == StateConnected {
+				prev = c
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("run %d did not connect", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if err := Shutdown(); err != nil {
+			t.Fatalf("shutdown %d: %v", i, err)
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("RunWarp %d: %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("RunWarp %d did not return after Shutdown", i)
+		}
+	}
+}
+
+type acceptAllProtector struct{}
+
+func (acceptAllProtector) Protect(int) bool { return true }
+
+// countLogs returns how many of c's buffered lines contain s.
+func countLogs(c *Client, s string) int {
+	n := 0
+	for _, ev := range c.logs.since(time.Time{}) {
+		if strings.Contains(ev.Message, s) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestStartWarnsProtectorCoverage(t *testing.T) {
+	fakeWarp(t)
+	dir := testDir(t)
+	RegisterSocketProtector(acceptAllProtector{})
+	defer RegisterSocketProtector(nil)
+	protectorWarned.Store(false)
+
+	c := NewClient(NewConfig())
+	c.SetTunStack(&MockTunStack{})
+	for i := 0; i < 2; i++ {
+		if err := c.Start(dir, -1); err != nil {
+			t.Fatal(err)
+		}
+		waitConnected(t, c)
+		if err := c.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countLogs(c, "WireGuard, scanner and API sockets are not protected"); n != 1 {
+		t.Errorf("protector warning logged %d times over two starts, want once", n)
+	}
+}
+
+func TestStartNotesOutInterfaceCoverage(t *testing.T) {
+	fakeWarp(t)
+	cfg := NewConfig()
+	cfg.OutInterface = "rmnet0"
+	c := NewClient(cfg)
+	c.SetTunStack(&MockTunStack{})
+	if err := c.Start(testDir(t), -1); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	waitConnected(t, c)
+	if n := countLogs(c, "Binding direct flows and webhooks to rmnet0; warp's WireGuard, scanner and API sockets use the default network"); n != 1 {
+		t.Errorf("out-interface note logged %d times, want once", n)
+	}
+}
+
+func TestStartLogsFWMark(t *testing.T) {
+	fakeWarp(t)
+	cfg := NewConfig()
+	cfg.FWMark = 51820
+	c := NewClient(cfg)
+	c.SetTunStack(&MockTunStack{})
+	if err := c.Start(testDir(t), -1); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	waitConnected(t, c)
+	if n := countLogs(c, "fwmark 51820 (0xca6c); warp's WireGuard, scanner and API sockets are not marked"); n != 1 {
+		t.Errorf("fwmark note logged %d times, want once", n)
+	}
+}
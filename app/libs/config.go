@@ -0,0 +1,615 @@
+package tun2socks
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	minMTU = 576
+	maxMTU = 65535
+
+	// legacyFakeIPRange is the historical default. It is publicly routed, so
+	// it is kept for one more release only; see CHANGELOG.md.
+	legacyFakeIPRange = "24.0.0.0/8"
+	// recommendedFakeIPRange is reserved for benchmarking (RFC 2544) and
+	// will become the default.
+	recommendedFakeIPRange = "198.18.0.0/15"
+)
+
+// lanRanges are the networks AllowLan is about: private, link-local and
+// carrier-grade NAT space.
+var lanRanges = []string{
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// Config holds the settings used to start the warp stack. It is the typed
+// equivalent of the flags accepted by RunWarp.
+//
+// BindAddress, HTTPProxyAddress, the DNS proxy settings, FakeIPRange, MTU,
+// AllowLan, the CIDR and domain routing rules, UserspaceMode, EnableIPv6,
+// DNSServers, PCAPFile and the SOCKS5 credentials are used by the tun2socks
+// layer, so changing them requires a full restart; every other warp setting
+// can be changed with Reconfigure.
+type Config struct {
+	Verbose        bool
+	BindAddress    string
+	Endpoint       string
+	License        string
+	Country        string
+	PsiphonEnabled bool
+	Gool           bool
+	Scan           bool
+	// Rescan makes a start with Scan set ignore the endpoint cached by an
+	// earlier scan under the path passed to Start. Without it the cached
+	// endpoint gets 10 seconds to carry a ping before a scan runs instead.
+	Rescan bool
+	// RTT is the scanner threshold in milliseconds; -1 means no threshold.
+	RTT int
+	// WireGuardConfigFile is a wg-quick style file (wg0.conf) whose peer
+	// Endpoint, interface MTU and interface DNS are used when Endpoint, MTU
+	// and DNSServers are unset. It is read again on every Start. Warp keeps
+	// its own keys and routes everything, so PrivateKey, PublicKey and
+	// AllowedIPs are only checked.
+	WireGuardConfigFile string
+	// ScanPorts limits scan results to endpoints on these ports. The bundled
+	// scanner picks the ports it probes itself, so a port it never tries
+	// cannot win. When no result matches, warp is retried with backoff
+	// rather than left to scan on its own, which could use any port.
+	ScanPorts []int
+	// ScanIPv6 limits scan results to IPv6 endpoints, for IPv6-only networks,
+	// and like ScanPorts never lets warp fall back to its own scan. Besides
+	// the IPv6 endpoints the bundled scanner reports, addresses in warp's
+	// ranges 2606:4700:d0::/48 and 2606:4700:d1::/48 are pinged directly
+	// and those answering within RTT are used on the ScanPorts, or 2408.
+	// Where ping sockets are not allowed, only the scanner's results remain.
+	ScanIPv6 bool
+	// LicenseKeys, when set, are used instead of License: warp starts with
+	// the first key and moves on to the next whenever a key is refused, e.g.
+	// because a shared WARP+ key reached its device limit, ending on the free
+	// tier once every key was refused. See Client.CurrentLicense.
+	LicenseKeys []string
+	// RegionTimeoutSecs is how long a psiphon region gets to connect when
+	// Country is a comma-separated priority list such as "NL,DE,FR"; zero
+	// means 30. A region that fails or times out makes warp fall back to the
+	// next one. See Client.PsiphonRegion and GetPsiphonRegions.
+	RegionTimeoutSecs int
+	// OutInterface, when set, binds the sockets this library opens to the
+	// outside, such as direct flows and webhook deliveries, to the interface
+	// of that name; see lwip.SetOutboundInterface. It takes effect whenever
+	// warp starts. It does not move the tunnel itself: the WireGuard UDP
+	// socket, the scanner probes and the API calls of app.RunWarp are created
+	// inside the wireguard layer, which offers no hook, and keep using the
+	// default network. Start logs a reminder of this.
+	OutInterface string
+	// FWMark, when non-zero, is set with SO_MARK on the same sockets, for
+	// policy routing with ip rule fwmark. Where the mark cannot be set, e.g.
+	// without CAP_NET_ADMIN, a warning is logged once and they go out
+	// unmarked. Like OutInterface it does not reach the sockets app.RunWarp
+	// opens: the WireGuard UDP socket, the scanner probes and the API calls
+	// go out unmarked, so an ip rule on the mark does not route the tunnel
+	// itself. Start logs the mark along with this reminder.
+	FWMark int
+
+	// FakeIPRange is the CIDR handed out by the fake DNS; empty disables fake DNS.
+	FakeIPRange string
+	// MTU of the tun device, between 576 and 65535; zero lets the engine pick.
+	MTU int
+	// AllowLan lets traffic to the lanRanges bypass the tunnel. It defaults to
+	// true for compatibility; set it to false for full-tunnel behaviour.
+	AllowLan bool
+	// BypassCIDRs are destinations the tun stack connects to directly
+	// instead of through warp, e.g. a corporate 10.0.0.0/8.
+	BypassCIDRs []string
+	// RouteCIDRs, when set, restrict warp to these destinations; everything
+	// else is connected to directly. Where BypassCIDRs and RouteCIDRs overlap
+	// the longest prefix wins, e.g. routing 10.0.0.0/8 but bypassing
+	// 10.1.0.0/16.
+	RouteCIDRs []string
+	// BypassDomains and RouteDomains do the same for domain suffixes, so
+	// example.com also matches sub.example.com and "*.ir" every .ir host.
+	// They rely on the fake DNS to know the host behind an address, so they
+	// need FakeIPRange, and take precedence over the CIDR rules. More rules can
+	// be kept in routing-rules.txt under the path passed to Start, see
+	// Client.ReloadRoutingRules.
+	BypassDomains []string
+	RouteDomains  []string
+	// EnableIPv6 lets the tun2socks stack handle IPv6 traffic. When false, DNS
+	// AAAA queries are answered with an empty response so dual-stack clients
+	// fall back to IPv4 right away.
+	EnableIPv6 bool
+	// DNSServers, as ip or ip:port, receive every DNS query the tun device
+	// carries, whatever server the device asked; each session goes to the
+	// next one in turn. Warp's own lookups are not affected.
+	DNSServers []string
+	// PCAPFile, when set, gets a copy of every packet on the tun device in
+	// libpcap format (raw IP), appended if the file already exists. Packets
+	// are dropped from the capture rather than slowing the tunnel down.
+	PCAPFile string
+
+	// HTTPProxyAddress, when set, starts an HTTP proxy there that forwards
+	// CONNECT tunnels and plain HTTP requests through warp.
+	HTTPProxyAddress string
+
+	// DOHServer, when set, is a DNS-over-HTTPS URL such as
+	// https://1.1.1.1/dns-query. The tun device's DNS is then resolved over it
+	// through warp, answering names from /etc/hosts locally and caching
+	// responses for their TTL. DNSListenAddr, when also set, serves the same
+	// resolver as a local DNS server, e.g. on 127.0.0.1:5353; it is off by
+	// default since unprivileged apps cannot bind port 53. With FakeIPRange set, A
+	// and AAAA queries on the tun device are still answered by the fake DNS,
+	// so the domain rules keep working; only other types go over DoH.
+	DOHServer     string
+	DNSListenAddr string
+	// DOHFallback lets queries fall back to plain DNS over TCP through warp,
+	// to DNSServers or 1.1.1.1, while the DoH server has not answered once
+	// since Start, e.g. when it is blocked.
+	DOHFallback bool
+
+	// ManagementAddr, when set, serves the REST/JSON management API there for
+	// as long as the client runs; changes take effect on the next Start.
+	ManagementAddr string
+	// MetricsAddr, when set, serves Prometheus metrics at /metrics there,
+	// e.g. ":2112"; like ManagementAddr it is read on Start.
+	MetricsAddr string
+
+	// WebhookURL, when set, receives a POST of {"event", "session", "ts"}
+	// whenever the client becomes connected, reconnecting or disconnected.
+	// With WebhookSecret set, the X-Oblivion-Signature header carries
+	// "sha256=" and the hex HMAC-SHA256 of the body keyed by the secret.
+	WebhookURL    string
+	WebhookSecret string
+
+	// Socks5User and Socks5Pass, when set, make the SOCKS5 listener on
+	// BindAddress require RFC 1929 username/password authentication. They are
+	// never written to the logs. That listener is a front-end: warp itself
+	// serves SOCKS5 without authentication on a random loopback port, which
+	// the tun stack, the HTTP proxy and the DNS proxy use directly. Other
+	// devices cannot reach it, but other processes on this one can.
+	Socks5User string
+	Socks5Pass string
+	// StrictBindCheck makes Start fail with ErrExposedBind, rather than log a
+	// warning, when BindAddress is reachable from other devices and no SOCKS5
+	// credentials are set, or when HTTPProxyAddress, ManagementAddr,
+	// MetricsAddr or DNSListenAddr is, since none of them authenticates.
+	StrictBindCheck bool
+
+	// UserspaceMode runs warp entirely in userspace: wireguard-go already
+	// uses its netstack backend and serves SOCKS5 on BindAddress, so the tun
+	// stack is skipped and any tun fd passed to Start or UpdateTunFd is
+	// ignored. It is meant for containers without CAP_NET_ADMIN, where no tun
+	// device can be created.
+	UserspaceMode bool
+	// DupFd makes Start and UpdateTunFd duplicate the tun fd and hand the
+	// copy to the tun stack, so the caller closing its fd, e.g. through a
+	// garbage-collected ParcelFileDescriptor, does not take the tunnel down.
+	// NewConfig sets it.
+	DupFd bool
+
+	// SelfTest makes the run fetch the Cloudflare trace through the SOCKS5
+	// proxy once it is up and end with ErrSelfTestFailed unless the trace
+	// reports warp=on (or plus) within 10 seconds, for CI and integration
+	// tests. See Client.SelfTestResult.
+	SelfTest bool
+
+	// IdleTimeoutSecs, when positive, restarts warp after that many seconds
+	// without tun traffic in either direction while connected, to recover
+	// from a silently dead session. Zero disables the watchdog.
+	IdleTimeoutSecs int
+
+	// MaxRetries limits how often warp is restarted after it fails; zero
+	// retries until stopped and a negative value disables retrying.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubled on every
+	// further attempt up to one minute; zero means one second.
+	RetryBackoff time.Duration
+
+	// StatsFile, when set, gets a JSON line of {"ts", "endpoint",
+	// "session_id", "handshake_ms", "rx_bytes", "tx_bytes"} appended every
+	// time warp comes up; see Client.LastHandshake for what counts as a
+	// handshake. Start warns when its last line is more than a day old.
+	StatsFile string
+
+	// LogFile, when set, is where captured lines are written while the client
+	// runs, in place of the EnableFileLogging file. It rotates once it reaches
+	// LogMaxSizeMB (zero means 10) and keeps 3 old files.
+	LogFile      string
+	LogMaxSizeMB int
+
+	// LogBufferSize is how many lines Client.Logs keeps; zero means 4096.
+	LogBufferSize int
+	// LogChannelSize is the capacity of the Client.LogCh channel; zero means 256.
+	LogChannelSize int
+}
+
+// NewConfig returns a Config filled with the same defaults as the RunWarp flags.
+func NewConfig() *Config {
+	return &Config{
+		BindAddress: "127.0.0.1:8086",
+		Endpoint:    "notset",
+		License:     "notset",
+		RTT:         1000,
+		FakeIPRange: legacyFakeIPRange,
+		AllowLan:    true,
+		EnableIPv6:  true,
+		DupFd:       true,
+	}
+}
+
+// FieldError is a problem with one Config field.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e FieldError) Error() string { return e.Err.Error() }
+func (e FieldError) Unwrap() error { return e.Err }
+
+// ValidationError lists every invalid field of a Config.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) add(field string, err error) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Err: err})
+}
+
+// Validate checks the whole config and returns a *ValidationError listing
+// every invalid field, or nil.
+func (c *Config) Validate() error {
+	v := &ValidationError{}
+	if err := validateHostPort(c.BindAddress); err != nil {
+		v.add("BindAddress", fmt.Errorf("invalid bind address %q: %w", c.BindAddress, err))
+	}
+	if c.HTTPProxyAddress != "" {
+		if err := validateHostPort(c.HTTPProxyAddress); err != nil {
+			v.add("HTTPProxyAddress", fmt.Errorf("invalid http proxy address %q: %w", c.HTTPProxyAddress, err))
+		}
+	}
+	if c.DOHServer != "" {
+		if u, err := url.Parse(c.DOHServer); err != nil || u.Scheme != "https" || u.Host == "" {
+			v.add("DOHServer", fmt.Errorf("invalid doh server %q: must be an absolute https url", c.DOHServer))
+		}
+	}
+	if c.DNSListenAddr != "" {
+		if err := validateHostPort(c.DNSListenAddr); err != nil {
+			v.add("DNSListenAddr", fmt.Errorf("invalid dns listen address %q: %w", c.DNSListenAddr, err))
+		}
+	}
+	if c.ManagementAddr != "" {
+		if err := validateHostPort(c.ManagementAddr); err != nil {
+			v.add("ManagementAddr", fmt.Errorf("invalid management address %q: %w", c.ManagementAddr, err))
+		}
+	}
+	if c.MetricsAddr != "" {
+		addr := c.MetricsAddr
+		if strings.HasPrefix(addr, ":") {
+			// A bare port listens on every interface.
+			addr = "0.0.0.0" + addr
+		}
+		if err := validateHostPort(addr); err != nil {
+			v.add("MetricsAddr", fmt.Errorf("invalid metrics address %q: %w", c.MetricsAddr, err))
+		}
+	}
+	if c.WebhookURL != "" {
+		if u, err := url.Parse(c.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add("WebhookURL", fmt.Errorf("invalid webhook url %q: must be an absolute http or https url", c.WebhookURL))
+		}
+	}
+	if c.Endpoint != "" && c.Endpoint != "notset" {
+		if err := validateHostPort(c.Endpoint); err != nil {
+			v.add("Endpoint", fmt.Errorf("invalid endpoint %q: %w", c.Endpoint, err))
+		}
+	}
+	if c.OutInterface != "" && (len(c.OutInterface) >= 16 || strings.ContainsAny(c.OutInterface, "/ \t")) {
+		v.add("OutInterface", fmt.Errorf("invalid interface name %q", c.OutInterface))
+	}
+	if c.FWMark < 0 || int64(c.FWMark) > math.MaxUint32 {
+		v.add("FWMark", fmt.Errorf("invalid fwmark %d: must be between 0 and %d", c.FWMark, uint32(math.MaxUint32)))
+	}
+	for _, key := range c.LicenseKeys {
+		if strings.TrimSpace(key) == "" || key == "notset" {
+			v.add("LicenseKeys", fmt.Errorf("invalid license key %q", key))
+		}
+	}
+	for _, code := range c.regions() {
+		check := ValidateCountryCode
+		if c.PsiphonEnabled {
+			check = validatePsiphonRegion
+		}
+		if err := check(code); err != nil {
+			v.add("Country", err)
+		}
+	}
+	if c.RegionTimeoutSecs < 0 {
+		v.add("RegionTimeoutSecs", fmt.Errorf("invalid region timeout %d: must not be negative", c.RegionTimeoutSecs))
+	}
+	if c.RTT < -1 {
+		v.add("RTT", fmt.Errorf("invalid rtt %d: must be -1 or more", c.RTT))
+	}
+	for _, p := range c.ScanPorts {
+		if p < 1 || p > 65535 {
+			v.add("ScanPorts", fmt.Errorf("invalid scan port %d: must be between 1 and 65535", p))
+		}
+	}
+	if c.FakeIPRange != "" {
+		if _, _, err := net.ParseCIDR(c.FakeIPRange); err != nil {
+			v.add("FakeIPRange", fmt.Errorf("invalid fake ip range %q: %w", c.FakeIPRange, err))
+		}
+	}
+	if (c.Socks5User == "") != (c.Socks5Pass == "") {
+		v.add("Socks5User", errors.New("socks5 user and password must be set together"))
+	}
+	if len(c.Socks5User) > 255 || len(c.Socks5Pass) > 255 {
+		v.add("Socks5User", errors.New("socks5 user and password must be at most 255 bytes"))
+	}
+	bypassed := make(map[string]bool)
+	for _, cidr := range c.BypassCIDRs {
+		if _, ipnet, err := net.ParseCIDR(cidr); err != nil {
+			v.add("BypassCIDRs", fmt.Errorf("invalid bypass cidr %q: %w", cidr, err))
+		} else {
+			bypassed[ipnet.String()] = true
+		}
+	}
+	for _, cidr := range c.RouteCIDRs {
+		if _, ipnet, err := net.ParseCIDR(cidr); err != nil {
+			v.add("RouteCIDRs", fmt.Errorf("invalid route cidr %q: %w", cidr, err))
+		} else if bypassed[ipnet.String()] {
+			v.add("RouteCIDRs", fmt.Errorf("route cidr %q is also bypassed", cidr))
+		}
+	}
+	for _, server := range c.DNSServers {
+		if _, err := normalizeDNSServer(server); err != nil {
+			v.add("DNSServers", err)
+		}
+	}
+	bypassedDomains := make(map[string]bool)
+	for _, d := range c.BypassDomains {
+		if err := validateDomainPattern(d); err != nil {
+			v.add("BypassDomains", err)
+		} else {
+			bypassedDomains[domainSuffix(d)] = true
+		}
+	}
+	for _, d := range c.RouteDomains {
+		if err := validateDomainPattern(d); err != nil {
+			v.add("RouteDomains", err)
+		} else if bypassedDomains[domainSuffix(d)] {
+			v.add("RouteDomains", fmt.Errorf("route domain %q is also bypassed", d))
+		}
+	}
+	if len(c.BypassDomains)+len(c.RouteDomains) > 0 && c.FakeIPRange == "" {
+		v.add("FakeIPRange", errors.New("bypass and route domains need a fake ip range"))
+	}
+	if c.MTU != 0 && (c.MTU < minMTU || c.MTU > maxMTU) {
+		v.add("MTU", fmt.Errorf("invalid mtu %d: must be 0 or between %d and %d", c.MTU, minMTU, maxMTU))
+	}
+	if c.LogMaxSizeMB < 0 {
+		v.add("LogMaxSizeMB", fmt.Errorf("invalid log max size %d: must not be negative", c.LogMaxSizeMB))
+	}
+	if c.IdleTimeoutSecs < 0 {
+		v.add("IdleTimeoutSecs", fmt.Errorf("invalid idle timeout %d: must not be negative", c.IdleTimeoutSecs))
+	}
+	if c.RetryBackoff < 0 {
+		v.add("RetryBackoff", fmt.Errorf("invalid retry backoff %v: must not be negative", c.RetryBackoff))
+	}
+	if len(v.Fields) > 0 {
+		return v
+	}
+	return nil
+}
+
+// checkFakeIPRange returns an error if cidr overlaps a network the host is
+// attached to, since traffic to it would be swallowed by the fake DNS.
+func checkFakeIPRange(cidr string) error {
+	if cidr == "" {
+		return nil
+	}
+	_, fake, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid fake ip range %q: %w", cidr, err)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		// Not every platform lets us list interfaces (e.g. recent Android).
+		log.Println("Skipping fake ip range overlap check:", err)
+		return nil
+	}
+	for _, addr := range addrs {
+		local, ok := addr.(*net.IPNet)
+		if !ok || local.IP.IsLoopback() {
+			continue
+		}
+		if fake.Contains(local.IP) || local.Contains(fake.IP) {
+			return fmt.Errorf("fake ip range %s overlaps local network %s", cidr, local)
+		}
+	}
+	return nil
+}
+
+// checkBindExposure warns about every local listener that is reachable from
+// other devices, listing the addresses it would be reachable on. Only the
+// SOCKS5 listener can require credentials, so with StrictBindCheck set an
+// exposed listener without them makes it return ErrExposedBind instead. An
+// exposed HTTP proxy is always an error once the SOCKS5 credentials are set,
+// since it would let anyone around them.
+func checkBindExposure(cfg *Config) error {
+	if exposed := exposedAddrs(cfg.BindAddress); len(exposed) > 0 {
+		on := strings.Join(exposed, ", ")
+		switch {
+		case cfg.Socks5User != "":
+			log.Printf("Warning: SOCKS5 on %s is reachable from other devices on %s; only the credentials protect it", cfg.BindAddress, on)
+		case cfg.StrictBindCheck:
+			return fmt.Errorf("%w: %s is reachable on %s; bind to 127.0.0.1 or set -socks5-user and -socks5-pass", ErrExposedBind, cfg.BindAddress, on)
+		default:
+			log.Printf("Warning: SOCKS5 on %s is reachable from other devices on %s without authentication; set -socks5-user and -socks5-pass", cfg.BindAddress, on)
+		}
+	}
+	if cfg.HTTPProxyAddress != "" && cfg.Socks5User != "" {
+		if exposed := exposedAddrs(cfg.HTTPProxyAddress); len(exposed) > 0 {
+			return fmt.Errorf("%w: the http proxy on %s is reachable on %s and would bypass the socks5 credentials; bind it to 127.0.0.1",
+				ErrExposedBind, cfg.HTTPProxyAddress, strings.Join(exposed, ", "))
+		}
+	}
+	type listener struct{ name, addr string }
+	listeners := []listener{
+		{"the HTTP proxy", cfg.HTTPProxyAddress},
+		{"the management API", cfg.ManagementAddr},
+		{"metrics", cfg.MetricsAddr},
+	}
+	if cfg.DOHServer != "" {
+		listeners = append(listeners, listener{"the DNS proxy", cfg.DNSListenAddr})
+	}
+	for _, l := range listeners {
+		if l.addr == "" {
+			continue
+		}
+		exposed := exposedAddrs(l.addr)
+		if len(exposed) == 0 {
+			continue
+		}
+		on := strings.Join(exposed, ", ")
+		if cfg.StrictBindCheck {
+			return fmt.Errorf("%w: %s on %s is reachable on %s; bind it to 127.0.0.1", ErrExposedBind, l.name, l.addr, on)
+		}
+		log.Printf("Warning: %s on %s is reachable from other devices on %s without authentication", l.name, l.addr, on)
+	}
+	return nil
+}
+
+// exposedAddrs returns the non-loopback addresses a listener on addr would
+// accept connections on. For the unspecified address these are the host's
+// interface addresses, IPv4 only for 0.0.0.0 and all of them for :: or an
+// empty host; when interfaces cannot be listed the bind host is returned.
+func exposedAddrs(addr string) []string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	if host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else if ips, err = net.LookupIP(host); err != nil {
+			return nil
+		}
+	}
+	var exposed []string
+	for _, ip := range ips {
+		switch {
+		case ip.IsLoopback():
+		case ip.IsUnspecified():
+			return interfaceAddrs(host, ip.To4() != nil)
+		default:
+			exposed = append(exposed, ip.String())
+		}
+	}
+	if host == "" {
+		return interfaceAddrs("::", false)
+	}
+	return exposed
+}
+
+func interfaceAddrs(host string, ipv4Only bool) []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		// Not every platform lets us list interfaces (e.g. recent Android).
+		return []string{host}
+	}
+	var list []string
+	for _, addr := range addrs {
+		local, ok := addr.(*net.IPNet)
+		if !ok || local.IP.IsLoopback() || (ipv4Only && local.IP.To4() == nil) {
+			continue
+		}
+		list = append(list, local.IP.String())
+	}
+	if len(list) == 0 {
+		return []string{host}
+	}
+	return list
+}
+
+// domainSuffix turns a pattern such as "*.Example.com." into "example.com".
+func domainSuffix(pattern string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(pattern, "*."), "."))
+}
+
+func validateDomainPattern(pattern string) error {
+	d := domainSuffix(pattern)
+	if d == "" || strings.ContainsAny(d, " /:*") {
+		return fmt.Errorf("invalid domain %q", pattern)
+	}
+	for _, label := range strings.Split(d, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid domain %q", pattern)
+		}
+	}
+	return nil
+}
+
+func validateHostPort(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+			return errors.New("ipv6 addresses must be in brackets, e.g. [2606:4700:d0::a]:2408")
+		}
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// normalizeDNSServer returns server, an IP address with an optional port, as
+// ip:port with port 53 by default.
+func normalizeDNSServer(server string) (string, error) {
+	if ip := net.ParseIP(strings.Trim(server, "[]")); ip != nil {
+		return net.JoinHostPort(ip.String(), "53"), nil
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil || net.ParseIP(host) == nil {
+		err = errors.New("must be an ip address with an optional port")
+	} else {
+		err = validateHostPort(server)
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid dns server %q: %w", server, err)
+	}
+	return server, nil
+}
+
+// rttThreshold returns the RTT handed to the scanner, mapping -1 to a value
+// no endpoint will exceed.
+func (c *Config) rttThreshold() int {
+	if c.RTT < 0 {
+		return math.MaxInt32
+	}
+	return c.RTT
+}
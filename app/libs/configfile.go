@@ -0,0 +1,147 @@
+package tun2socks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// configFileVersion is bumped when the exported format changes incompatibly.
+const configFileVersion = 1
+
+// configKeyLabel separates the config key from anything else derived from
+// the same salt.
+const configKeyLabel = "oblivion config v1"
+
+// configFile is the exported form of a Config. The secrets are sealed with
+// AES-GCM and shadow the plain fields of the embedded Config.
+type configFile struct {
+	Version int
+	Config
+	License       string   `json:",omitempty"`
+	LicenseKeys   []string `json:",omitempty"`
+	Socks5Pass    string   `json:",omitempty"`
+	WebhookSecret string   `json:",omitempty"`
+}
+
+// ExportConfig writes cfg to w as JSON so it can be kept across app upgrades.
+// The license keys, SOCKS5 password and webhook secret are encrypted with
+// AES-256-GCM using a key derived from salt, which should be specific to the
+// device; the same salt is needed to import the config again.
+func ExportConfig(cfg Config, w io.Writer, salt []byte) error {
+	aead, err := configCipher(salt)
+	if err != nil {
+		return err
+	}
+	f := configFile{Version: configFileVersion, Config: cfg}
+	if f.License, err = sealSecret(aead, cfg.License); err != nil {
+		return err
+	}
+	for _, key := range cfg.LicenseKeys {
+		sealed, err := sealSecret(aead, key)
+		if err != nil {
+			return err
+		}
+		f.LicenseKeys = append(f.LicenseKeys, sealed)
+	}
+	if f.Socks5Pass, err = sealSecret(aead, cfg.Socks5Pass); err != nil {
+		return err
+	}
+	if f.WebhookSecret, err = sealSecret(aead, cfg.WebhookSecret); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(f)
+}
+
+// ImportConfig reads a config written by ExportConfig with the same salt.
+// Fields missing from the input keep their NewConfig defaults, and the result
+// is checked like RunWarpWithConfig does; an invalid config is returned along
+// with a *ValidationError listing every invalid field.
+func ImportConfig(r io.Reader, salt []byte) (Config, error) {
+	aead, err := configCipher(salt)
+	if err != nil {
+		return Config{}, err
+	}
+	f := configFile{Config: *NewConfig()}
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return Config{}, fmt.Errorf("decode config: %w", err)
+	}
+	if f.Version != configFileVersion {
+		return Config{}, fmt.Errorf("unsupported config version %d", f.Version)
+	}
+	cfg := f.Config
+	if cfg.License, err = openSecret(aead, f.License); err != nil {
+		return Config{}, fmt.Errorf("license: %w", err)
+	}
+	cfg.LicenseKeys = nil
+	for i, sealed := range f.LicenseKeys {
+		key, err := openSecret(aead, sealed)
+		if err != nil {
+			return Config{}, fmt.Errorf("license key %d: %w", i+1, err)
+		}
+		cfg.LicenseKeys = append(cfg.LicenseKeys, key)
+	}
+	if cfg.Socks5Pass, err = openSecret(aead, f.Socks5Pass); err != nil {
+		return Config{}, fmt.Errorf("socks5 password: %w", err)
+	}
+	if cfg.WebhookSecret, err = openSecret(aead, f.WebhookSecret); err != nil {
+		return Config{}, fmt.Errorf("webhook secret: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func configCipher(salt []byte) (cipher.AEAD, error) {
+	if len(salt) == 0 {
+		return nil, errors.New("config salt must not be empty")
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(configKeyLabel))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealSecret returns the base64 of nonce||ciphertext, or "" for an empty
+// secret.
+func sealSecret(aead cipher.AEAD, secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+func openSecret(aead cipher.AEAD, sealed string) (string, error) {
+	if sealed == "" {
+		return "", nil
+	}
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < aead.NonceSize() {
+		return "", errors.New("sealed value too short")
+	}
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("cannot decrypt; wrong salt?")
+	}
+	return string(plain), nil
+}
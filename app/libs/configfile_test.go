@@ -0,0 +1,87 @@
+package tun2socks
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testExportConfig returns a valid config with every secret set.
+func testExportConfig() Config {
+	cfg := *NewConfig()
+	cfg.License = "a1B2c3D4-e5F6g7H8-i9J0k1L2"
+	cfg.LicenseKeys = []string{"m3N4o5P6-q7R8s9T0-u1V2w3X4", "y5Z6a7B8-c9D0e1F2-g3H4i5J6"}
+	cfg.Socks5User = "user"
+	cfg.Socks5Pass = "s0cks-p4ss-word"
+	cfg.WebhookURL = "https://example.com/hook"
+	cfg.WebhookSecret = "w3bh00k-s3cr3t"
+	cfg.BypassCIDRs = []string{"10.0.0.0/8"}
+	cfg.ScanPorts = []int{2408, 500}
+	return cfg
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	cfg := testExportConfig()
+	salt := []byte("device-1234")
+	var buf bytes.Buffer
+	if err := ExportConfig(cfg, &buf, salt); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ImportConfig(bytes.NewReader(buf.Bytes()), salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, cfg) {
+		t.Errorf("imported config differs:\n got %+v\nwant %+v", got, cfg)
+	}
+}
+
+func TestConfigExportHidesSecrets(t *testing.T) {
+	cfg := testExportConfig()
+	var buf bytes.Buffer
+	if err := ExportConfig(cfg, &buf, []byte("device-1234")); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	secrets := append([]string{cfg.License, cfg.Socks5Pass, cfg.WebhookSecret}, cfg.LicenseKeys...)
+	for _, s := range secrets {
+		if strings.Contains(out, s) {
+			t.Errorf("export contains %q in plain text:\n%s", s, out)
+		}
+	}
+	// Settings that are not secret stay readable.
+	if !strings.Contains(out, cfg.WebhookURL) {
+		t.Errorf("export lacks the webhook url:\n%s", out)
+	}
+}
+
+func TestConfigImportWrongSalt(t *testing.T) {
+	var buf bytes.Buffer
+	if err := ExportConfig(testExportConfig(), &buf, []byte("device-1234")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ImportConfig(bytes.NewReader(buf.Bytes()), []byte("device-5678"))
+	if err == nil {
+		t.Fatalf("import with another salt succeeded: %+v", got)
+	}
+	if !strings.Contains(err.Error(), "wrong salt") {
+		t.Errorf("error = %v, want a wrong salt error", err)
+	}
+	if got.License != "" || got.Socks5Pass != "" {
+		t.Errorf("failed import returned secrets: %+v", got)
+	}
+}
+
+func TestConfigEmptySalt(t *testing.T) {
+	var buf bytes.Buffer
+	if err := ExportConfig(testExportConfig(), &buf, nil); err == nil {
+		t.Error("export without a salt succeeded")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("export without a salt wrote %q", buf.String())
+	}
+	if _, err := ImportConfig(strings.NewReader(`{"Version":1}`), nil); err == nil {
+		t.Error("import without a salt succeeded")
+	}
+}
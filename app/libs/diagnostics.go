@@ -0,0 +1,118 @@
+package tun2socks
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const diagnosticsLogLines = 50
+
+// DiagnosticsReport is a snapshot of a client for bug reports. Its JSON form
+// redacts the secrets in Config; see MarshalJSON.
+type DiagnosticsReport struct {
+	Time      time.Time
+	Session   string
+	State     string
+	LastError string `json:",omitempty"`
+	// ActiveEndpoint is Client.ActiveEndpoint, which may differ from
+	// Config.Endpoint after a scan.
+	ActiveEndpoint string `json:",omitempty"`
+	Config         Config
+	Traffic        TrafficStats
+	Stats          Stats
+	// LatencyMillis is the round trip of a Ping through the tunnel, or -1
+	// with PingError set when it failed or the client is not running.
+	LatencyMillis int64
+	PingError     string `json:",omitempty"`
+	// SelfTest is the outcome of Config.SelfTest, once it has finished.
+	SelfTest *SelfTestResult `json:",omitempty"`
+	// LogTail holds the last 50 buffered log lines, oldest first.
+	LogTail []string
+}
+
+// MarshalJSON encodes the report with the license keys cut down to their last
+// four characters and the passwords and webhook secret replaced entirely.
+func (d DiagnosticsReport) MarshalJSON() ([]byte, error) {
+	type report DiagnosticsReport // without the MarshalJSON method
+	r := report(d)
+	r.Config.License = redactLicense(r.Config.License)
+	if len(r.Config.LicenseKeys) > 0 {
+		keys := make([]string, len(r.Config.LicenseKeys))
+		for i, key := range r.Config.LicenseKeys {
+			keys[i] = redactLicense(key)
+		}
+		r.Config.LicenseKeys = keys
+	}
+	if r.Config.Socks5Pass != "" {
+		r.Config.Socks5Pass = "redacted"
+	}
+	if r.Config.WebhookSecret != "" {
+		r.Config.WebhookSecret = "redacted"
+	}
+	return json.Marshal(r)
+}
+
+func redactLicense(license string) string {
+	if license == "" || license == "notset" {
+		return license
+	}
+	if len(license) <= 4 {
+		return strings.Repeat("*", len(license))
+	}
+	return strings.Repeat("*", len(license)-4) + license[len(license)-4:]
+}
+
+// Diagnostics gathers the client's state, config, counters and log tail, and
+// measures the latency through the tunnel while running. The ping is bounded
+// by ctx and by the usual five second health check timeout.
+func (c *Client) Diagnostics(ctx context.Context) DiagnosticsReport {
+	c.mu.Lock()
+	cfg := c.cfg
+	c.mu.Unlock()
+	d := DiagnosticsReport{
+		Time:           time.Now(),
+		Session:        c.SessionID(),
+		State:          c.State().String(),
+		ActiveEndpoint: c.ActiveEndpoint(),
+		Config:         cfg,
+		Traffic:        c.TrafficStats(),
+		Stats:          c.Stats(),
+		LatencyMillis:  -1,
+	}
+	if err := c.LastError(); err != nil {
+		d.LastError = err.Error()
+	}
+	if res, ok := c.SelfTestResult(); ok {
+		d.SelfTest = &res
+	}
+
+	evs := c.logs.since(time.Time{})
+	if len(evs) > diagnosticsLogLines {
+		evs = evs[len(evs)-diagnosticsLogLines:]
+	}
+	d.LogTail = make([]string, len(evs))
+	for i, ev := range evs {
+		d.LogTail[i] = ev.String()
+	}
+
+	if !c.IsRunning() {
+		d.PingError = ErrNotRunning.Error()
+		return d
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if rtt, err := c.Ping(ctx, healthCheckHost); err != nil {
+		d.PingError = err.Error()
+	} else {
+		d.LatencyMillis = rtt.Milliseconds()
+	}
+	return d
+}
+
+// DiagnosticsJSON is Diagnostics encoded as indented JSON, ready to attach to
+// a bug report.
+func (c *Client) DiagnosticsJSON(ctx context.Context) ([]byte, error) {
+	return json.MarshalIndent(c.Diagnostics(ctx), "", "  ")
+}
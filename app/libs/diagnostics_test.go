@@ -0,0 +1,72 @@
+package tun2socks
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRedactLicense(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"notset", "notset"},
+		{"abc", "***"},
+		{"abcd", "****"},
+		{"abcde", "*bcde"},
+		{"a1B2c3D4-e5F6g7H8-i9J0k1L2", "**********************k1L2"},
+	}
+	for _, tt := range tests {
+		if got := redactLicense(tt.in); got != tt.want {
+			t.Errorf("redactLicense(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDiagnosticsRedactsSecrets(t *testing.T) {
+	cfg := NewConfig()
+	cfg.License = "a1B2c3D4-e5F6g7H8-i9J0k1L2"
+	cfg.LicenseKeys = []string{"m3N4o5P6-q7R8s9T0-u1V2w3X4"}
+	cfg.Socks5User, cfg.Socks5Pass = "user", "s0cks-p4ss-word"
+	cfg.WebhookURL, cfg.WebhookSecret = "https://example.com/hook", "w3bh00k-s3cr3t"
+	c := NewClient(cfg)
+	b, err := c.DiagnosticsJSON(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{cfg.License, cfg.LicenseKeys[0], cfg.Socks5Pass, cfg.WebhookSecret} {
+		if strings.Contains(string(b), secret) {
+			t.Errorf("diagnostics contain %q:\n%s", secret, b)
+		}
+	}
+
+	var report struct {
+		PingError string
+		Config    Config
+	}
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	got := report.Config
+	if got.License != "**********************k1L2" {
+		t.Errorf("License = %q, want all but the last 4 characters masked", got.License)
+	}
+	if len(got.LicenseKeys) != 1 || got.LicenseKeys[0] != "**********************w3X4" {
+		t.Errorf("LicenseKeys = %q, want all but the last 4 characters masked", got.LicenseKeys)
+	}
+	if got.Socks5Pass != "redacted" || got.WebhookSecret != "redacted" {
+		t.Errorf("Socks5Pass = %q, WebhookSecret = %q, want both redacted", got.Socks5Pass, got.WebhookSecret)
+	}
+	// Settings that are not secret are kept.
+	if got.Socks5User != "user" || got.WebhookURL != cfg.WebhookURL {
+		t.Errorf("Socks5User = %q, WebhookURL = %q", got.Socks5User, got.WebhookURL)
+	}
+	if report.PingError != ErrNotRunning.Error() {
+		t.Errorf("PingError = %q before Start", report.PingError)
+	}
+
+	// Redacting the report leaves the client's config alone.
+	if c.cfg.LicenseKeys[0] != "m3N4o5P6-q7R8s9T0-u1V2w3X4" || c.cfg.License != cfg.License {
+		t.Errorf("config changed by MarshalJSON: %+v", c.cfg)
+	}
+}
@@ -0,0 +1,162 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	dnsCacheSize      = 1024
+	dnsCacheMaxTTL    = 600 // seconds
+	dnsNegativeMaxTTL = 300 // seconds
+)
+
+type dnsCacheKey struct {
+	name  string
+	qtype uint16
+}
+
+// dnsTTL is the offset of a TTL field in a cached response and its value
+// when the response was stored.
+type dnsTTL struct {
+	off int
+	ttl uint32
+}
+
+type dnsCacheEntry struct {
+	resp   []byte
+	ttls   []dnsTTL
+	stored time.Time
+	expiry time.Time
+}
+
+// dnsCache keeps responses for their lowest answer TTL, capped at
+// dnsCacheMaxTTL. NXDOMAIN and empty answers are kept for the TTL of their
+// authority records, capped at dnsNegativeMaxTTL. Served copies carry the
+// ID and question spelling of the query and TTLs lowered by their age.
+type dnsCache struct {
+	mu sync.Mutex
+	m  map[dnsCacheKey]dnsCacheEntry
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{m: make(map[dnsCacheKey]dnsCacheEntry)}
+}
+
+// get returns the cached response to query, whose question ends at qend.
+func (c *dnsCache) get(key dnsCacheKey, query []byte, qend int) []byte {
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.m[key]
+	if ok && !now.Before(e.expiry) {
+		delete(c.m, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	resp := append([]byte(nil), e.resp...)
+	copy(resp[:2], query[:2])
+	copy(resp[12:qend], query[12:qend])
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, t := range e.ttls {
+		ttl := uint32(0)
+		if t.ttl > age {
+			ttl = t.ttl - age
+		}
+		binary.BigEndian.PutUint32(resp[t.off:], ttl)
+	}
+	return resp
+}
+
+// put stores resp, the answer to a question ending at qend, if it can be
+// cached.
+func (c *dnsCache) put(key dnsCacheKey, resp []byte, qend int) {
+	ttl, ttls, ok := dnsResponseTTL(resp, qend)
+	if !ok || ttl == 0 {
+		return
+	}
+	now := time.Now()
+	e := dnsCacheEntry{
+		resp:   append([]byte(nil), resp...),
+		ttls:   ttls,
+		stored: now,
+		expiry: now.Add(time.Duration(ttl) * time.Second),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.m) >= dnsCacheSize {
+		for k, old := range c.m {
+			if !now.Before(old.expiry) {
+				delete(c.m, k)
+			}
+		}
+		for k := range c.m {
+			if len(c.m) < dnsCacheSize {
+				break
+			}
+			delete(c.m, k)
+		}
+	}
+	c.m[key] = e
+}
+
+// dnsResponseTTL returns how long resp may be cached and where its answer
+// and authority TTLs are. It reports false for truncated responses, errors
+// other than NXDOMAIN, and messages it cannot walk.
+func dnsResponseTTL(resp []byte, qend int) (uint32, []dnsTTL, bool) {
+	if len(resp) < qend || resp[2]&0x02 != 0 { // TC
+		return 0, nil, false
+	}
+	rcode := resp[3] & 0x0f
+	if rcode != 0 && rcode != 3 {
+		return 0, nil, false
+	}
+	ancount := int(binary.BigEndian.Uint16(resp[6:8]))
+	nscount := int(binary.BigEndian.Uint16(resp[8:10]))
+	negative := rcode == 3 || ancount == 0
+	var ttls []dnsTTL
+	limit := uint32(dnsCacheMaxTTL)
+	if negative {
+		limit = dnsNegativeMaxTTL
+	}
+	off := qend
+	for i := 0; i < ancount+nscount; i++ {
+		// Skip the owner name: labels ending in a root label or a pointer.
+		for {
+			if off >= len(resp) {
+				return 0, nil, false
+			}
+			l := int(resp[off])
+			if l&0xc0 == 0xc0 {
+				off += 2
+				break
+			}
+			off++
+			if l == 0 {
+				break
+			}
+			off += l
+		}
+		if off+10 > len(resp) {
+			return 0, nil, false
+		}
+		ttl := binary.BigEndian.Uint32(resp[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(resp[off+8:]))
+		ttls = append(ttls, dnsTTL{off: off + 4, ttl: ttl})
+		if (!negative || i >= ancount) && ttl < limit {
+			limit = ttl
+		}
+		off += 10 + rdlen
+		if off > len(resp) {
+			return 0, nil, false
+		}
+	}
+	if negative && nscount == 0 {
+		// Nothing says how long the name stays missing.
+		return 0, nil, false
+	}
+	return limit, ttls, true
+}
@@ -0,0 +1,386 @@
+package tun2socks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDOHServer  = "https://1.1.1.1/dns-query"
+	dohTimeout        = 5 * time.Second
+	dnsTCPIdleTimeout = 10 * time.Second
+	dnsHostsTTL       = 60
+	maxDNSMessage     = 65535
+
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+)
+
+// hostsPath is read once per run for local overrides.
+var hostsPath = "/etc/hosts"
+
+// dohResolver resolves DNS queries by forwarding them to Config.DOHServer
+// (RFC 8484) through warp's SOCKS5 listener. A and AAAA queries for names in
+// the hosts file are answered locally; everything else, CNAME chains
+// included, is relayed as is and cached. With fallback servers, queries go to
+// them as plain DNS over TCP, still through warp, until the DoH server has
+// answered once; after that a DoH failure is a SERVFAIL so the resolver
+// cannot be downgraded. It serves the tun device and, when one is set up,
+// the dnsProxy.
+type dohResolver struct {
+	url      string
+	client   *http.Client
+	hosts    map[string][]net.IP
+	cache    *dnsCache
+	upstream string
+	fallback []string
+	next     atomic.Uint32
+	dohOK    atomic.Bool
+}
+
+func newDOHResolver(dohURL, upstream string, fallback []string) *dohResolver {
+	hosts, err := readHosts(hostsPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("[dns] ignoring hosts file:", err)
+	}
+	return &dohResolver{
+		url: dohURL,
+		client: &http.Client{
+			Timeout: dohTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+					return dialSocks5(ctx, upstream, addr)
+				},
+				MaxIdleConnsPerHost: 2,
+				IdleConnTimeout:     90 * time.Second,
+				ForceAttemptHTTP2:   true,
+			},
+		},
+		hosts:    hosts,
+		cache:    newDNSCache(),
+		upstream: upstream,
+		fallback: fallback,
+	}
+}
+
+// dnsProxy answers plain DNS on Config.DNSListenAddr, over UDP and TCP, with
+// a dohResolver.
+type dnsProxy struct {
+	udp net.PacketConn
+	tcp net.Listener
+	res *dohResolver
+	wg  sync.WaitGroup
+}
+
+func listenDNSProxy(addr string, res *dohResolver) (*dnsProxy, error) {
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	return &dnsProxy{udp: udp, tcp: tcp, res: res}, nil
+}
+
+func (p *dnsProxy) close() {
+	p.udp.Close()
+	p.tcp.Close()
+}
+
+// serve answers queries until ctx is done.
+func (p *dnsProxy) serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		p.close()
+	}()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.serveTCP(ctx)
+	}()
+
+	buf := make([]byte, maxDNSMessage)
+	for {
+		n, addr, err := p.udp.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("[dns] udp read failed:", err)
+			}
+			break
+		}
+		query := append([]byte(nil), buf[:n]...)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			if resp := p.res.resolve(ctx, query); resp != nil {
+				p.udp.WriteTo(resp, addr)
+			}
+		}()
+	}
+	p.wg.Wait()
+}
+
+func (p *dnsProxy) serveTCP(ctx context.Context) {
+	for {
+		conn, err := p.tcp.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("[dns] tcp accept failed:", err)
+			}
+			return
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-ctx.Done():
+				case <-done:
+				}
+				conn.Close()
+			}()
+			p.handleTCP(ctx, conn)
+		}()
+	}
+}
+
+// handleTCP answers length-prefixed queries (RFC 1035, section 4.2.2) until
+// the client goes quiet.
+func (p *dnsProxy) handleTCP(ctx context.Context, conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(r, query); err != nil {
+			return
+		}
+		resp := p.res.resolve(ctx, query)
+		if resp == nil {
+			return
+		}
+		binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+		if _, err := conn.Write(append(size[:], resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// resolve returns the response to query, a SERVFAIL when it cannot be
+// resolved, or nil for a message too malformed to answer.
+func (d *dohResolver) resolve(ctx context.Context, query []byte) []byte {
+	name, qtype, qend, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil
+	}
+	if qtype == dnsTypeA || qtype == dnsTypeAAAA {
+		if ips, ok := d.hosts[name]; ok {
+			return dnsHostsReply(query[:qend], qtype, ips)
+		}
+	}
+	key := dnsCacheKey{name: name, qtype: qtype}
+	if resp := d.cache.get(key, query, qend); resp != nil {
+		return resp
+	}
+	resp, err := d.exchange(ctx, query)
+	if err != nil && len(d.fallback) > 0 && !d.dohOK.Load() && ctx.Err() == nil {
+		server := d.fallback[int(d.next.Add(1)-1)%len(d.fallback)]
+		log.Printf("[dns] %s: %v, trying plain dns via %s", name, err, server)
+		resp, err = socksExchange(ctx, d.upstream, server, query)
+	} else if err == nil {
+		d.dohOK.Store(true)
+	}
+	if err != nil {
+		log.Printf("[dns] %s: %v", name, err)
+		return dnsServfail(query[:qend])
+	}
+	if _, _, end, err := parseDNSQuestion(resp); err == nil && end == qend {
+		d.cache.put(key, resp, qend)
+	}
+	return resp
+}
+
+func (d *dohResolver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh server returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessage))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 12 || !bytes.Equal(body[:2], query[:2]) {
+		return nil, errors.New("doh server returned a malformed response")
+	}
+	return body, nil
+}
+
+// socksExchange sends query over TCP to server through the SOCKS5 proxy and
+// returns the response.
+func socksExchange(ctx context.Context, proxy, server string, query []byte) ([]byte, error) {
+	conn, err := dialSocks5(ctx, proxy, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dohTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 || !bytes.Equal(resp[:2], query[:2]) {
+		return nil, errors.New("dns: malformed response")
+	}
+	return resp, nil
+}
+
+// parseDNSQuestion returns the lower-cased name and type of the single
+// question in msg and the offset just past it.
+func parseDNSQuestion(msg []byte) (name string, qtype uint16, end int, err error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return "", 0, 0, errors.New("expected one question")
+	}
+	var labels []string
+	off := 12
+	for {
+		if off >= len(msg) {
+			return "", 0, 0, errors.New("truncated question")
+		}
+		l := int(msg[off])
+		off++
+		if l == 0 {
+			break
+		}
+		if l > 63 || off+l > len(msg) {
+			return "", 0, 0, errors.New("malformed question name")
+		}
+		labels = append(labels, string(msg[off:off+l]))
+		off += l
+	}
+	if off+4 > len(msg) {
+		return "", 0, 0, errors.New("truncated question")
+	}
+	qtype = binary.BigEndian.Uint16(msg[off:])
+	return strings.ToLower(strings.Join(labels, ".")), qtype, off + 4, nil
+}
+
+// dnsReplyHeader turns the header of query into a response header with the
+// given rcode and answer count, keeping ID, opcode and RD.
+func dnsReplyHeader(query []byte, rcode byte, answers int) []byte {
+	h := make([]byte, 12)
+	copy(h[:2], query[:2])
+	h[2] = 0x80 | query[2]&0x79 // QR, opcode, RD
+	h[3] = 0x80 | rcode         // RA
+	binary.BigEndian.PutUint16(h[4:], 1)
+	binary.BigEndian.PutUint16(h[6:], uint16(answers))
+	return h
+}
+
+// dnsHostsReply answers question, the header and question of a query, with
+// the addresses of the matching family from the hosts file.
+func dnsHostsReply(question []byte, qtype uint16, ips []net.IP) []byte {
+	var answers [][]byte
+	for _, ip := range ips {
+		rdata := ip.To4()
+		if qtype == dnsTypeAAAA {
+			if rdata != nil {
+				continue
+			}
+			rdata = ip.To16()
+		}
+		if rdata == nil {
+			continue
+		}
+		rr := []byte{0xc0, 12} // pointer to the question name
+		rr = binary.BigEndian.AppendUint16(rr, qtype)
+		rr = binary.BigEndian.AppendUint16(rr, dnsClassIN)
+		rr = binary.BigEndian.AppendUint32(rr, dnsHostsTTL)
+		rr = binary.BigEndian.AppendUint16(rr, uint16(len(rdata)))
+		answers = append(answers, append(rr, rdata...))
+	}
+	msg := append(dnsReplyHeader(question, 0, len(answers)), question[12:]...)
+	for _, rr := range answers {
+		msg = append(msg, rr...)
+	}
+	return msg
+}
+
+func dnsServfail(question []byte) []byte {
+	return append(dnsReplyHeader(question, 2, 0), question[12:]...)
+}
+
+// readHosts parses a hosts(5) file into lower-cased names and their
+// addresses.
+func readHosts(path string) (map[string][]net.IP, error) {
+	hosts := make(map[string][]net.IP)
+	f, err := os.Open(path)
+	if err != nil {
+		return hosts, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return hosts, sc.Err()
+}
@@ -0,0 +1,357 @@
+package tun2socks
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const dnsTypeCNAME = 5
+
+// testRR is a resource record as the mock DoH server serves it and as
+// testDNSAnswers decodes it; data is an address or a CNAME target.
+type testRR struct {
+	name  string
+	qtype uint16
+	data  string
+}
+
+// testZone is what the mock DoH server knows: www.example.net is a two-step
+// CNAME chain ending at edge.example.net.
+var testZone = []testRR{
+	{"v4.example.net", dnsTypeA, "192.0.2.1"},
+	{"v6.example.net", dnsTypeAAAA, "2001:db8::1"},
+	{"dual.example.net", dnsTypeA, "192.0.2.2"},
+	{"dual.example.net", dnsTypeAAAA, "2001:db8::2"},
+	{"www.example.net", dnsTypeCNAME, "cdn.example.net"},
+	{"cdn.example.net", dnsTypeCNAME, "edge.example.net"},
+	{"edge.example.net", dnsTypeA, "192.0.2.7"},
+	{"edge.example.net", dnsTypeAAAA, "2001:db8::7"},
+}
+
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(name, ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func testDNSQuery(id uint16, name string, qtype uint16) []byte {
+	q := binary.BigEndian.AppendUint16(nil, id)
+	q = append(q, 0x01, 0x00) // RD
+	q = binary.BigEndian.AppendUint16(q, 1)
+	q = append(q, make([]byte, 6)...)
+	q = appendDNSName(q, name)
+	q = binary.BigEndian.AppendUint16(q, qtype)
+	return binary.BigEndian.AppendUint16(q, dnsClassIN)
+}
+
+// testDNSReply answers query from testZone the way a recursive resolver
+// would, following CNAMEs and returning every link of the chain.
+func testDNSReply(query []byte) []byte {
+	name, qtype, qend, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil
+	}
+	var answers []testRR
+	for hops := 0; hops < 8; hops++ {
+		var next string
+		for _, rr := range testZone {
+			if rr.name != name {
+				continue
+			}
+			if rr.qtype == dnsTypeCNAME {
+				answers = append(answers, rr)
+				next = rr.data
+			} else if rr.qtype == qtype {
+				answers = append(answers, rr)
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	rcode := byte(0)
+	if len(answers) == 0 {
+		rcode = 3
+	}
+	msg := append(dnsReplyHeader(query[:qend], rcode, len(answers)), query[12:qend]...)
+	for _, rr := range answers {
+		var rdata []byte
+		if rr.qtype == dnsTypeCNAME {
+			rdata = appendDNSName(nil, rr.data)
+		} else {
+			ip := net.ParseIP(rr.data)
+			if rr.qtype == dnsTypeA {
+				ip = ip.To4()
+			}
+			rdata = ip
+		}
+		msg = appendDNSName(msg, rr.name)
+		msg = binary.BigEndian.AppendUint16(msg, rr.qtype)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+		msg = binary.BigEndian.AppendUint32(msg, 300)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	if rcode == 3 {
+		// A bare SOA in the authority section makes it cacheable.
+		binary.BigEndian.PutUint16(msg[8:], 1)
+		msg = append(msg, 0)
+		msg = binary.BigEndian.AppendUint16(msg, 6)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+		msg = binary.BigEndian.AppendUint32(msg, 60)
+		msg = binary.BigEndian.AppendUint16(msg, 0)
+	}
+	return msg
+}
+
+// readDNSName decodes the possibly compressed name at off in msg and returns
+// it with the offset just past it.
+func readDNSName(t *testing.T, msg []byte, off int) (string, int) {
+	t.Helper()
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			t.Fatalf("name runs past the message")
+		}
+		l := int(msg[off])
+		if l&0xc0 == 0xc0 {
+			if end < 0 {
+				end = off + 2
+			}
+			if jumps++; jumps > 16 {
+				t.Fatalf("name pointer loop")
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			continue
+		}
+		off++
+		if l == 0 {
+			break
+		}
+		labels = append(labels, string(msg[off:off+l]))
+		off += l
+	}
+	if end < 0 {
+		end = off
+	}
+	return strings.Join(labels, "."), end
+}
+
+// testDNSAnswers returns the rcode and the answer section of resp.
+func testDNSAnswers(t *testing.T, resp []byte) (byte, []testRR) {
+	t.Helper()
+	_, _, off, err := parseDNSQuestion(resp)
+	if err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+	var answers []testRR
+	for i := 0; i < int(binary.BigEndian.Uint16(resp[6:8])); i++ {
+		var rr testRR
+		rr.name, off = readDNSName(t, resp, off)
+		rr.qtype = binary.BigEndian.Uint16(resp[off:])
+		rdlen := int(binary.BigEndian.Uint16(resp[off+8:]))
+		off += 10
+		switch rr.qtype {
+		case dnsTypeCNAME:
+			rr.data, _ = readDNSName(t, resp, off)
+		default:
+			rr.data = net.IP(resp[off : off+rdlen]).String()
+		}
+		off += rdlen
+		answers = append(answers, rr)
+	}
+	return resp[3] & 0x0f, answers
+}
+
+// newTestDOH starts a mock DoH server answering from testZone and returns a
+// resolver talking to it and the number of requests it has served.
+func newTestDOH(t *testing.T) (*dohResolver, *atomic.Int32) {
+	var requests atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		resp := testDNSReply(query)
+		if resp == nil {
+			http.Error(w, "malformed query", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return &dohResolver{url: srv.URL, client: srv.Client(), cache: newDNSCache()}, &requests
+}
+
+func TestDOHResolve(t *testing.T) {
+	d, _ := newTestDOH(t)
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  []testRR
+	}{
+		{"v4.example.net", dnsTypeA, []testRR{{"v4.example.net", dnsTypeA, "192.0.2.1"}}},
+		{"v6.example.net", dnsTypeAAAA, []testRR{{"v6.example.net", dnsTypeAAAA, "2001:db8::1"}}},
+		{"dual.example.net", dnsTypeA, []testRR{{"dual.example.net", dnsTypeA, "192.0.2.2"}}},
+		{"dual.example.net", dnsTypeAAAA, []testRR{{"dual.example.net", dnsTypeAAAA, "2001:db8::2"}}},
+		{"www.example.net", dnsTypeA, []testRR{
+			{"www.example.net", dnsTypeCNAME, "cdn.example.net"},
+			{"cdn.example.net", dnsTypeCNAME, "edge.example.net"},
+			{"edge.example.net", dnsTypeA, "192.0.2.7"},
+		}},
+		{"www.example.net", dnsTypeAAAA, []testRR{
+			{"www.example.net", dnsTypeCNAME, "cdn.example.net"},
+			{"cdn.example.net", dnsTypeCNAME, "edge.example.net"},
+			{"edge.example.net", dnsTypeAAAA, "2001:db8::7"},
+		}},
+		{"cdn.example.net", dnsTypeA, []testRR{
+			{"cdn.example.net", dnsTypeCNAME, "edge.example.net"},
+			{"edge.example.net", dnsTypeA, "192.0.2.7"},
+		}},
+	}
+	for i, tt := range tests {
+		resp := d.resolve(context.Background(), testDNSQuery(uint16(0x1000+i), tt.name, tt.qtype))
+		if resp == nil {
+			t.Errorf("%s type %d: no reply", tt.name, tt.qtype)
+			continue
+		}
+		if id := binary.BigEndian.Uint16(resp); id != uint16(0x1000+i) {
+			t.Errorf("%s type %d: reply ID %#x, want %#x", tt.name, tt.qtype, id, 0x1000+i)
+		}
+		rcode, got := testDNSAnswers(t, resp)
+		if rcode != 0 || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s type %d: rcode %d, answers %v, want %v", tt.name, tt.qtype, rcode, got, tt.want)
+		}
+	}
+}
+
+func TestDOHResolveNXDomain(t *testing.T) {
+	d, _ := newTestDOH(t)
+	resp := d.resolve(context.Background(), testDNSQuery(1, "missing.example.net", dnsTypeA))
+	if rcode, got := testDNSAnswers(t, resp); rcode != 3 || len(got) != 0 {
+		t.Errorf("rcode %d, answers %v, want NXDOMAIN with none", rcode, got)
+	}
+}
+
+func TestDOHResolveCache(t *testing.T) {
+	d, requests := newTestDOH(t)
+	ctx := context.Background()
+	queries := []struct {
+		name  string
+		qtype uint16
+	}{
+		{"www.example.net", dnsTypeA},
+		{"www.example.net", dnsTypeAAAA},
+		{"missing.example.net", dnsTypeA},
+	}
+	first := make([][]testRR, len(queries))
+	for i, q := range queries {
+		_, first[i] = testDNSAnswers(t, d.resolve(ctx, testDNSQuery(1, q.name, q.qtype)))
+	}
+	if n := requests.Load(); n != int32(len(queries)) {
+		t.Fatalf("%d requests for %d distinct questions", n, len(queries))
+	}
+	for i, q := range queries {
+		// Differently cased and with a new ID, it is still a cache hit.
+		resp := d.resolve(ctx, testDNSQuery(2, strings.ToUpper(q.name), q.qtype))
+		if id := binary.BigEndian.Uint16(resp); id != 2 {
+			t.Errorf("%s type %d: cached reply ID %d, want 2", q.name, q.qtype, id)
+		}
+		if name, _, _, _ := parseDNSQuestion(resp); name != q.name {
+			t.Errorf("%s type %d: cached reply question %q", q.name, q.qtype, name)
+		}
+		if _, got := testDNSAnswers(t, resp); !reflect.DeepEqual(got, first[i]) {
+			t.Errorf("%s type %d: cached answers %v, want %v", q.name, q.qtype, got, first[i])
+		}
+	}
+	if n := requests.Load(); n != int32(len(queries)) {
+		t.Errorf("%d requests after repeating the questions, want %d", n, len(queries))
+	}
+}
+
+func TestDOHResolveServerError(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	d := &dohResolver{url: srv.URL, client: srv.Client(), cache: newDNSCache()}
+	resp := d.resolve(context.Background(), testDNSQuery(1, "v4.example.net", dnsTypeA))
+	if rcode, _ := testDNSAnswers(t, resp); rcode != 2 {
+		t.Errorf("rcode %d, want SERVFAIL", rcode)
+	}
+	if d.dohOK.Load() {
+		t.Error("dohOK set after a failed exchange")
+	}
+}
+
+func TestDNSProxyServesDOH(t *testing.T) {
+	d, _ := newTestDOH(t)
+	p, err := listenDNSProxy("127.0.0.1:0", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.serve(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	want := []testRR{
+		{"www.example.net", dnsTypeCNAME, "cdn.example.net"},
+		{"cdn.example.net", dnsTypeCNAME, "edge.example.net"},
+		{"edge.example.net", dnsTypeA, "192.0.2.7"},
+	}
+
+	udp, err := net.Dial("udp", p.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.Write(testDNSQuery(7, "www.example.net", dnsTypeA))
+	buf := make([]byte, maxDNSMessage)
+	n, err := udp.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, got := testDNSAnswers(t, buf[:n]); !reflect.DeepEqual(got, want) {
+		t.Errorf("udp answers %v, want %v", got, want)
+	}
+
+	tcp, err := net.Dial("tcp", p.tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	query := testDNSQuery(8, "www.example.net", dnsTypeA)
+	tcp.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...))
+	var size [2]byte
+	if _, err := io.ReadFull(tcp, size[:]); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(tcp, resp); err != nil {
+		t.Fatal(err)
+	}
+	if _, got := testDNSAnswers(t, resp); !reflect.DeepEqual(got, want) {
+		t.Errorf("tcp answers %v, want %v", got, want)
+	}
+}
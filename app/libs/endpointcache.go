@@ -0,0 +1,88 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	endpointCacheFile = "endpoint-cache.json"
+	// endpointCacheMaxAge is how long a cached endpoint is tried before
+	// scanning again anyway.
+	endpointCacheMaxAge = 7 * 24 * time.Hour
+	// cachedEndpointTimeout is how long warp gets to carry a ping over a
+	// cached endpoint before it is dropped and a scan runs instead.
+	cachedEndpointTimeout = 10 * time.Second
+)
+
+// endpointCache is the last endpoint a scan picked, kept under the path
+// passed to Start so the next start with Scan set can skip the scan.
+// Verified is refreshed whenever a ping gets through over it.
+type endpointCache struct {
+	Endpoint string    `json:"endpoint"`
+	Verified time.Time `json:"verified"`
+}
+
+// loadEndpointCache returns the cached endpoint in dir, if there is a recent
+// enough one.
+func loadEndpointCache(dir string) (endpointCache, bool) {
+	var ec endpointCache
+	b, err := os.ReadFile(filepath.Join(dir, endpointCacheFile))
+	if err != nil {
+		return ec, false
+	}
+	if err := json.Unmarshal(b, &ec); err != nil || validateHostPort(ec.Endpoint) != nil {
+		return ec, false
+	}
+	return ec, time.Since(ec.Verified) < endpointCacheMaxAge
+}
+
+// saveEndpointCache records endpoint in dir. The file is written to a
+// temporary name and renamed, so a crash leaves either the old or the new
+// cache, never a partial one.
+func saveEndpointCache(dir, endpoint string) error {
+	b, err := json.Marshal(endpointCache{Endpoint: endpoint, Verified: time.Now()})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, endpointCacheFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, endpointCacheFile))
+}
+
+func removeEndpointCache(dir string) error {
+	err := os.Remove(filepath.Join(dir, endpointCacheFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// InvalidateEndpointCache forgets the endpoint cached under the path of the
+// latest Start, so the next start with Scan set scans again.
+func (c *Client) InvalidateEndpointCache() error {
+	c.mu.Lock()
+	dir := c.path
+	c.mu.Unlock()
+	if dir == "" {
+		return nil
+	}
+	return removeEndpointCache(dir)
+}
@@ -0,0 +1,129 @@
+package tun2socks
+
+import "sync"
+
+const eventQueueSize = 64
+
+// EventListener receives connection events. It is meant to be implemented on
+// the host side through gomobile. Callbacks run on a dedicated goroutine, one
+// at a time and in order.
+type EventListener interface {
+	OnStateChanged(state string)
+	OnError(msg string)
+}
+
+// ScanListener is told when an endpoint scan finishes. It is separate from
+// EventListener so existing host implementations keep compiling; register it
+// with RegisterScanListener. Callbacks share EventListener's goroutine.
+type ScanListener interface {
+	// OnScanComplete receives the same JSON array as GetScanResults.
+	OnScanComplete(results string)
+}
+
+// RegionListener is told which psiphon region warp is trying, as it falls
+// back through Config.Country. Like ScanListener it is registered on its own,
+// with RegisterRegionListener, and shares EventListener's goroutine.
+type RegionListener interface {
+	OnRegionChanged(country string)
+}
+
+// eventDispatcher delivers events to the registered listener off the calling
+// goroutine, so a slow listener never blocks the tunnel.
+type eventDispatcher struct {
+	once  sync.Once
+	queue chan func()
+
+	// deliverMu is held while a callback runs, so replacing a listener
+	// waits for any in-flight callback to return.
+	deliverMu      sync.Mutex
+	listener       EventListener
+	scanListener   ScanListener
+	regionListener RegionListener
+}
+
+var events = &eventDispatcher{queue: make(chan func(), eventQueueSize)}
+
+// RegisterEventListener sets the listener for connection events of every
+// client; nil removes it. Once it returns, the previous listener receives no
+// further callbacks. It must not be called from inside a callback.
+func RegisterEventListener(l EventListener) {
+	events.once.Do(func() { go events.loop() })
+	events.deliverMu.Lock()
+	defer events.deliverMu.Unlock()
+	events.listener = l
+}
+
+// RegisterScanListener sets the listener for scan results; nil removes it. It
+// follows the same rules as RegisterEventListener.
+func RegisterScanListener(l ScanListener) {
+	events.once.Do(func() { go events.loop() })
+	events.deliverMu.Lock()
+	defer events.deliverMu.Unlock()
+	events.scanListener = l
+}
+
+// RegisterRegionListener sets the listener for psiphon region changes; nil
+// removes it. It follows the same rules as RegisterEventListener.
+func RegisterRegionListener(l RegionListener) {
+	events.once.Do(func() { go events.loop() })
+	events.deliverMu.Lock()
+	defer events.deliverMu.Unlock()
+	events.regionListener = l
+}
+
+func (d *eventDispatcher) loop() {
+	for fn := range d.queue {
+		d.deliverMu.Lock()
+		fn()
+		d.deliverMu.Unlock()
+	}
+}
+
+// post queues fn without blocking, dropping the oldest queued event when the
+// listener is falling behind.
+func (d *eventDispatcher) post(fn func()) {
+	for {
+		select {
+		case d.queue <- fn:
+			return
+		default:
+		}
+		select {
+		case <-d.queue:
+		default:
+		}
+	}
+}
+
+func (d *eventDispatcher) stateChanged(s State) {
+	d.post(func() {
+		if d.listener != nil {
+			d.listener.OnStateChanged(s.String())
+		}
+	})
+}
+
+func (d *eventDispatcher) error(err error) {
+	msg := err.Error()
+	d.post(func() {
+		if d.listener != nil {
+			d.listener.OnError(msg)
+		}
+	})
+}
+
+func (d *eventDispatcher) scanComplete(results string) {
+	d.post(func() {
+		if d.scanListener != nil {
+			d.scanListener.OnScanComplete(results)
+		}
+	})
+}
+
+func (d *eventDispatcher) regionChanged(country string) {
+	d.post(func() {
+		if d.regionListener != nil {
+			d.regionListener.OnRegionChanged(country)
+		}
+	})
+}
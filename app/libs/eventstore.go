@@ -0,0 +1,125 @@
+package tun2socks
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventStoreSize is how many events an EventStore keeps.
+const eventStoreSize = 10000
+
+// Categories of stored events.
+const (
+	EventCategoryWireGuard = "wireguard"
+	EventCategoryPsiphon   = "psiphon"
+	EventCategoryLwip      = "lwip"
+	EventCategoryScanner   = "scanner"
+	EventCategoryApp       = "app"
+)
+
+// Event is a captured log line kept for later queries.
+type Event struct {
+	Time     time.Time
+	Level    string
+	Category string
+	Message  string
+}
+
+// EventStore keeps the latest captured lines of a client, oldest first, so
+// questions such as "how many reconnects in the last hour?" can be answered
+// after the fact. Unlike the log buffer it is not emptied by GetLogMessages;
+// once full the oldest events are dropped.
+type EventStore struct {
+	mu     sync.Mutex
+	events []Event
+	max    int
+}
+
+func newEventStore(size int) *EventStore {
+	return &EventStore{max: size}
+}
+
+func (s *EventStore) add(ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Lines come in order; keep the list sorted should a clock step back.
+	i := len(s.events)
+	if i > 0 && ev.Time.Before(s.events[i-1].Time) {
+		i = sort.Search(len(s.events), func(j int) bool { return s.events[j].Time.After(ev.Time) })
+	}
+	s.events = append(s.events, Event{})
+	copy(s.events[i+1:], s.events[i:])
+	s.events[i] = ev
+	// Trim in batches so a full store does not copy on every line.
+	if len(s.events) >= s.max+s.max/4 {
+		n := copy(s.events, s.events[len(s.events)-s.max:])
+		for j := n; j < len(s.events); j++ {
+			s.events[j] = Event{}
+		}
+		s.events = s.events[:n]
+	}
+}
+
+// Query returns the events from from up to, but not including, to, oldest
+// first. A zero from or to leaves that end open. Empty levels or categories
+// match every level or category; otherwise they are compared case-insensitively.
+func (s *EventStore) Query(from, to time.Time, levels []string, categories []string) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lo := 0
+	if !from.IsZero() {
+		lo = sort.Search(len(s.events), func(i int) bool { return !s.events[i].Time.Before(from) })
+	}
+	hi := len(s.events)
+	if !to.IsZero() {
+		hi = sort.Search(len(s.events), func(i int) bool { return !s.events[i].Time.Before(to) })
+	}
+	if hi < lo {
+		hi = lo
+	}
+	var out []Event
+	for _, ev := range s.events[lo:hi] {
+		if matchesAny(levels, ev.Level) && matchesAny(categories, ev.Category) {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+func matchesAny(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, s := range list {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// categoryOf returns the category of a line from source. Tun2socks lines are
+// lwip and stdout/stderr lines, printed by the bundled warp and wireguard-go,
+// are wireguard. Lines of this package are app unless they start with a
+// "[name]" tag such as "[dns]" or "[scanner]", which is used as is.
+func categoryOf(source, msg string) string {
+	switch source {
+	case sourceT2S:
+		return EventCategoryLwip
+	case sourceStdout, sourceStderr:
+		return EventCategoryWireGuard
+	}
+	if strings.HasPrefix(msg, "[") {
+		if end := strings.IndexByte(msg, ']'); end > 1 {
+			return strings.ToLower(msg[1:end])
+		}
+	}
+	return EventCategoryApp
+}
+
+// Events returns the store of the client's captured lines.
+func (c *Client) Events() *EventStore {
+	return c.logs.store
+}
@@ -0,0 +1,270 @@
+package tun2socks
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	logFileName          = "oblivion.log"
+	defaultLogFileSizeKB = 1024
+	defaultLogFileSizeMB = 10
+	defaultLogFiles      = 3
+)
+
+// rotatingFile is a buffered, size-rotated log file. When the current file
+// would exceed maxSize it is renamed to name.1, name.1 to name.2 and so on,
+// keeping at most maxFiles rotated files.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	w        *bufio.Writer
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.w, rf.size = f, bufio.NewWriter(f), info.Size()
+	return nil
+}
+
+// writeLine appends line and a newline, rotating first if needed.
+func (rf *rotatingFile) writeLine(line string) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return os.ErrClosed
+	}
+	n := int64(len(line) + 1)
+	if rf.size > 0 && rf.size+n > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return err
+		}
+	}
+	rf.w.WriteString(line)
+	if err := rf.w.WriteByte('\n'); err != nil {
+		return err
+	}
+	rf.size += n
+	return nil
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.w.Flush()
+	rf.f.Close()
+	rf.f = nil
+	os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxFiles))
+	for i := rf.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) flush() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	return rf.w.Flush()
+}
+
+func (rf *rotatingFile) close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	rf.w.Flush()
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
+
+// fileLogging mirrors every captured line into a rotating file once enabled.
+var fileLogging struct {
+	mu       sync.Mutex
+	enabled  bool
+	dir      string // empty until resolved from the RunWarp path
+	maxSize  int64
+	maxFiles int
+	file     *rotatingFile
+	// override is the Config.LogFile that file was opened for by useLogFile,
+	// empty when file is the one under dir.
+	override string
+}
+
+// EnableFileLogging mirrors every captured log line into a set of files under
+// dir, rotating once a file reaches maxSizeKB and keeping maxFiles rotated
+// files (defaults 1024 and 3 when zero or less). An empty dir means "logs"
+// under the path passed to RunWarp. File logging is off by default.
+func EnableFileLogging(dir string, maxSizeKB, maxFiles int) error {
+	if maxSizeKB <= 0 {
+		maxSizeKB = defaultLogFileSizeKB
+	}
+	if maxFiles <= 0 {
+		maxFiles = defaultLogFiles
+	}
+
+	fileLogging.mu.Lock()
+	defer fileLogging.mu.Unlock()
+	fileLogging.enabled = true
+	fileLogging.dir = dir
+	fileLogging.maxSize = int64(maxSizeKB) * 1024
+	fileLogging.maxFiles = maxFiles
+	if fileLogging.override != "" {
+		// A running client's Config.LogFile takes precedence.
+		return nil
+	}
+	closeLogFileLocked()
+	if dir == "" {
+		return nil
+	}
+	return openLogFileLocked()
+}
+
+// DisableFileLogging flushes and closes the log file. A running client's
+// Config.LogFile stays open until the client stops.
+func DisableFileLogging() {
+	fileLogging.mu.Lock()
+	defer fileLogging.mu.Unlock()
+	fileLogging.enabled = false
+	if fileLogging.override == "" {
+		closeLogFileLocked()
+	}
+}
+
+// GetLogFilePath returns the path of the current log file, or an empty string
+// when file logging is not active.
+func GetLogFilePath() string {
+	fileLogging.mu.Lock()
+	defer fileLogging.mu.Unlock()
+	if fileLogging.file == nil {
+		return ""
+	}
+	return fileLogging.file.path
+}
+
+// useLogPath opens the log file under path/logs if file logging was enabled
+// without a directory.
+func useLogPath(path string) {
+	fileLogging.mu.Lock()
+	if !fileLogging.enabled || fileLogging.file != nil || fileLogging.dir != "" {
+		fileLogging.mu.Unlock()
+		return
+	}
+	fileLogging.dir = filepath.Join(path, "logs")
+	err := openLogFileLocked()
+	if err != nil {
+		fileLogging.dir = ""
+	}
+	// The log output ends in logToFile, so log only once mu is released.
+	fileLogging.mu.Unlock()
+	if err != nil {
+		log.Println("Failed to open log file:", err)
+	}
+}
+
+func openLogFileLocked() error {
+	rf, err := openRotatingFile(filepath.Join(fileLogging.dir, logFileName), fileLogging.maxSize, fileLogging.maxFiles)
+	if err != nil {
+		return err
+	}
+	fileLogging.file = rf
+	return nil
+}
+
+func closeLogFileLocked() {
+	if fileLogging.file != nil {
+		fileLogging.file.close()
+		fileLogging.file = nil
+	}
+}
+
+// useLogFile makes path, the Config.LogFile of a starting client, the log
+// file in place of the one EnableFileLogging set up, until releaseLogFile.
+func useLogFile(path string, maxSizeMB int) error {
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultLogFileSizeMB
+	}
+	rf, err := openRotatingFile(path, int64(maxSizeMB)<<20, defaultLogFiles)
+	if err != nil {
+		return err
+	}
+	fileLogging.mu.Lock()
+	defer fileLogging.mu.Unlock()
+	closeLogFileLocked()
+	fileLogging.file = rf
+	fileLogging.override = path
+	return nil
+}
+
+// releaseLogFile closes the file useLogFile opened for path and goes back to
+// the EnableFileLogging directory, if any. It is a no-op when path is empty or
+// another client has taken over since.
+func releaseLogFile(path string) {
+	fileLogging.mu.Lock()
+	if path == "" || fileLogging.override != path {
+		fileLogging.mu.Unlock()
+		return
+	}
+	closeLogFileLocked()
+	fileLogging.override = ""
+	var err error
+	if fileLogging.enabled && fileLogging.dir != "" {
+		err = openLogFileLocked()
+	}
+	fileLogging.mu.Unlock()
+	if err != nil {
+		log.Println("Failed to reopen log file:", err)
+	}
+}
+
+// logToFile mirrors line into the log file, if any.
+func logToFile(line string) {
+	fileLogging.mu.Lock()
+	rf := fileLogging.file
+	fileLogging.mu.Unlock()
+	if rf != nil {
+		rf.writeLine(line)
+	}
+}
+
+// flushLogFile writes any buffered lines to disk.
+func flushLogFile() {
+	fileLogging.mu.Lock()
+	rf := fileLogging.file
+	fileLogging.mu.Unlock()
+	if rf != nil {
+		rf.flush()
+	}
+}
@@ -0,0 +1,192 @@
+package tun2socks
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	healthCheckHost    = "1.1.1.1"
+	healthCheckTimeout = 5 * time.Second
+)
+
+// socksAddr returns the address warp's SOCKS5 server can be reached at
+// without authentication.
+func (c *Client) socksAddr() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addr := c.cfg.BindAddress
+	if c.run != nil && !c.run.finished() {
+		addr = c.run.warpAddr
+	}
+	return strings.Replace(addr, "0.0.0.0", "127.0.0.1", -1)
+}
+
+// Ping sends an HTTP HEAD request for host through the local SOCKS5 proxy and
+// returns the round-trip time. host may be a bare host name, which is fetched
+// over https, or a full URL.
+func (c *Client) Ping(ctx context.Context, host string) (time.Duration, error) {
+	url := host
+	if !strings.Contains(host, "://") {
+		url = "https://" + host + "/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	resp, err := socksHTTPClient(c.socksAddr()).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	rtt := time.Since(start)
+	c.latency.Store(rtt.Milliseconds())
+	return rtt, nil
+}
+
+// socksHTTPClient returns a client whose requests go through the SOCKS5 server
+// at proxy. Any response proves the path works, so it does not follow
+// redirects.
+func socksHTTPClient(proxy string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialSocks5(ctx, proxy, addr)
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// waitWarpUp pings through the SOCKS5 proxy every second until a ping
+// succeeds, reporting true, or ctx is done or a positive timeout passes,
+// reporting false. app.RunWarp reports no handshake, so this is how a start
+// of warp is seen to have come up.
+func (c *Client) waitWarpUp(ctx context.Context, timeout time.Duration) bool {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	for {
+		pingCtx, pingCancel := context.WithTimeout(ctx, healthCheckTimeout)
+		_, err := c.Ping(pingCtx, healthCheckHost)
+		pingCancel()
+		if err == nil {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// IsHealthy reports whether a single Ping to 1.1.1.1 succeeds within five
+// seconds.
+func (c *Client) IsHealthy(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	_, err := c.Ping(ctx, healthCheckHost)
+	return err == nil
+}
+
+const (
+	connectivityDNSServer = "1.1.1.1:53"
+	connectivityDNSName   = "www.cloudflare.com"
+	connectivityTCPAddr   = "1.1.1.1:443"
+	connectivityTraceURL  = "https://www.cloudflare.com/cdn-cgi/trace"
+)
+
+// ConnectivityStage is the outcome of one step of TestConnectivity.
+type ConnectivityStage struct {
+	Name          string `json:"name"`
+	OK            bool   `json:"ok"`
+	LatencyMillis int64  `json:"latencyMillis"`
+	Error         string `json:"error,omitempty"`
+}
+
+// ConnectivityResult is the outcome of TestConnectivity. FailedStage names
+// the first stage that failed; the stages after it are not run.
+type ConnectivityResult struct {
+	OK          bool                `json:"ok"`
+	FailedStage string              `json:"failedStage,omitempty"`
+	Stages      []ConnectivityStage `json:"stages"`
+}
+
+// TestConnectivity checks the tunnel end to end through the local SOCKS5
+// proxy: a DNS lookup over TCP to 1.1.1.1 ("dns"), a TCP connect to 1.1.1.1:443
+// ("tcp") and an HTTP HEAD to the Cloudflare trace endpoint ("http"). It
+// stops at the first failure or when ctx is done.
+func (c *Client) TestConnectivity(ctx context.Context) ConnectivityResult {
+	proxy := c.socksAddr()
+	stages := []struct {
+		name string
+		run  func(context.Context) error
+	}{
+		{"dns", func(ctx context.Context) error {
+			return socksLookup(ctx, proxy, connectivityDNSServer, connectivityDNSName)
+		}},
+		{"tcp", func(ctx context.Context) error {
+			conn, err := dialSocks5(ctx, proxy, connectivityTCPAddr)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}},
+		{"http", func(ctx context.Context) error {
+			_, err := c.Ping(ctx, connectivityTraceURL)
+			return err
+		}},
+	}
+
+	res := ConnectivityResult{OK: true, Stages: make([]ConnectivityStage, 0, len(stages))}
+	for _, s := range stages {
+		start := time.Now()
+		err := s.run(ctx)
+		st := ConnectivityStage{Name: s.name, OK: err == nil, LatencyMillis: time.Since(start).Milliseconds()}
+		if err != nil {
+			st.Error = err.Error()
+			res.OK, res.FailedStage = false, s.name
+		}
+		res.Stages = append(res.Stages, st)
+		if err != nil {
+			break
+		}
+	}
+	return res
+}
+
+// socksLookup resolves name with an A query sent over TCP to server through
+// the SOCKS5 proxy, so the lookup itself takes the tunnel.
+func socksLookup(ctx context.Context, proxy, server, name string) error {
+	// ID, flags (RD), QDCOUNT=1, then the question.
+	msg := []byte{0x4f, 0x42, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, 1, 0, 1) // root, QTYPE=A, QCLASS=IN
+	resp, err := socksExchange(ctx, proxy, server, msg)
+	if err != nil {
+		return err
+	}
+	if rcode := resp[3] & 0x0f; rcode != 0 {
+		return fmt.Errorf("dns: %s: rcode %d", name, rcode)
+	}
+	if binary.BigEndian.Uint16(resp[6:8]) == 0 {
+		return fmt.Errorf("dns: %s: no answer", name)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package tun2socks
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const httpProxyShutdownTimeout = 5 * time.Second
+
+// hopHeaders are removed before forwarding a plain HTTP request (RFC 7230,
+// section 6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// httpProxy is an HTTP proxy on Config.HTTPProxyAddress that forwards CONNECT
+// tunnels and absolute-URI requests through warp's SOCKS5 listener. Its
+// traffic is counted separately from the tun device.
+type httpProxy struct {
+	ln        net.Listener
+	upstream  string
+	transport *http.Transport
+
+	requests atomic.Uint64
+	rx, tx   atomic.Uint64
+
+	mu      sync.Mutex
+	tunnels map[net.Conn]struct{} // hijacked CONNECT connections
+	closing bool                  // set once serve has closed the tunnels
+	// wg counts client connections from when Serve accepts them until they
+	// or the tunnel they were hijacked for are closed.
+	wg sync.WaitGroup
+}
+
+func listenHTTPProxy(addr, upstream string) (*httpProxy, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p := &httpProxy{ln: ln, upstream: upstream, tunnels: make(map[net.Conn]struct{})}
+	p.transport = &http.Transport{
+		Proxy:               nil,
+		DialContext:         func(ctx context.Context, _, addr string) (net.Conn, error) { return p.dial(ctx, addr) },
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return p, nil
+}
+
+func (p *httpProxy) dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := dialSocks5(ctx, p.upstream, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, rx: &p.rx, tx: &p.tx}, nil
+}
+
+// serve handles requests until ctx is done, then shuts the server down and
+// closes any open CONNECT tunnels.
+func (p *httpProxy) serve(ctx context.Context) {
+	srv := &http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: 30 * time.Second,
+		ErrorLog:          log.New(log.Writer(), "[http-proxy] ", 0),
+		// Serve runs the StateNew hook before it accepts the next
+		// connection, so every Add happens before Serve returns and Wait
+		// starts. A hijacked connection reports no StateClosed; its
+		// tunnel calls Done instead.
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				p.wg.Add(1)
+			case http.StateClosed:
+				p.wg.Done()
+			}
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), httpProxyShutdownTimeout)
+		defer cancel()
+		if srv.Shutdown(shutdownCtx) != nil {
+			srv.Close()
+		}
+		p.mu.Lock()
+		p.closing = true
+		for conn := range p.tunnels {
+			conn.Close()
+		}
+		p.mu.Unlock()
+		p.transport.CloseIdleConnections()
+	}()
+	if err := srv.Serve(p.ln); err != nil && err != http.ErrServerClosed {
+		log.Println("[http-proxy] serve failed:", err)
+	}
+	p.wg.Wait()
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.requests.Add(1)
+	if req.Method == http.MethodConnect {
+		p.handleConnect(w, req)
+		return
+	}
+	if !req.URL.IsAbs() {
+		http.Error(w, "this is a proxy; requests need an absolute URI", http.StatusBadRequest)
+		return
+	}
+
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		log.Printf("[http-proxy] %s %s: %v", req.Method, req.URL.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *httpProxy) handleConnect(w http.ResponseWriter, req *http.Request) {
+	upstream, err := p.dial(req.Context(), req.Host)
+	if err != nil {
+		log.Printf("[http-proxy] CONNECT %s: %v", req.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be hijacked", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		log.Println("[http-proxy] hijack failed:", err)
+		return
+	}
+	defer p.wg.Done()
+	defer conn.Close()
+	p.mu.Lock()
+	if p.closing {
+		// The tunnels were already closed; this one would be missed.
+		p.mu.Unlock()
+		return
+	}
+	p.tunnels[conn] = struct{}{}
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.tunnels, conn)
+		p.mu.Unlock()
+	}()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		// Bytes the client sent after the request may already be buffered.
+		io.Copy(upstream, buf.Reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range strings.Split(h.Get("Connection"), ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			h.Del(f)
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// countingConn adds the bytes read and written on a connection to rx and tx.
+type countingConn struct {
+	net.Conn
+	rx, tx *atomic.Uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.rx.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.tx.Add(uint64(n))
+	return n, err
+}
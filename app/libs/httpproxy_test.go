@@ -0,0 +1,118 @@
+package tun2socks
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startHTTPProxy serves an httpProxy in front of a fresh upstream SOCKS5
+// server and returns it with the cancel func that stops it and a channel
+// closed once serve has returned.
+func startHTTPProxy(t *testing.T) (*httpProxy, context.CancelFunc, <-chan struct{}) {
+	t.Helper()
+	p, err := listenHTTPProxy("127.0.0.1:0", listenUpstreamSocks(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.serve(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return p, cancel, done
+}
+
+// openTunnel sends CONNECT for target through the proxy at addr and returns
+// the tunneled connection.
+func openTunnel(t *testing.T, addr, target string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s: %s", target, resp.Status)
+	}
+	return conn
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	p, _, _ := startHTTPProxy(t)
+	conn := openTunnel(t, p.ln.Addr().String(), listenEcho(t))
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ping" {
+		t.Errorf("echo = %q, want ping", reply)
+	}
+	if p.rx.Load() == 0 || p.tx.Load() == 0 {
+		t.Errorf("tunnel traffic not counted: rx %d, tx %d", p.rx.Load(), p.tx.Load())
+	}
+}
+
+// TestHTTPProxyShutdownClosesTunnels stops the proxy while tunnels are open
+// and more are being opened. Run with -race; serve must close every tunnel
+// and return.
+func TestHTTPProxyShutdownClosesTunnels(t *testing.T) {
+	p, cancel, done := startHTTPProxy(t)
+	addr, echo := p.ln.Addr().String(), listenEcho(t)
+	open := openTunnel(t, addr, echo)
+	defer open.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				return // already closed
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(conn, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+			io.Copy(io.Discard, conn)
+		}()
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(httpProxyShutdownTimeout + 5*time.Second):
+		t.Fatal("serve did not return with tunnels open")
+	}
+	wg.Wait()
+
+	open.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := open.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read on a tunnel after shutdown = %v, want EOF", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.tunnels) != 0 {
+		t.Errorf("%d tunnels left after shutdown", len(p.tunnels))
+	}
+}
@@ -0,0 +1,59 @@
+package tun2socks
+
+import (
+	"strings"
+	"time"
+)
+
+// licenseErrors are the messages warp fails with when the Cloudflare API
+// refuses a license key, lower-cased: the API's device limit error and the
+// wireguard-go fork's wrapping of a failed license update.
+var licenseErrors = []string{
+	"too many connected devices",
+	"failed to update license",
+	"activation error",
+}
+
+// licenseRefused reports whether warp failed with err because its license
+// key was refused, judging by err and the wireguard and app lines logged
+// since started, e.g. when a shared WARP+ key hit its device limit.
+func (c *Client) licenseRefused(err error, started time.Time) bool {
+	if isLicenseError(err.Error()) {
+		return true
+	}
+	// The tun2socks, scanner and psiphon lines never carry the API error.
+	categories := []string{EventCategoryWireGuard, EventCategoryApp}
+	for _, ev := range c.logs.store.Query(started, time.Time{}, nil, categories) {
+		if isLicenseError(ev.Message) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLicenseError reports whether msg contains one of licenseErrors. This
+// package's own lines about licenses, such as the rotation notices, do not.
+func isLicenseError(msg string) bool {
+	m := strings.ToLower(msg)
+	for _, e := range licenseErrors {
+		if strings.Contains(m, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// CurrentLicense returns the license key warp is using, redacted to its last
+// four characters. It is empty on the free tier and when the client is not
+// running. See Config.LicenseKeys.
+func (c *Client) CurrentLicense() string {
+	r := c.currentRun()
+	if r == nil || r.finished() {
+		return ""
+	}
+	key := r.license.Load()
+	if key == nil || *key == "" || *key == "notset" {
+		return ""
+	}
+	return redactLicense(*key)
+}
@@ -0,0 +1,102 @@
+package tun2socks
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsLicenseError(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want bool
+	}{
+		// What warp fails with when the API refuses a key.
+		{`activation error, status 403 {"result":null,"success":false,"errors":[{"code":1020,"message":"Too many connected devices."}]}`, true},
+		{"Too many connected devices.", true},
+		{"failed to update license key: activation error, status 400", true},
+		{"ERROR: FAILED TO UPDATE LICENSE", true},
+
+		// Lines that mention licenses or errors but not a refusal.
+		{"License key ********k1L2 was refused, trying the next one", false},
+		{"License key ********k1L2 was refused and no keys are left, using the free tier", false},
+		{`invalid license key "notset"`, false},
+		{"using license from the identity file", false},
+		{"license: error reading identity, creating a new one", false},
+		{"handshake failed: connection error", false},
+		{"connected devices: 2", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isLicenseError(tt.msg); got != tt.want {
+			t.Errorf("isLicenseError(%q) = %v, want %v", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestLicenseRefused(t *testing.T) {
+	c := NewClient(NewConfig())
+	c.logs.writeLine(sourceStderr, "Too many connected devices.") // before started
+	started := time.Now()
+	time.Sleep(time.Millisecond)
+	c.logs.writeLine(sourceT2S, "forwarding: too many connected devices")
+	c.logs.writeLine(sourceApp, "[scanner] failed to update license")
+	c.logs.writeLine(sourceApp, "License key ********k1L2 was refused, trying the next one")
+	exited := errors.New("warp exited")
+	if c.licenseRefused(exited, started) {
+		t.Error("refused on lines before the run or from other layers")
+	}
+	if !c.licenseRefused(errors.New("failed to update license: activation error"), started) {
+		t.Error("not refused on the error warp returned")
+	}
+	c.logs.writeLine(sourceStderr, "Too many connected devices.")
+	if !c.licenseRefused(exited, started) {
+		t.Error("not refused on warp's stderr line")
+	}
+}
+
+func TestLicenseRotation(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		licenses []string
+	)
+	orig := runWarp
+	runWarp = func(psiphonEnabled, gool, scan, verbose bool, country, bindAddress, endpoint, license string, ctx context.Context, rtt int) error {
+		mu.Lock()
+		licenses = append(licenses, license)
+		mu.Unlock()
+		if license == "first-key-1111" {
+			log.Println("Too many connected devices.")
+			return errors.New("warp exited")
+		}
+		<-ctx.Done()
+		return nil
+	}
+	defer func() { runWarp = orig }()
+
+	cfg := NewConfig()
+	cfg.LicenseKeys = []string{"first-key-1111", "second-key-2222"}
+	c := NewClient(cfg)
+	c.SetTunStack(&MockTunStack{})
+	if err := c.Start(testDir(t), -1); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	waitConnected(t, c)
+	want := redactLicense("second-key-2222")
+	deadline := time.Now().Add(5 * time.Second)
+	for c.CurrentLicense() != want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := c.CurrentLicense(); got != want {
+		t.Errorf("CurrentLicense = %q, want the second key", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(licenses) != 2 || licenses[0] != "first-key-1111" || licenses[1] != "second-key-2222" {
+		t.Errorf("warp ran with %q, want each key once", licenses)
+	}
+}
@@ -0,0 +1,420 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/xjasonlyu/tun2socks/v2/log"
+)
+
+const (
+	defaultLogChannelSize = 256
+	defaultLogBufferSize  = 4096
+	logListenerQueueSize  = 1024
+)
+
+// LogListener receives every captured log line. It is meant to be implemented
+// on the host side through gomobile.
+type LogListener interface {
+	OnLog(line string)
+}
+
+// logDispatcher delivers lines to the registered LogListener on its own
+// goroutine. Lines are delivered in order; when the listener falls behind by
+// more than logListenerQueueSize lines, the oldest queued lines are dropped.
+type logDispatcher struct {
+	once  sync.Once
+	queue chan string
+
+	// deliverMu is held while OnLog runs, so replacing the listener waits for
+	// any in-flight callback to return.
+	deliverMu sync.Mutex
+	listener  LogListener
+}
+
+var logListeners = &logDispatcher{queue: make(chan string, logListenerQueueSize)}
+
+// SetLogListener registers l to receive every captured log line in addition
+// to the GetLogMessages buffer; nil removes it. Once it returns, the previous
+// listener receives no further lines. It must not be called from OnLog.
+func SetLogListener(l LogListener) {
+	logListeners.once.Do(func() { go logListeners.loop() })
+	logListeners.deliverMu.Lock()
+	defer logListeners.deliverMu.Unlock()
+	logListeners.listener = l
+}
+
+func (d *logDispatcher) loop() {
+	for line := range d.queue {
+		d.deliverMu.Lock()
+		if d.listener != nil {
+			d.listener.OnLog(line)
+		}
+		d.deliverMu.Unlock()
+	}
+}
+
+func (d *logDispatcher) post(line string) {
+	for {
+		select {
+		case d.queue <- line:
+			return
+		default:
+		}
+		select {
+		case <-d.queue:
+		default:
+		}
+	}
+}
+
+// Sources of captured log lines.
+const (
+	sourceApp    = "app"    // standard library logger
+	sourceT2S    = "t2s"    // tun2socks logger
+	sourceStdout = "stdout" // anything printed to os.Stdout
+	sourceStderr = "stderr" // anything printed to os.Stderr
+)
+
+// logTimeFormat is RFC 3339 with millisecond precision.
+const logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// LogEvent is a single captured log line.
+type LogEvent struct {
+	Time    time.Time
+	Level   string
+	Source  string
+	Message string
+	// Session is the ID of the run the line belongs to; see Client.SessionID.
+	Session string
+}
+
+// String formats ev the way GetLogMessages returns it in text mode:
+//
+//	2006-01-02T15:04:05.000Z07:00 [session:id] [source] message
+//
+// The session tag is omitted for lines logged before the first Start.
+func (ev LogEvent) String() string {
+	line := ev.Time.Format(logTimeFormat) + " "
+	if ev.Session != "" {
+		line += "[session:" + ev.Session + "] "
+	}
+	return line + "[" + ev.Source + "] " + ev.Message
+}
+
+// JSON formats ev as a single-line JSON object with ts, level, source, msg
+// and, when known, session.
+func (ev LogEvent) JSON() string {
+	b, _ := json.Marshal(struct {
+		TS      string `json:"ts"`
+		Level   string `json:"level"`
+		Source  string `json:"source"`
+		Msg     string `json:"msg"`
+		Session string `json:"session,omitempty"`
+	}{ev.Time.Format(logTimeFormat), ev.Level, ev.Source, ev.Message, ev.Session})
+	return string(b)
+}
+
+// logJSON selects the JSON log format instead of plain text.
+var logJSON atomic.Bool
+
+// SetLogFormat selects how captured lines are rendered: "text" (the default)
+// or "json". In JSON mode every line is a JSON object and GetLogMessages
+// returns a JSON array.
+func SetLogFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "text":
+		logJSON.Store(false)
+	case "json":
+		logJSON.Store(true)
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+	return nil
+}
+
+// formatEvent renders ev in the current log format.
+func formatEvent(ev LogEvent) string {
+	if logJSON.Load() {
+		return ev.JSON()
+	}
+	return ev.String()
+}
+
+// logLevel is the most verbose L.Level that is captured.
+var logLevel atomic.Uint32
+
+func init() {
+	logLevel.Store(uint32(L.InfoLevel))
+}
+
+// SetLogLevel sets the level of both the tun2socks logger and the captured
+// log lines: "debug", "info", "warn", "error" or "silent". It takes effect
+// immediately, including while connected.
+func SetLogLevel(level string) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	setLogLevel(lvl)
+	return nil
+}
+
+func setLogLevel(lvl L.Level) {
+	logLevel.Store(uint32(lvl))
+	L.SetLevel(lvl)
+}
+
+// eventLevel returns the L.Level of a captured line's level. Anything
+// parseLogLevel does not know counts as debug, so it is never captured at a
+// stricter level than debug lines are.
+func eventLevel(level string) L.Level {
+	lvl, err := parseLogLevel(level)
+	if err != nil || lvl == L.SilentLevel {
+		return L.DebugLevel
+	}
+	return lvl
+}
+
+func parseLogLevel(level string) (L.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return L.DebugLevel, nil
+	case "info":
+		return L.InfoLevel, nil
+	case "warn", "warning":
+		return L.WarnLevel, nil
+	case "error":
+		return L.ErrorLevel, nil
+	case "silent":
+		return L.SilentLevel, nil
+	default:
+		return 0, fmt.Errorf("invalid log level %q", level)
+	}
+}
+
+// logWriter keeps the most recent lines written to it until they are drained,
+// and publishes each line on a bounded channel.
+type logWriter struct {
+	mu       sync.Mutex
+	messages *ring
+	session  string // tags every line, set by Client.Start
+	store    *EventStore
+
+	// bufferDropped counts lines overwritten in messages before being drained.
+	bufferDropped atomic.Uint64
+
+	events  chan LogEvent
+	dropped atomic.Uint64
+}
+
+func newLogWriter(bufferSize, channelSize int) *logWriter {
+	if bufferSize <= 0 {
+		bufferSize = defaultLogBufferSize
+	}
+	if channelSize <= 0 {
+		channelSize = defaultLogChannelSize
+	}
+	return &logWriter{
+		messages: newRing(bufferSize),
+		store:    newEventStore(eventStoreSize),
+		events:   make(chan LogEvent, channelSize),
+	}
+}
+
+// Write captures bytes as a line from the standard library logger.
+func (writer *logWriter) Write(bytes []byte) (int, error) {
+	writer.writeLine(sourceApp, string(bytes))
+	return len(bytes), nil
+}
+
+// source returns a writer that tags every line written to it with tag.
+func (writer *logWriter) source(tag string) *sourceWriter {
+	return &sourceWriter{writer: writer, tag: tag}
+}
+
+func (writer *logWriter) writeLine(source, msg string) {
+	msg = strings.TrimRight(msg, "\r\n")
+	level := levelOf(source, msg)
+	if uint32(eventLevel(level)) > logLevel.Load() {
+		return
+	}
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	ev := LogEvent{Time: time.Now(), Level: level, Source: source, Message: msg, Session: writer.session}
+	line := formatEvent(ev)
+	if writer.messages.push(ev) {
+		writer.bufferDropped.Add(1)
+	}
+	writer.store.add(Event{Time: ev.Time, Level: level, Category: categoryOf(source, msg), Message: msg})
+	writer.publish(ev)
+	logListeners.post(line)
+	logToFile(line)
+}
+
+func (writer *logWriter) setSession(id string) {
+	writer.mu.Lock()
+	writer.session = id
+	writer.mu.Unlock()
+}
+
+// sourceWriter is an io.Writer feeding a logWriter under a fixed source tag.
+type sourceWriter struct {
+	writer *logWriter
+	tag    string
+}
+
+func (w *sourceWriter) Write(bytes []byte) (int, error) {
+	w.writer.writeLine(w.tag, string(bytes))
+	return len(bytes), nil
+}
+
+// publish sends ev without blocking, dropping the oldest queued event when the
+// channel is full. It is called with mu held so events stay in order.
+func (writer *logWriter) publish(ev LogEvent) {
+	for {
+		select {
+		case writer.events <- ev:
+			return
+		default:
+		}
+		select {
+		case <-writer.events:
+			writer.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// drain returns the buffered lines in the current log format and clears the
+// buffer: newline separated in text mode, a JSON array in JSON mode. If lines
+// were lost to the buffer limit since the last drain, they are preceded by a
+// "... N lines dropped ..." entry.
+func (writer *logWriter) drain() string {
+	writer.mu.Lock()
+	evs, dropped := writer.messages.drain()
+	writer.mu.Unlock()
+	return joinEvents(evs, dropped)
+}
+
+// filter returns the buffered lines at least as severe as level, formatted
+// like drain, without removing anything from the buffer.
+func (writer *logWriter) filter(level L.Level) string {
+	writer.mu.Lock()
+	evs := writer.messages.snapshot()
+	writer.mu.Unlock()
+
+	n := 0
+	for _, ev := range evs {
+		if eventLevel(ev.Level) <= level {
+			evs[n] = ev
+			n++
+		}
+	}
+	return joinEvents(evs[:n], 0)
+}
+
+// since returns the buffered events logged after t, oldest first, without
+// removing anything from the buffer.
+func (writer *logWriter) since(t time.Time) []LogEvent {
+	writer.mu.Lock()
+	evs := writer.messages.snapshot()
+	writer.mu.Unlock()
+
+	n := 0
+	for _, ev := range evs {
+		if ev.Time.After(t) {
+			evs[n] = ev
+			n++
+		}
+	}
+	return evs[:n]
+}
+
+// count returns the number of buffered lines.
+func (writer *logWriter) count() int {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	return writer.messages.n
+}
+
+func joinEvents(evs []LogEvent, dropped int) string {
+	asJSON := logJSON.Load()
+	if len(evs) == 0 && dropped == 0 {
+		if asJSON {
+			return "[]"
+		}
+		return ""
+	}
+	lines := make([]string, 0, len(evs)+1)
+	if dropped > 0 {
+		marker := fmt.Sprintf("... %d lines dropped ...", dropped)
+		if asJSON {
+			marker = LogEvent{Time: time.Now(), Level: "warn", Source: sourceApp, Message: marker}.JSON()
+		}
+		lines = append(lines, marker)
+	}
+	for _, ev := range evs {
+		lines = append(lines, formatEvent(ev))
+	}
+	if asJSON {
+		return "[" + strings.Join(lines, ",") + "]"
+	}
+	return strings.Join(lines, "\n")
+}
+
+// setBufferSize changes how many lines are kept between drains; zero or less
+// restores the default.
+func (writer *logWriter) setBufferSize(n int) {
+	if n <= 0 {
+		n = defaultLogBufferSize
+	}
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	writer.messages.resize(n)
+}
+
+// levelOf returns the level of a line from source. Tun2socks lines carry
+// logrus' level= field and stdout/stderr lines the "ERROR: " or "DEBUG: "
+// prefix of wireguard-go's logger. The standard logger has no levels, so
+// lines of this package count as warnings when they start with "Warning:"
+// and as errors when they start with "Error" or "Failed"; the rest is info.
+func levelOf(source, msg string) string {
+	switch source {
+	case sourceT2S:
+		for _, field := range strings.Fields(msg) {
+			if v, ok := strings.CutPrefix(field, "level="); ok {
+				switch v {
+				case "warning":
+					return "warn"
+				case "fatal", "panic":
+					return "error"
+				case "debug", "trace":
+					return "debug"
+				case "error":
+					return v
+				}
+				break
+			}
+		}
+	case sourceStdout, sourceStderr:
+		switch {
+		case strings.HasPrefix(msg, "ERROR: "):
+			return "error"
+		case strings.HasPrefix(msg, "DEBUG: "):
+			return "debug"
+		}
+	default:
+		switch {
+		case strings.HasPrefix(msg, "Warning:"):
+			return "warn"
+		case strings.HasPrefix(msg, "Error"), strings.HasPrefix(msg, "Failed"):
+			return "error"
+		}
+	}
+	return "info"
+}
@@ -0,0 +1,185 @@
+package tun2socks
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	L "github.com/xjasonlyu/tun2socks/v2/log"
+)
+
+// TestLogWriterConcurrentDrain writes through a stdout pipe, as captureOutput
+// sets it up, and through the standard logger path while another goroutine
+// keeps draining the buffer. Run with -race; every line must come out once.
+func TestLogWriterConcurrentDrain(t *testing.T) {
+	const writers, lines = 4, 500
+	logs := newLogWriter(writers*lines*2, 0)
+	r := &run{}
+	pw := r.pipeTo(logs.source(sourceStdout))
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < lines; i++ {
+				if w%2 == 0 {
+					fmt.Fprintf(pw, "pipe %d-%d\n", w, i)
+				} else {
+					fmt.Fprintf(logs, "logger %d-%d\n", w, i)
+				}
+			}
+		}(w)
+	}
+
+	var out strings.Builder
+	stop := make(chan struct{})
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if s := logs.drain(); s != "" {
+				out.WriteString(s + "\n")
+			}
+		}
+	}()
+
+	wg.Wait()
+	r.closePipes()
+	close(stop)
+	<-drained
+	if s := logs.drain(); s != "" {
+		out.WriteString(s + "\n")
+	}
+
+	if strings.Contains(out.String(), "lines dropped") {
+		t.Fatal("lines were dropped although the buffer holds them all")
+	}
+	seen := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		seen[line[strings.LastIndexByte(line, ']')+2:]]++
+	}
+	for w := 0; w < writers; w++ {
+		kind := "pipe"
+		if w%2 != 0 {
+			kind = "logger"
+		}
+		for i := 0; i < lines; i++ {
+			if msg := fmt.Sprintf("%s %d-%d", kind, w, i); seen[msg] != 1 {
+				t.Fatalf("%q drained %d times, want 1", msg, seen[msg])
+			}
+		}
+	}
+}
+
+// recordingListener hands every line to lines; OnLog blocks until the test
+// reads it, after signalling entered.
+type recordingListener struct {
+	lines   chan string
+	entered chan struct{}
+}
+
+func newRecordingListener() *recordingListener {
+	return &recordingListener{lines: make(chan string), entered: make(chan struct{}, 1)}
+}
+
+func (l *recordingListener) OnLog(line string) {
+	select {
+	case l.entered <- struct{}{}:
+	default:
+	}
+	l.lines <- line
+}
+
+func TestLogListenerOrder(t *testing.T) {
+	d := &logDispatcher{queue: make(chan string, 16)}
+	l := newRecordingListener()
+	d.listener = l
+	go d.loop()
+	defer close(d.queue)
+
+	for i := 0; i < 10; i++ {
+		d.post(fmt.Sprint("line ", i))
+	}
+	for i := 0; i < 10; i++ {
+		if got, want := <-l.lines, fmt.Sprint("line ", i); got != want {
+			t.Fatalf("line %d = %q, want %q", i, got, want)
+		}
+	}
+}
+
+// TestLogListenerOverflow checks that a listener stuck in OnLog does not
+// block the writer and, once it catches up, gets the newest queued lines in
+// order with the oldest ones dropped.
+func TestLogListenerOverflow(t *testing.T) {
+	const size = 8
+	d := &logDispatcher{queue: make(chan string, size)}
+	l := newRecordingListener()
+	d.listener = l
+	go d.loop()
+	defer close(d.queue)
+
+	d.post("line 0")
+	<-l.entered
+	// The loop is now stuck in OnLog with line 0, so the queue fills up.
+	posted := make(chan struct{})
+	go func() {
+		defer close(posted)
+		for i := 1; i <= size+5; i++ {
+			d.post(fmt.Sprint("line ", i))
+		}
+	}()
+	select {
+	case <-posted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("post blocked on a stuck listener")
+	}
+
+	if got := <-l.lines; got != "line 0" {
+		t.Fatalf("first line = %q, want line 0", got)
+	}
+	// Lines 1 to 5 were dropped to make room.
+	for i := 6; i <= size+5; i++ {
+		if got, want := <-l.lines, fmt.Sprint("line ", i); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	select {
+	case line := <-l.lines:
+		t.Errorf("unexpected extra line %q", line)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLogLevelFiltersTrace(t *testing.T) {
+	defer setLogLevel(L.InfoLevel)
+	const trace = `time="2024-01-01T00:00:00Z" level=trace msg="[TCP] dial"`
+	for _, tt := range []struct {
+		level L.Level
+		want  int
+	}{
+		{L.SilentLevel, 0},
+		{L.ErrorLevel, 0},
+		{L.InfoLevel, 0},
+		{L.DebugLevel, 1},
+	} {
+		setLogLevel(tt.level)
+		logs := newLogWriter(0, 0)
+		logs.writeLine(sourceT2S, trace)
+		if n := logs.count(); n != tt.want {
+			t.Errorf("at %v: %d trace lines captured, want %d", tt.level, n, tt.want)
+		}
+		if tt.want > 0 {
+			if evs := logs.since(time.Time{}); evs[0].Level != "debug" {
+				t.Errorf("trace line has level %q, want debug", evs[0].Level)
+			}
+		}
+	}
+}
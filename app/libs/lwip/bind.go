@@ -0,0 +1,97 @@
+package lwip
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+var errBindUnsupported = errors.New("not supported on this platform")
+
+// outboundBinding is where ControlSocket binds outbound sockets: an Android
+// network handle, which takes precedence, or an interface name. A non-zero
+// mark is set as their SO_MARK.
+type outboundBinding struct {
+	iface   string
+	network int64
+	mark    int
+	// reported and markReported are set once a failure to bind or mark has
+	// been logged, so a broken setting is reported once rather than for every
+	// dial.
+	reported     atomic.Bool
+	markReported atomic.Bool
+}
+
+var binding atomic.Pointer[outboundBinding]
+
+// SetOutboundInterface binds sockets dialed with ControlSocket to the
+// interface called name with SO_BINDTODEVICE, e.g. to keep direct flows on
+// cellular while Wi-Fi is captive; "" unbinds them. It applies to new sockets
+// only. SO_BINDTODEVICE needs CAP_NET_RAW; Android apps should use
+// SetOutboundNetwork instead.
+func SetOutboundInterface(name string) {
+	setBinding(func(b *outboundBinding) { b.iface = name })
+}
+
+// SetOutboundNetwork binds sockets dialed with ControlSocket to the Android
+// network with the given handle, as android.net.Network.getNetworkHandle
+// returns it; 0 unbinds them. It takes precedence over SetOutboundInterface
+// and applies to new sockets only.
+func SetOutboundNetwork(handle int64) {
+	setBinding(func(b *outboundBinding) { b.network = handle })
+}
+
+// SetOutboundMark sets the fwmark of sockets dialed with ControlSocket, for
+// policy routing with ip rule fwmark; 0 leaves them unmarked. Setting SO_MARK
+// needs CAP_NET_ADMIN and only exists on Linux; where it fails a warning is
+// logged once and the sockets go out unmarked.
+func SetOutboundMark(mark int) {
+	setBinding(func(b *outboundBinding) { b.mark = mark })
+}
+
+func setBinding(update func(b *outboundBinding)) {
+	for {
+		cur := binding.Load()
+		next := &outboundBinding{}
+		if cur != nil {
+			next.iface, next.network, next.mark = cur.iface, cur.network, cur.mark
+		}
+		update(next)
+		if binding.CompareAndSwap(cur, next) {
+			return
+		}
+	}
+}
+
+// bindOutbound marks fd as set with SetOutboundMark and binds it as set with
+// SetOutboundNetwork or SetOutboundInterface. Only a failure to bind fails
+// the dial.
+func bindOutbound(fd int) error {
+	b := binding.Load()
+	if b == nil {
+		return nil
+	}
+	if b.mark != 0 {
+		if err := setMark(fd, b.mark); err != nil && !b.markReported.Swap(true) {
+			log.Warnf("setting fwmark %d on sockets failed, sending them unmarked: %v", b.mark, err)
+		}
+	}
+	if b.network == 0 && b.iface == "" {
+		return nil
+	}
+	var err error
+	if b.network != 0 {
+		err = bindToNetwork(fd, b.network)
+	} else {
+		err = bindToDevice(fd, b.iface)
+	}
+	if err != nil && !b.reported.Swap(true) {
+		if b.network != 0 {
+			log.Errorf("binding sockets to network %d failed: %v", b.network, err)
+		} else {
+			log.Errorf("binding sockets to interface %s failed: %v", b.iface, err)
+		}
+	}
+	return err
+}
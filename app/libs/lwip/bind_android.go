@@ -0,0 +1,42 @@
+//go:build android
+
+package lwip
+
+/*
+#cgo LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <errno.h>
+#include <stdint.h>
+
+// android_setsocknetwork is looked up at run time since libandroid only has
+// it from API level 23 on.
+static int setsocknetwork(uint64_t handle, int fd) {
+	static int (*fn)(uint64_t, int);
+	if (!fn) {
+		void *lib = dlopen("libandroid.so", RTLD_NOW);
+		if (lib) {
+			fn = (int (*)(uint64_t, int))dlsym(lib, "android_setsocknetwork");
+		}
+	}
+	if (!fn) {
+		errno = ENOSYS;
+		return -1;
+	}
+	return fn(handle, fd);
+}
+*/
+import "C"
+
+import "syscall"
+
+// bindToNetwork binds fd to the Android network with the given handle.
+func bindToNetwork(fd int, handle int64) error {
+	r, err := C.setsocknetwork(C.uint64_t(handle), C.int(fd))
+	if r == 0 {
+		return nil
+	}
+	if err == nil {
+		err = syscall.EINVAL
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+package lwip
+
+import "syscall"
+
+// bindToDevice binds fd to the interface called name.
+func bindToDevice(fd int, name string) error {
+	return syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+}
+
+// setMark sets the SO_MARK of fd.
+func setMark(fd, mark int) error {
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+}
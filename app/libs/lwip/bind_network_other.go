@@ -0,0 +1,8 @@
+//go:build !android
+
+package lwip
+
+// bindToNetwork needs android_setsocknetwork, which only Android has.
+func bindToNetwork(fd int, handle int64) error {
+	return errBindUnsupported
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package lwip
+
+// bindToDevice is only implemented with SO_BINDTODEVICE on Linux.
+func bindToDevice(fd int, name string) error {
+	return errBindUnsupported
+}
+
+// setMark is only implemented with SO_MARK on Linux.
+func setMark(fd, mark int) error {
+	return errBindUnsupported
+}
@@ -0,0 +1,134 @@
+package lwip
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+const (
+	bypassDialTimeout = 10 * time.Second
+	bypassUDPIdle     = 30 * time.Second
+)
+
+// bypassTCPHandler connects flows the active route table sends direct, and
+// those of excluded apps, to their destination instead of through the SOCKS5
+// server. The app's own sockets are excluded from the VPN, or protected with
+// SetSocketProtector, so the direct connection does not loop back into the
+// tun device.
+type bypassTCPHandler struct {
+	core.TCPConnHandler
+}
+
+func (h bypassTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	direct, host := activeRoutes.Load().route(target.IP)
+	if !direct && excludedFlow("tcp", flowSource(conn, target), target) {
+		direct = true
+	}
+	if !direct {
+		return h.TCPConnHandler.Handle(conn, target)
+	}
+	addr := target.String()
+	if host != "" {
+		addr = net.JoinHostPort(host, strconv.Itoa(target.Port))
+	}
+	remote, err := directDialer.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Debugf("bypass tcp %v", addr)
+	go func() {
+		defer conn.Close()
+		defer remote.Close()
+		done := make(chan struct{}, 2)
+		go func() {
+			io.Copy(remote, conn)
+			done <- struct{}{}
+		}()
+		go func() {
+			io.Copy(conn, remote)
+			done <- struct{}{}
+		}()
+		<-done
+	}()
+	return nil
+}
+
+// bypassUDPHandler is the UDP counterpart of bypassTCPHandler.
+type bypassUDPHandler struct {
+	core.UDPConnHandler
+
+	mu    sync.Mutex
+	conns map[core.UDPConn]*net.UDPConn
+}
+
+func newBypassUDPHandler(inner core.UDPConnHandler) *bypassUDPHandler {
+	return &bypassUDPHandler{UDPConnHandler: inner, conns: make(map[core.UDPConn]*net.UDPConn)}
+}
+
+func (h *bypassUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	if target == nil {
+		return h.UDPConnHandler.Connect(conn, target)
+	}
+	direct, host := activeRoutes.Load().route(target.IP)
+	if !direct && excludedFlow("udp", conn.LocalAddr(), target) {
+		direct = true
+	}
+	if !direct {
+		return h.UDPConnHandler.Connect(conn, target)
+	}
+	dst := target
+	if host != "" {
+		var err error
+		if dst, err = net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(target.Port))); err != nil {
+			return err
+		}
+	}
+	c, err := directDialer.Dial("udp", dst.String())
+	if err != nil {
+		return err
+	}
+	remote := c.(*net.UDPConn)
+	log.Debugf("bypass udp %v", dst)
+	h.mu.Lock()
+	h.conns[conn] = remote
+	h.mu.Unlock()
+
+	go func() {
+		defer func() {
+			h.mu.Lock()
+			delete(h.conns, conn)
+			h.mu.Unlock()
+			remote.Close()
+			conn.Close()
+		}()
+		buf := make([]byte, 64*1024)
+		for {
+			remote.SetReadDeadline(time.Now().Add(bypassUDPIdle))
+			n, err := remote.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := conn.WriteFrom(buf[:n], target); err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (h *bypassUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.mu.Lock()
+	remote, ok := h.conns[conn]
+	h.mu.Unlock()
+	if !ok {
+		return h.UDPConnHandler.ReceiveTo(conn, data, addr)
+	}
+	_, err := remote.Write(data)
+	return err
+}
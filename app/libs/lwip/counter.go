@@ -0,0 +1,55 @@
+package lwip
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+var (
+	rxBytes, txBytes     atomic.Uint64
+	rxPackets, txPackets atomic.Uint64
+)
+
+// BytesTransferred returns the bytes written to the tun device (rx, traffic
+// coming back from the tunnel) and read from it (tx, traffic the device sent)
+// since the last ResetCounters.
+func BytesTransferred() (rx, tx uint64) {
+	return rxBytes.Load(), txBytes.Load()
+}
+
+// PacketsTransferred is BytesTransferred counted in packets.
+func PacketsTransferred() (rx, tx uint64) {
+	return rxPackets.Load(), txPackets.Load()
+}
+
+// ResetCounters sets the traffic counters back to zero.
+func ResetCounters() {
+	rxBytes.Store(0)
+	txBytes.Store(0)
+	rxPackets.Store(0)
+	txPackets.Store(0)
+}
+
+// countingReadWriteCloser counts the bytes and packets passing through the
+// tun device, where every read or write carries one packet.
+type countingReadWriteCloser struct {
+	io.ReadWriteCloser
+}
+
+func (c countingReadWriteCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		txBytes.Add(uint64(n))
+		txPackets.Add(1)
+	}
+	return n, err
+}
+
+func (c countingReadWriteCloser) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		rxBytes.Add(uint64(n))
+		rxPackets.Add(1)
+	}
+	return n, err
+}
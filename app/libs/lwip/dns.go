@@ -0,0 +1,75 @@
+package lwip
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+const (
+	dnsPort       = 53
+	dnsHeaderSize = 12
+	dnsTypeAAAA   = 28
+)
+
+// noAAAAHandler answers DNS AAAA queries with an empty response instead of
+// forwarding them, so clients on an IPv4-only stack do not wait for an IPv6
+// answer that can never be used.
+type noAAAAHandler struct {
+	core.UDPConnHandler
+}
+
+func (h noAAAAHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	if addr.Port == dnsPort {
+		if resp := emptyAAAAResponse(data); resp != nil {
+			_, err := conn.WriteFrom(resp, addr)
+			return err
+		}
+	}
+	return h.UDPConnHandler.ReceiveTo(conn, data, addr)
+}
+
+// emptyAAAAResponse returns a NOERROR response with no answers when query is
+// a single-question AAAA query, and nil otherwise.
+func emptyAAAAResponse(query []byte) []byte {
+	if len(query) < dnsHeaderSize {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(query[2:4])
+	if flags&0x8000 != 0 || (flags>>11)&0xf != 0 { // a response, or not a standard query
+		return nil
+	}
+	if binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return nil
+	}
+	// Walk the question name to find its type.
+	i := dnsHeaderSize
+	for {
+		if i >= len(query) {
+			return nil
+		}
+		n := int(query[i])
+		if n == 0 {
+			i++
+			break
+		}
+		if n&0xc0 != 0 { // compression is not valid in a query's only name
+			return nil
+		}
+		i += 1 + n
+	}
+	if i+4 > len(query) || binary.BigEndian.Uint16(query[i:i+2]) != dnsTypeAAAA {
+		return nil
+	}
+	end := i + 4
+
+	resp := make([]byte, end)
+	copy(resp, query[:end])
+	// QR=1, keep opcode and RD, set RA, RCODE=0.
+	binary.BigEndian.PutUint16(resp[2:4], 0x8000|flags&0x7900|0x0080)
+	binary.BigEndian.PutUint16(resp[6:8], 0)   // ANCOUNT
+	binary.BigEndian.PutUint16(resp[8:10], 0)  // NSCOUNT
+	binary.BigEndian.PutUint16(resp[10:12], 0) // ARCOUNT
+	return resp
+}
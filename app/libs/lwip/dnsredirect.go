@@ -0,0 +1,91 @@
+package lwip
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// dnsRedirectHandler sends every DNS query to one of the configured
+// resolvers, whatever server the device asked. Replies are rewritten to come
+// from the server the device expects. It sits in front of the flow handler,
+// so GetConnections shows the resolver actually used.
+type dnsRedirectHandler struct {
+	core.UDPConnHandler
+	servers []*net.UDPAddr
+	next    atomic.Uint32
+
+	mu    sync.Mutex
+	conns map[core.UDPConn]*dnsRedirectConn
+}
+
+func newDNSRedirectHandler(inner core.UDPConnHandler, servers []*net.UDPAddr) *dnsRedirectHandler {
+	return &dnsRedirectHandler{UDPConnHandler: inner, servers: servers, conns: make(map[core.UDPConn]*dnsRedirectConn)}
+}
+
+// parseDNSServers resolves the ip:port resolver addresses.
+func parseDNSServers(servers []string) ([]*net.UDPAddr, error) {
+	addrs := make([]*net.UDPAddr, 0, len(servers))
+	for _, s := range servers {
+		addr, err := net.ResolveUDPAddr("udp", s)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func (h *dnsRedirectHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	if target == nil || target.Port != dnsPort {
+		return h.UDPConnHandler.Connect(conn, target)
+	}
+	server := h.servers[int(h.next.Add(1)-1)%len(h.servers)]
+	rc := &dnsRedirectConn{UDPConn: conn, orig: target, server: server, h: h}
+	h.mu.Lock()
+	h.conns[conn] = rc
+	h.mu.Unlock()
+	log.Infof("dns %v redirected to %v", target, server)
+	err := h.UDPConnHandler.Connect(rc, server)
+	if err != nil {
+		rc.forget()
+	}
+	return err
+}
+
+func (h *dnsRedirectHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.mu.Lock()
+	rc, ok := h.conns[conn]
+	h.mu.Unlock()
+	if !ok {
+		return h.UDPConnHandler.ReceiveTo(conn, data, addr)
+	}
+	return h.UDPConnHandler.ReceiveTo(rc, data, rc.server)
+}
+
+type dnsRedirectConn struct {
+	core.UDPConn
+	orig, server *net.UDPAddr
+	h            *dnsRedirectHandler
+	once         sync.Once
+}
+
+func (c *dnsRedirectConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	return c.UDPConn.WriteFrom(data, c.orig)
+}
+
+func (c *dnsRedirectConn) Close() error {
+	c.forget()
+	return c.UDPConn.Close()
+}
+
+func (c *dnsRedirectConn) forget() {
+	c.once.Do(func() {
+		c.h.mu.Lock()
+		delete(c.h.conns, c.UDPConn)
+		c.h.mu.Unlock()
+	})
+}
@@ -0,0 +1,87 @@
+package lwip
+
+import (
+	"net"
+	"sync"
+
+	"github.com/eycorsican/go-tun2socks/common/dns"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// DNSResolver answers a raw DNS query; a nil reply drops the query.
+type DNSResolver func(query []byte) []byte
+
+// resolverHandler answers every DNS query on the tun device with the
+// resolver instead of sending it anywhere, e.g. to resolve it over
+// DNS-over-HTTPS. With a fake DNS, A and AAAA queries still get fake
+// addresses, so flows can be matched to their host by the domain rules; only
+// the other types reach the resolver. Queries are resolved off the lwip
+// thread and the session is closed once no query is outstanding.
+type resolverHandler struct {
+	core.UDPConnHandler
+	resolve DNSResolver
+	fake    dns.FakeDns // nil without a fake ip range
+
+	mu      sync.Mutex
+	pending map[core.UDPConn]int
+}
+
+func newResolverHandler(inner core.UDPConnHandler, resolve DNSResolver, fake dns.FakeDns) *resolverHandler {
+	return &resolverHandler{UDPConnHandler: inner, resolve: resolve, fake: fake, pending: make(map[core.UDPConn]int)}
+}
+
+func (h *resolverHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	if target == nil || target.Port != dnsPort {
+		return h.UDPConnHandler.Connect(conn, target)
+	}
+	h.mu.Lock()
+	h.pending[conn] = 0
+	h.mu.Unlock()
+	return nil
+}
+
+func (h *resolverHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.mu.Lock()
+	n, ok := h.pending[conn]
+	if ok {
+		h.pending[conn] = n + 1
+	}
+	h.mu.Unlock()
+	if !ok {
+		return h.UDPConnHandler.ReceiveTo(conn, data, addr)
+	}
+	query := append([]byte(nil), data...)
+	go func() {
+		resp := h.fakeResponse(query)
+		if resp == nil {
+			resp = h.resolve(query)
+		}
+		if resp != nil {
+			conn.WriteFrom(resp, addr)
+		}
+		h.mu.Lock()
+		h.pending[conn]--
+		done := h.pending[conn] == 0
+		if done {
+			delete(h.pending, conn)
+		}
+		h.mu.Unlock()
+		if done {
+			conn.Close()
+		}
+	}()
+	return nil
+}
+
+// fakeResponse returns the fake DNS answer to query, or nil when there is no
+// fake DNS or query is not a single A or AAAA question.
+func (h *resolverHandler) fakeResponse(query []byte) []byte {
+	if h.fake == nil {
+		return nil
+	}
+	resp, err := h.fake.GenerateFakeResponse(query)
+	if err != nil {
+		return nil
+	}
+	return resp
+}
@@ -0,0 +1,216 @@
+package lwip
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/dns"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// Flow describes an open connection through the tun stack.
+type Flow struct {
+	Protocol    string
+	Source      string
+	Destination string
+	// Host is the domain behind a fake destination IP, when known.
+	Host     string
+	BytesIn  uint64
+	BytesOut uint64
+	Started  time.Time
+}
+
+type flow struct {
+	protocol    string
+	source      string
+	destination string
+	host        string
+	in, out     atomic.Uint64
+	started     time.Time
+}
+
+// flows holds the open flows. The data path only touches a flow's atomics;
+// the lock is taken when a flow opens or closes and while listing.
+var flows struct {
+	sync.Mutex
+	m map[*flow]struct{}
+}
+
+func addFlow(proto string, src net.Addr, dst net.Addr, ip net.IP, fake dns.FakeDns) *flow {
+	f := &flow{protocol: proto, destination: dst.String(), started: time.Now()}
+	if src != nil {
+		f.source = src.String()
+	}
+	if fake != nil && fake.IsFakeIP(ip) {
+		f.host = fake.QueryDomain(ip)
+	}
+	flows.Lock()
+	if flows.m == nil {
+		flows.m = make(map[*flow]struct{})
+	}
+	flows.m[f] = struct{}{}
+	flows.Unlock()
+	return f
+}
+
+func removeFlow(f *flow) {
+	flows.Lock()
+	delete(flows.m, f)
+	flows.Unlock()
+}
+
+// Flows returns up to limit open flows, oldest first; limit <= 0 returns all.
+func Flows(limit int) []Flow {
+	flows.Lock()
+	list := make([]Flow, 0, len(flows.m))
+	for f := range flows.m {
+		list = append(list, Flow{
+			Protocol:    f.protocol,
+			Source:      f.source,
+			Destination: f.destination,
+			Host:        f.host,
+			BytesIn:     f.in.Load(),
+			BytesOut:    f.out.Load(),
+			Started:     f.started,
+		})
+	}
+	flows.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// flowTCPHandler records every TCP connection handed to the inner handler.
+type flowTCPHandler struct {
+	core.TCPConnHandler
+	fake dns.FakeDns
+}
+
+func (h flowTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	f := addFlow("tcp", flowSource(conn, target), target, target.IP, h.fake)
+	err := h.TCPConnHandler.Handle(&flowConn{Conn: conn, flow: f}, target)
+	if err != nil {
+		removeFlow(f)
+	}
+	return err
+}
+
+// flowConn counts the bytes of a TCP flow: reads are what the device sent,
+// writes what came back.
+type flowConn struct {
+	net.Conn
+	flow *flow
+	once sync.Once
+}
+
+func (c *flowConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.flow.out.Add(uint64(n))
+	return n, err
+}
+
+func (c *flowConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.flow.in.Add(uint64(n))
+	return n, err
+}
+
+func (c *flowConn) Close() error {
+	c.once.Do(func() { removeFlow(c.flow) })
+	return c.Conn.Close()
+}
+
+// CloseRead and CloseWrite keep half-close working for handlers that use it.
+func (c *flowConn) CloseRead() error {
+	if hc, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return hc.CloseRead()
+	}
+	return c.Close()
+}
+
+func (c *flowConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return c.Close()
+}
+
+// flowUDPHandler records UDP sessions. The inner handler sees a wrapped
+// UDPConn, so its own bookkeeping keyed by conn keeps working.
+type flowUDPHandler struct {
+	core.UDPConnHandler
+	fake dns.FakeDns
+
+	mu    sync.Mutex
+	conns map[core.UDPConn]*flowUDPConn
+}
+
+func newFlowUDPHandler(inner core.UDPConnHandler, fake dns.FakeDns) *flowUDPHandler {
+	return &flowUDPHandler{UDPConnHandler: inner, fake: fake, conns: make(map[core.UDPConn]*flowUDPConn)}
+}
+
+func (h *flowUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	var fc *flowUDPConn
+	if target != nil {
+		fc = &flowUDPConn{UDPConn: conn, flow: addFlow("udp", conn.LocalAddr(), target, target.IP, h.fake), h: h}
+	} else {
+		fc = &flowUDPConn{UDPConn: conn, h: h}
+	}
+	h.mu.Lock()
+	h.conns[conn] = fc
+	h.mu.Unlock()
+	err := h.UDPConnHandler.Connect(fc, target)
+	if err != nil {
+		fc.forget()
+	}
+	return err
+}
+
+func (h *flowUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.mu.Lock()
+	fc, ok := h.conns[conn]
+	h.mu.Unlock()
+	if !ok {
+		return h.UDPConnHandler.ReceiveTo(conn, data, addr)
+	}
+	if fc.flow != nil {
+		fc.flow.out.Add(uint64(len(data)))
+	}
+	return h.UDPConnHandler.ReceiveTo(fc, data, addr)
+}
+
+type flowUDPConn struct {
+	core.UDPConn
+	flow *flow // nil when the target was unknown at Connect
+	h    *flowUDPHandler
+	once sync.Once
+}
+
+func (c *flowUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	n, err := c.UDPConn.WriteFrom(data, addr)
+	if c.flow != nil {
+		c.flow.in.Add(uint64(n))
+	}
+	return n, err
+}
+
+func (c *flowUDPConn) Close() error {
+	c.forget()
+	return c.UDPConn.Close()
+}
+
+func (c *flowUDPConn) forget() {
+	c.once.Do(func() {
+		c.h.mu.Lock()
+		delete(c.h.conns, c.UDPConn)
+		c.h.mu.Unlock()
+		if c.flow != nil {
+			removeFlow(c.flow)
+		}
+	})
+}
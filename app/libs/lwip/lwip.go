@@ -2,11 +2,13 @@ package lwip
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
 	"time"
 
+	"github.com/eycorsican/go-tun2socks/common/dns"
 	"github.com/eycorsican/go-tun2socks/common/dns/cache"
 	"github.com/eycorsican/go-tun2socks/common/dns/fakedns"
 	"github.com/eycorsican/go-tun2socks/common/log"
@@ -25,6 +27,26 @@ type Tun2socksStartOptions struct {
 	MTU          int
 	EnableIPv6   bool
 	AllowLan     bool
+	// BypassCIDRs are connected to directly instead of through Socks5Server.
+	BypassCIDRs []string
+	// RouteCIDRs, when set, are the only destinations sent to Socks5Server;
+	// the rest is connected to directly. The longest matching prefix of both
+	// lists decides.
+	RouteCIDRs []string
+	// BypassDomains and RouteDomains are the same for hosts resolved by the
+	// fake DNS, as suffixes: example.com also matches sub.example.com. They
+	// take precedence over the CIDR rules and need FakeIPRange.
+	BypassDomains []string
+	RouteDomains  []string
+	// PCAPFile, when set, receives a copy of every packet on the tun device.
+	PCAPFile string
+	// DNSServers, as ip:port, receive every DNS query instead of the server
+	// the device asked.
+	DNSServers []string
+	// ResolveDNS, when set, answers the DNS queries on the tun device itself,
+	// e.g. over DNS-over-HTTPS; DNSServers is then ignored. With FakeIPRange
+	// set, A and AAAA queries are still answered by the fake DNS.
+	ResolveDNS DNSResolver
 }
 
 var (
@@ -38,12 +60,16 @@ var (
 // Stop stop it
 func Stop() {
 	log.Infof("enter stop")
-	log.Infof("begin close tun")
-	err := tunDev.Close()
-	if err != nil {
-		log.Infof("close tun(Stop func): %v", err)
+	if tunDev != nil {
+		log.Infof("begin close tun")
+		err := tunDev.Close()
+		if err != nil {
+			log.Infof("close tun(Stop func): %v", err)
+		}
 	}
-	if lwipTUNDataPipeTask.Running() {
+	if lwipTUNDataPipeTask == nil {
+		log.Infof("lwipTUNDataPipeTask never started")
+	} else if lwipTUNDataPipeTask.Running() {
 		log.Infof("send stop lwipTUNDataPipeTask sig")
 		lwipTUNDataPipeTask.Stop()
 		log.Infof("lwipTUNDataPipeTask stop sig sent")
@@ -52,27 +78,45 @@ func Stop() {
 		log.Infof("lwipTUNDataPipeTask already stopped")
 	}
 
-	log.Infof("begin close lwipStack")
-	lwipStack.Close(core.DELAY)
+	if lwipStack != nil {
+		log.Infof("begin close lwipStack")
+		lwipStack.Close(core.DELAY)
+	}
+	flows.Lock()
+	flows.m = nil
+	flows.Unlock()
+	activeRoutes.Store(nil)
 }
 
 // hack to receive tunfd
-func openTunDevice(tunFd int) (*water.Interface, error) {
+func openTunDevice(tunFd int, pcapFile string) (*water.Interface, error) {
 	file := os.NewFile(uintptr(tunFd), "tun") // dummy file path name since we already got the fd
+	var rwc io.ReadWriteCloser = countingReadWriteCloser{file}
+	if pcapFile != "" {
+		p, err := openPCAP(pcapFile)
+		if err != nil {
+			return nil, fmt.Errorf("open pcap file: %w", err)
+		}
+		log.Infof("writing packets to %v", pcapFile)
+		rwc = pcapReadWriteCloser{rwc, p}
+	}
 	tunDev = &water.Interface{
-		ReadWriteCloser: file,
+		ReadWriteCloser: pauseReadWriteCloser{rwc},
 	}
 	return tunDev, nil
 }
 
 // Start sets up lwIP stack, starts a Tun2socks instance
-func Start(opt *Tun2socksStartOptions) int {
+func Start(opt *Tun2socksStartOptions) error {
+	if errs := ValidateTun2socksOptions(opt); len(errs) > 0 {
+		return errors.Join(errs...)
+	}
 
 	mtuUsed = opt.MTU
 	var err error
-	tunDev, err = openTunDevice(opt.TunFd)
+	tunDev, err = openTunDevice(opt.TunFd, opt.PCAPFile)
 	if err != nil {
-		log.Fatalf("failed to open tun device: %v", err)
+		return fmt.Errorf("failed to open tun device: %w", err)
 	}
 	// handle previous lwIP stack
 	if lwipStack != nil {
@@ -88,25 +132,57 @@ func Start(opt *Tun2socksStartOptions) int {
 
 	// Register tun2socks connection handlers.
 	proxyAddr, err := net.ResolveTCPAddr("tcp", opt.Socks5Server)
+	if err != nil {
+		return fmt.Errorf("invalid proxy server address: %w", err)
+	}
 	proxyHost := proxyAddr.IP.String()
 	proxyPort := uint16(proxyAddr.Port)
+	cacheDNS := cache.NewSimpleDnsCache()
+	dnsServers, err := parseDNSServers(opt.DNSServers)
 	if err != nil {
-		log.Infof("invalid proxy server address: %v", err)
-		return -1
+		return fmt.Errorf("invalid dns server: %w", err)
 	}
-	cacheDNS := cache.NewSimpleDnsCache()
+	var tcpHandler core.TCPConnHandler
+	var udpHandler core.UDPConnHandler
+	var fake dns.FakeDns
+	var fakeNet *net.IPNet
 	if opt.FakeIPRange != "" {
 		_, ipnet, err := net.ParseCIDR(opt.FakeIPRange)
 		if err != nil {
-			log.Fatalf("failed to parse fake ip range %v", opt.FakeIPRange)
+			return fmt.Errorf("failed to parse fake ip range %v: %w", opt.FakeIPRange, err)
 		}
+		fakeNet = ipnet
 		fakeDNS := fakedns.NewFakeDNS(ipnet, 3000)
-		core.RegisterTCPConnHandler(socks.NewTCPHandler(proxyHost, proxyPort, fakeDNS))
-		core.RegisterUDPConnHandler(socks.NewUDPHandler(proxyHost, proxyPort, 30*time.Second, cacheDNS, fakeDNS))
+		fake = fakeDNS
+		tcpHandler = socks.NewTCPHandler(proxyHost, proxyPort, fakeDNS)
+		udpHandler = socks.NewUDPHandler(proxyHost, proxyPort, 30*time.Second, cacheDNS, fakeDNS)
 	} else {
-		core.RegisterTCPConnHandler(socks.NewTCPHandler(proxyHost, proxyPort, nil))
-		core.RegisterUDPConnHandler(socks.NewUDPHandler(proxyHost, proxyPort, 30*time.Second, cacheDNS, nil))
+		tcpHandler = socks.NewTCPHandler(proxyHost, proxyPort, nil)
+		udpHandler = socks.NewUDPHandler(proxyHost, proxyPort, 30*time.Second, cacheDNS, nil)
+	}
+	if !opt.EnableIPv6 {
+		udpHandler = noAAAAHandler{udpHandler}
+	}
+	routes, err := newRouteTable(opt.BypassCIDRs, opt.RouteCIDRs, opt.BypassDomains, opt.RouteDomains, fakeNet, fake)
+	if err != nil {
+		return err
+	}
+	// Always installed, so UpdateRoutes can add rules to a stack started
+	// without any.
+	tcpHandler = bypassTCPHandler{tcpHandler}
+	udpHandler = newBypassUDPHandler(udpHandler)
+	activeRoutes.Store(routes)
+	core.RegisterTCPConnHandler(flowTCPHandler{tcpHandler, fake})
+	udpHandler = newFlowUDPHandler(udpHandler, fake)
+	if opt.ResolveDNS != nil {
+		udpHandler = newResolverHandler(udpHandler, opt.ResolveDNS, fake)
+		if !opt.EnableIPv6 {
+			udpHandler = noAAAAHandler{udpHandler}
+		}
+	} else if len(dnsServers) > 0 {
+		udpHandler = newDNSRedirectHandler(udpHandler, dnsServers)
 	}
+	core.RegisterUDPConnHandler(udpHandler)
 
 	// Register an output callback to write packets output from lwip stack to tun
 	// device, output function should be set before input any packets.
@@ -160,5 +236,5 @@ func Start(opt *Tun2socksStartOptions) int {
 
 	log.Infof("Running tun2socks")
 
-	return 0
+	return nil
 }
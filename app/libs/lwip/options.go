@@ -0,0 +1,148 @@
+package lwip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	minMTU = 576
+	maxMTU = 65535
+)
+
+// ValidateTun2socksOptions returns every problem found in opts, or nil.
+func ValidateTun2socksOptions(opts *Tun2socksStartOptions) []error {
+	if opts == nil {
+		return []error{errors.New("options must not be nil")}
+	}
+	var errs []error
+	if opts.TunFd < 0 {
+		errs = append(errs, fmt.Errorf("invalid tun fd %d", opts.TunFd))
+	}
+	if host, port, err := net.SplitHostPort(opts.Socks5Server); err != nil {
+		errs = append(errs, fmt.Errorf("invalid socks5 server %q: %w", opts.Socks5Server, err))
+	} else if p, err := strconv.Atoi(port); host == "" || err != nil || p < 1 || p > 65535 {
+		errs = append(errs, fmt.Errorf("invalid socks5 server %q: expected host:port", opts.Socks5Server))
+	}
+	if opts.FakeIPRange != "" {
+		if _, _, err := net.ParseCIDR(opts.FakeIPRange); err != nil {
+			errs = append(errs, fmt.Errorf("invalid fake ip range %q: %w", opts.FakeIPRange, err))
+		}
+	}
+	if opts.MTU != 0 && (opts.MTU < minMTU || opts.MTU > maxMTU) {
+		errs = append(errs, fmt.Errorf("invalid mtu %d: must be 0 or between %d and %d", opts.MTU, minMTU, maxMTU))
+	}
+	for _, server := range opts.DNSServers {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil || net.ParseIP(host) == nil {
+			errs = append(errs, fmt.Errorf("invalid dns server %q: expected ip:port", server))
+		}
+	}
+	for _, cidr := range opts.BypassCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid bypass cidr %q: %w", cidr, err))
+		}
+	}
+	for _, cidr := range opts.RouteCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid route cidr %q: %w", cidr, err))
+		}
+	}
+	for _, d := range append(append([]string(nil), opts.BypassDomains...), opts.RouteDomains...) {
+		if _, err := normalizeDomain(d); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if (len(opts.BypassDomains) > 0 || len(opts.RouteDomains) > 0) && opts.FakeIPRange == "" {
+		errs = append(errs, errors.New("domain rules need a fake ip range"))
+	}
+	return errs
+}
+
+// Tun2socksOptionsBuilder builds Tun2socksStartOptions and validates them in
+// Build.
+type Tun2socksOptionsBuilder struct {
+	opts Tun2socksStartOptions
+}
+
+// NewTun2socksOptions returns a builder with IPv6 and LAN access enabled, the
+// defaults of the app.
+func NewTun2socksOptions() *Tun2socksOptionsBuilder {
+	return &Tun2socksOptionsBuilder{opts: Tun2socksStartOptions{EnableIPv6: true, AllowLan: true}}
+}
+
+func (b *Tun2socksOptionsBuilder) WithTunFd(fd int) *Tun2socksOptionsBuilder {
+	b.opts.TunFd = fd
+	return b
+}
+
+func (b *Tun2socksOptionsBuilder) WithSocks5Server(addr string) *Tun2socksOptionsBuilder {
+	b.opts.Socks5Server = addr
+	return b
+}
+
+func (b *Tun2socksOptionsBuilder) WithFakeIPRange(cidr string) *Tun2socksOptionsBuilder {
+	b.opts.FakeIPRange = cidr
+	return b
+}
+
+func (b *Tun2socksOptionsBuilder) WithMTU(mtu int) *Tun2socksOptionsBuilder {
+	b.opts.MTU = mtu
+	return b
+}
+
+func (b *Tun2socksOptionsBuilder) WithIPv6(enable bool) *Tun2socksOptionsBuilder {
+	b.opts.EnableIPv6 = enable
+	return b
+}
+
+func (b *Tun2socksOptionsBuilder) WithAllowLan(allow bool) *Tun2socksOptionsBuilder {
+	b.opts.AllowLan = allow
+	return b
+}
+
+func (b *Tun2socksOptionsBuilder) WithBypassCIDRs(cidrs ...string) *Tun2socksOptionsBuilder {
+	b.opts.BypassCIDRs = append([]string(nil), cidrs...)
+	return b
+}
+
+func (b *Tun2socksOptionsBuilder) WithRouteCIDRs(cidrs ...string) *Tun2socksOptionsBuilder {
+	b.opts.RouteCIDRs = append([]string(nil), cidrs...)
+	return b
+}
+
+func (b *Tun2socksOptionsBuilder) WithBypassDomains(domains ...string) *Tun2socksOptionsBuilder {
+	b.opts.BypassDomains = append([]string(nil), domains...)
+	return b
+}
+
+func (b *Tun2socksOptionsBuilder) WithRouteDomains(domains ...string) *Tun2socksOptionsBuilder {
+	b.opts.RouteDomains = append([]string(nil), domains...)
+	return b
+}
+
+func (b *Tun2socksOptionsBuilder) WithDNSServers(servers ...string) *Tun2socksOptionsBuilder {
+	b.opts.DNSServers = append([]string(nil), servers...)
+	return b
+}
+
+func (b *Tun2socksOptionsBuilder) WithDNSResolver(resolve DNSResolver) *Tun2socksOptionsBuilder {
+	b.opts.ResolveDNS = resolve
+	return b
+}
+
+func (b *Tun2socksOptionsBuilder) WithPCAPFile(path string) *Tun2socksOptionsBuilder {
+	b.opts.PCAPFile = path
+	return b
+}
+
+// Build returns a copy of the options, or all validation errors joined.
+func (b *Tun2socksOptionsBuilder) Build() (*Tun2socksStartOptions, error) {
+	opts := b.opts
+	if errs := ValidateTun2socksOptions(&opts); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &opts, nil
+}
@@ -0,0 +1,151 @@
+package lwip
+
+import (
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+)
+
+// paused makes the tun device answer every packet with an ICMP destination
+// unreachable instead of handing it to lwip.
+var paused atomic.Bool
+
+// SetPaused turns packet dropping on or off. The tun device and lwip stay up
+// either way, so the OS does not see the VPN go down.
+func SetPaused(p bool) {
+	paused.Store(p)
+}
+
+const (
+	protoICMP   = 1
+	protoICMPv6 = 58
+
+	icmpv4Unreachable = 3
+	icmpv4AdminProhib = 13
+	icmpv6Unreachable = 1
+	icmpv6AdminProhib = 1
+	icmpv6MinMTU      = 1280
+)
+
+// pauseReadWriteCloser swallows the packets read from the tun device while
+// paused and writes the ICMP errors back to it.
+type pauseReadWriteCloser struct {
+	io.ReadWriteCloser
+}
+
+func (c pauseReadWriteCloser) Read(b []byte) (int, error) {
+	for {
+		n, err := c.ReadWriteCloser.Read(b)
+		if err != nil || n == 0 || !paused.Load() {
+			return n, err
+		}
+		if reply := unreachableReply(b[:n]); reply != nil {
+			c.ReadWriteCloser.Write(reply)
+		}
+	}
+}
+
+// unreachableReply returns an "administratively prohibited" destination
+// unreachable for pkt, or nil for packets that must not get one, such as
+// other ICMP errors.
+func unreachableReply(pkt []byte) []byte {
+	if len(pkt) == 0 {
+		return nil
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		return unreachableV4(pkt)
+	case 6:
+		return unreachableV6(pkt)
+	}
+	return nil
+}
+
+func unreachableV4(pkt []byte) []byte {
+	ihl := int(pkt[0]&0x0f) * 4
+	if ihl < 20 || len(pkt) < ihl {
+		return nil
+	}
+	if pkt[9] == protoICMP && (len(pkt) <= ihl || !isICMPv4Query(pkt[ihl])) {
+		return nil
+	}
+	// The original header plus 64 bits of its payload (RFC 792).
+	quoted := pkt
+	if len(quoted) > ihl+8 {
+		quoted = quoted[:ihl+8]
+	}
+
+	reply := make([]byte, 20+8+len(quoted))
+	reply[0] = 0x45
+	binary.BigEndian.PutUint16(reply[2:], uint16(len(reply)))
+	reply[8] = 64 // TTL
+	reply[9] = protoICMP
+	copy(reply[12:16], pkt[16:20]) // back to the sender
+	copy(reply[16:20], pkt[12:16])
+	binary.BigEndian.PutUint16(reply[10:], checksum(reply[:20], 0))
+
+	icmp := reply[20:]
+	icmp[0] = icmpv4Unreachable
+	icmp[1] = icmpv4AdminProhib
+	copy(icmp[8:], quoted)
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, 0))
+	return reply
+}
+
+func isICMPv4Query(typ byte) bool {
+	return typ == 0 || typ == 8 || typ == 13 || typ == 14
+}
+
+func unreachableV6(pkt []byte) []byte {
+	if len(pkt) < 40 {
+		return nil
+	}
+	// ICMPv6 errors have types below 128; never answer one with another.
+	if pkt[6] == protoICMPv6 && (len(pkt) <= 40 || pkt[40] < 128) {
+		return nil
+	}
+	// As much of the packet as fits in the minimum MTU (RFC 4443).
+	quoted := pkt
+	if len(quoted) > icmpv6MinMTU-40-8 {
+		quoted = quoted[:icmpv6MinMTU-40-8]
+	}
+
+	reply := make([]byte, 40+8+len(quoted))
+	reply[0] = 0x60
+	binary.BigEndian.PutUint16(reply[4:], uint16(8+len(quoted)))
+	reply[6] = protoICMPv6
+	reply[7] = 64 // hop limit
+	copy(reply[8:24], pkt[24:40])
+	copy(reply[24:40], pkt[8:24])
+
+	icmp := reply[40:]
+	icmp[0] = icmpv6Unreachable
+	icmp[1] = icmpv6AdminProhib
+	copy(icmp[8:], quoted)
+	// Pseudo-header: addresses, upper-layer length and next header.
+	var sum uint32
+	sum = sumWords(reply[8:40], sum)
+	sum += uint32(len(icmp))
+	sum += protoICMPv6
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, sum))
+	return reply
+}
+
+func sumWords(b []byte, sum uint32) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// checksum is the Internet checksum of b, starting from sum.
+func checksum(b []byte, sum uint32) uint16 {
+	sum = sumWords(b, sum)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,142 @@
+package lwip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+const (
+	pcapMagic     = 0xa1b2c3d4
+	pcapSnapLen   = 65535
+	pcapLinkRaw   = 101 // LINKTYPE_RAW: packets start with the IP header
+	pcapQueueSize = 1024
+)
+
+type pcapPacket struct {
+	ts   time.Time
+	data []byte
+}
+
+// pcapWriter writes packets to a libpcap file from its own goroutine, so the
+// data path only pays for a copy. Packets are dropped while the queue is full.
+type pcapWriter struct {
+	f     *os.File
+	w     *bufio.Writer
+	queue chan pcapPacket
+	done  chan struct{}
+	once  sync.Once
+
+	mu      sync.Mutex // guards queue against close and dropped
+	dropped uint64
+}
+
+// openPCAP opens path for appending, writing the global header if the file
+// is new or empty.
+func openPCAP(path string) (*pcapWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	p := &pcapWriter{
+		f:     f,
+		w:     bufio.NewWriter(f),
+		queue: make(chan pcapPacket, pcapQueueSize),
+		done:  make(chan struct{}),
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() == 0 {
+		var hdr [24]byte
+		binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+		binary.LittleEndian.PutUint16(hdr[4:], 2) // version 2.4
+		binary.LittleEndian.PutUint16(hdr[6:], 4)
+		binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+		binary.LittleEndian.PutUint32(hdr[20:], pcapLinkRaw)
+		p.w.Write(hdr[:])
+	}
+	go p.loop(p.queue)
+	return p, nil
+}
+
+func (p *pcapWriter) loop(queue <-chan pcapPacket) {
+	defer close(p.done)
+	var hdr [16]byte
+	for pkt := range queue {
+		binary.LittleEndian.PutUint32(hdr[0:], uint32(pkt.ts.Unix()))
+		binary.LittleEndian.PutUint32(hdr[4:], uint32(pkt.ts.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(hdr[8:], uint32(len(pkt.data)))
+		binary.LittleEndian.PutUint32(hdr[12:], uint32(len(pkt.data)))
+		p.w.Write(hdr[:])
+		p.w.Write(pkt.data)
+	}
+}
+
+// packet queues a copy of b.
+func (p *pcapWriter) packet(b []byte) {
+	if len(b) > pcapSnapLen {
+		b = b[:pcapSnapLen]
+	}
+	pkt := pcapPacket{ts: time.Now(), data: append([]byte(nil), b...)}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.queue == nil {
+		return
+	}
+	select {
+	case p.queue <- pkt:
+	default:
+		p.dropped++
+	}
+}
+
+// close flushes the queued packets and closes the file.
+func (p *pcapWriter) close() {
+	p.once.Do(func() {
+		p.mu.Lock()
+		close(p.queue)
+		p.queue = nil
+		dropped := p.dropped
+		p.mu.Unlock()
+		<-p.done
+		if err := p.w.Flush(); err != nil {
+			log.Infof("flush pcap: %v", err)
+		}
+		p.f.Close()
+		if dropped > 0 {
+			log.Infof("pcap dropped %d packets", dropped)
+		}
+	})
+}
+
+// pcapReadWriteCloser copies every packet read from or written to the tun
+// device into a pcap file.
+type pcapReadWriteCloser struct {
+	io.ReadWriteCloser
+	pcap *pcapWriter
+}
+
+func (c pcapReadWriteCloser) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	if n > 0 {
+		c.pcap.packet(b[:n])
+	}
+	return n, err
+}
+
+func (c pcapReadWriteCloser) Write(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(b)
+	if n > 0 {
+		c.pcap.packet(b[:n])
+	}
+	return n, err
+}
+
+func (c pcapReadWriteCloser) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.pcap.close()
+	return err
+}
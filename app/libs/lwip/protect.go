@@ -0,0 +1,60 @@
+package lwip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// ErrSocketNotProtected is returned by dials whose socket the protector set
+// with SetSocketProtector refused.
+var ErrSocketNotProtected = errors.New("socket protector refused the socket")
+
+// socketProtector is the function set with SetSocketProtector, nil when none
+// is.
+var socketProtector atomic.Pointer[func(fd int) bool]
+
+// SetSocketProtector makes every socket dialed with ControlSocket, such as the
+// direct connections of bypassed flows, pass through protect before it
+// connects; nil removes it. On Android protect is VpnService.protect, which
+// keeps the socket from being routed back into the tun device.
+func SetSocketProtector(protect func(fd int) bool) {
+	if protect == nil {
+		socketProtector.Store(nil)
+		return
+	}
+	socketProtector.Store(&protect)
+}
+
+// SocketProtectorSet reports whether a protector is set with
+// SetSocketProtector.
+func SocketProtectorSet() bool {
+	return socketProtector.Load() != nil
+}
+
+// ControlSocket is a net.Dialer Control function for sockets to the outside.
+// It hands the socket to the protector, failing the dial with
+// ErrSocketNotProtected if it is refused, and binds it as set with
+// SetOutboundNetwork or SetOutboundInterface.
+func ControlSocket(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if p := socketProtector.Load(); p != nil && !(*p)(int(fd)) {
+			log.Warnf("socket protector refused %s socket to %s", network, address)
+			err = fmt.Errorf("%s %s: %w", network, address, ErrSocketNotProtected)
+			return
+		}
+		err = bindOutbound(int(fd))
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// directDialer dials the connections of flows that bypass the SOCKS5 server.
+var directDialer = &net.Dialer{Timeout: bypassDialTimeout, Control: ControlSocket}
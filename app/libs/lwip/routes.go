@@ -0,0 +1,221 @@
+package lwip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/eycorsican/go-tun2socks/common/dns"
+)
+
+// Route is a split-tunnel rule for a CIDR or a domain suffix: matching
+// destinations reach the SOCKS5 server, or are connected to directly when
+// Direct is set.
+type Route struct {
+	CIDR   string
+	Domain string
+	Direct bool
+}
+
+// Routes is the split-tunnel rule set of the running stack.
+type Routes struct {
+	CIDRs   []Route // longest prefix first
+	Domains []Route // longest suffix first
+	// Direct is set when destinations matching no CIDR go direct.
+	// DomainsDirect is set when hosts behind fake IPs that match no domain go
+	// direct; otherwise they fall through to the CIDR rules.
+	Direct        bool
+	DomainsDirect bool
+}
+
+type routeRule struct {
+	net    *net.IPNet
+	direct bool
+}
+
+type domainRule struct {
+	suffix string
+	direct bool
+}
+
+// routeTable decides per destination whether to bypass the SOCKS5 server.
+// For a fake IP the host it was handed out for is checked against the domain
+// rules first, the longest matching suffix winning; since the fake DNS maps
+// every fake IP back to its host, this is the decision its resolution would
+// have got, and a reload applies to names resolved before it. Everything else
+// goes by the rule with the longest matching prefix. A destination matching
+// no rule is tunneled unless tunneling is restricted to listed ranges or
+// domains.
+type routeTable struct {
+	rules            []routeRule  // longest prefix first
+	domains          []domainRule // longest suffix first
+	restricted       bool
+	domainRestricted bool
+
+	fakeNet *net.IPNet
+	fake    dns.FakeDns
+}
+
+// activeRoutes is the table of the running stack, nil when none is.
+var activeRoutes atomic.Pointer[routeTable]
+
+// normalizeDomain turns a suffix pattern such as "*.example.com" or
+// "Example.com." into "example.com".
+func normalizeDomain(pattern string) (string, error) {
+	d := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(pattern, "*."), "."))
+	if d == "" || strings.ContainsAny(d, " /:*") {
+		return "", fmt.Errorf("invalid domain %q", pattern)
+	}
+	for _, label := range strings.Split(d, ".") {
+		if label == "" || len(label) > 63 {
+			return "", fmt.Errorf("invalid domain %q", pattern)
+		}
+	}
+	return d, nil
+}
+
+// newRouteTable builds the table for the bypass and route lists. When they
+// restrict tunneling, the fake DNS range stays tunneled since its addresses
+// mean nothing outside the stack. Domain rules need fake DNS: without it the
+// stack never learns the host behind an address.
+func newRouteTable(bypass, route, bypassDomains, routeDomains []string, fakeNet *net.IPNet, fake dns.FakeDns) (*routeTable, error) {
+	t := &routeTable{
+		restricted:       len(route) > 0,
+		domainRestricted: len(routeDomains) > 0,
+		fakeNet:          fakeNet,
+		fake:             fake,
+	}
+	seen := make(map[string]bool)
+	add := func(cidr string, direct bool) error {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		key := ipnet.String()
+		if d, ok := seen[key]; ok {
+			if d != direct {
+				return fmt.Errorf("cidr %s is both bypassed and routed", key)
+			}
+			return nil
+		}
+		seen[key] = direct
+		t.rules = append(t.rules, routeRule{net: ipnet, direct: direct})
+		return nil
+	}
+	for _, cidr := range bypass {
+		if err := add(cidr, true); err != nil {
+			return nil, fmt.Errorf("invalid bypass cidr: %w", err)
+		}
+	}
+	for _, cidr := range route {
+		if err := add(cidr, false); err != nil {
+			return nil, fmt.Errorf("invalid route cidr: %w", err)
+		}
+	}
+	if t.restricted && fakeNet != nil && !seen[fakeNet.String()] {
+		t.rules = append(t.rules, routeRule{net: fakeNet})
+	}
+	sort.SliceStable(t.rules, func(i, j int) bool {
+		a, _ := t.rules[i].net.Mask.Size()
+		b, _ := t.rules[j].net.Mask.Size()
+		return a > b
+	})
+
+	if (len(bypassDomains) > 0 || len(routeDomains) > 0) && fake == nil {
+		return nil, errors.New("domain rules need a fake ip range")
+	}
+	seenDomains := make(map[string]bool)
+	addDomain := func(pattern string, direct bool) error {
+		d, err := normalizeDomain(pattern)
+		if err != nil {
+			return err
+		}
+		if prev, ok := seenDomains[d]; ok {
+			if prev != direct {
+				return fmt.Errorf("domain %s is both bypassed and routed", d)
+			}
+			return nil
+		}
+		seenDomains[d] = direct
+		t.domains = append(t.domains, domainRule{suffix: d, direct: direct})
+		return nil
+	}
+	for _, d := range bypassDomains {
+		if err := addDomain(d, true); err != nil {
+			return nil, fmt.Errorf("invalid bypass domain: %w", err)
+		}
+	}
+	for _, d := range routeDomains {
+		if err := addDomain(d, false); err != nil {
+			return nil, fmt.Errorf("invalid route domain: %w", err)
+		}
+	}
+	sort.SliceStable(t.domains, func(i, j int) bool {
+		return len(t.domains[i].suffix) > len(t.domains[j].suffix)
+	})
+	return t, nil
+}
+
+// route reports whether ip should bypass the SOCKS5 server and, for a fake
+// IP, the host to connect to instead. A nil table tunnels everything.
+func (t *routeTable) route(ip net.IP) (direct bool, host string) {
+	if t == nil {
+		return false, ""
+	}
+	if t.fake != nil && t.fake.IsFakeIP(ip) {
+		host = strings.TrimSuffix(t.fake.QueryDomain(ip), ".")
+		if host != "" && len(t.domains) > 0 {
+			h := strings.ToLower(host)
+			for _, d := range t.domains {
+				if h == d.suffix || strings.HasSuffix(h, "."+d.suffix) {
+					return d.direct, host
+				}
+			}
+			if t.domainRestricted {
+				return true, host
+			}
+		}
+	}
+	for _, r := range t.rules {
+		if r.net.Contains(ip) {
+			return r.direct, host
+		}
+	}
+	return t.restricted, host
+}
+
+// UpdateRoutes replaces the split-tunnel rules of the running stack. Open
+// flows keep the route they were given. On error the current rules stay.
+func UpdateRoutes(bypass, route, bypassDomains, routeDomains []string) error {
+	cur := activeRoutes.Load()
+	if cur == nil {
+		return errors.New("tun2socks is not running")
+	}
+	t, err := newRouteTable(bypass, route, bypassDomains, routeDomains, cur.fakeNet, cur.fake)
+	if err != nil {
+		return err
+	}
+	if !activeRoutes.CompareAndSwap(cur, t) {
+		return errors.New("tun2socks restarted while updating routes")
+	}
+	return nil
+}
+
+// RoutingRules returns the rules of the running stack.
+func RoutingRules() Routes {
+	t := activeRoutes.Load()
+	if t == nil {
+		return Routes{}
+	}
+	r := Routes{Direct: t.restricted, DomainsDirect: t.domainRestricted}
+	for _, rule := range t.rules {
+		r.CIDRs = append(r.CIDRs, Route{CIDR: rule.net.String(), Direct: rule.direct})
+	}
+	for _, rule := range t.domains {
+		r.Domains = append(r.Domains, Route{Domain: rule.suffix, Direct: rule.direct})
+	}
+	return r
+}
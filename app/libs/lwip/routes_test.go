@@ -0,0 +1,192 @@
+package lwip
+
+import (
+	"net"
+	"testing"
+)
+
+// testFakeDNS maps fake IPs to the hosts they were handed out for, the way
+// the stack's fake DNS would after resolving them.
+type testFakeDNS struct {
+	fakeNet *net.IPNet
+	hosts   map[string]string
+}
+
+func (f testFakeDNS) GenerateFakeResponse([]byte) ([]byte, error) { return nil, nil }
+func (f testFakeDNS) QueryDomain(ip net.IP) string                { return f.hosts[ip.String()] }
+func (f testFakeDNS) IsFakeIP(ip net.IP) bool                     { return f.fakeNet.Contains(ip) }
+
+func newTestFakeDNS(t *testing.T) testFakeDNS {
+	_, fakeNet, err := net.ParseCIDR("198.18.0.0/15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testFakeDNS{fakeNet: fakeNet, hosts: map[string]string{
+		"198.18.0.1": "www.example.ir.",
+		"198.18.0.2": "cdn.example.com.",
+		"198.18.0.3": "other.net.",
+		"198.18.0.4": "Static.CDN.Example.com.",
+		"198.19.0.1": "example.com.",
+	}}
+}
+
+func TestRoutePrecedence(t *testing.T) {
+	fake := newTestFakeDNS(t)
+	tests := []struct {
+		name                        string
+		bypass, route               []string
+		bypassDomains, routeDomains []string
+		ip                          string
+		wantDirect                  bool
+		wantHost                    string
+	}{
+		{
+			name:          "domain bypass beats cidr route",
+			route:         []string{"198.18.0.0/15"},
+			bypassDomains: []string{"*.ir"},
+			ip:            "198.18.0.1", wantDirect: true, wantHost: "www.example.ir",
+		},
+		{
+			name:          "domain bypass beats longer cidr route",
+			route:         []string{"198.18.0.1/32"},
+			bypassDomains: []string{"ir"},
+			ip:            "198.18.0.1", wantDirect: true, wantHost: "www.example.ir",
+		},
+		{
+			name:         "domain route beats cidr bypass",
+			bypass:       []string{"198.18.0.0/16"},
+			routeDomains: []string{"example.com"},
+			ip:           "198.18.0.2", wantDirect: false, wantHost: "cdn.example.com",
+		},
+		{
+			name:          "unmatched host falls through to cidr route",
+			route:         []string{"198.18.0.0/16"},
+			bypassDomains: []string{"*.ir"},
+			ip:            "198.18.0.3", wantDirect: false, wantHost: "other.net",
+		},
+		{
+			name:          "unmatched host falls through to cidr bypass",
+			bypass:        []string{"198.18.0.0/16"},
+			bypassDomains: []string{"*.ir"},
+			ip:            "198.18.0.3", wantDirect: true, wantHost: "other.net",
+		},
+		{
+			name:         "route domains send unmatched hosts direct despite cidr route",
+			route:        []string{"198.18.0.0/15"},
+			routeDomains: []string{"example.com"},
+			ip:           "198.18.0.3", wantDirect: true, wantHost: "other.net",
+		},
+		{
+			name:          "longest suffix wins over shorter bypass",
+			bypassDomains: []string{"example.com"},
+			routeDomains:  []string{"cdn.example.com"},
+			ip:            "198.18.0.4", wantDirect: false, wantHost: "Static.CDN.Example.com",
+		},
+		{
+			name:          "longest suffix wins over shorter route",
+			bypassDomains: []string{"cdn.example.com"},
+			routeDomains:  []string{"example.com"},
+			route:         []string{"198.18.0.0/15"},
+			ip:            "198.18.0.2", wantDirect: true, wantHost: "cdn.example.com",
+		},
+		{
+			name:          "suffix matches the name itself",
+			bypassDomains: []string{"example.com"},
+			bypass:        []string{"198.19.0.0/16"},
+			ip:            "198.19.0.1", wantDirect: true, wantHost: "example.com",
+		},
+		{
+			name:          "suffix does not match inside a label",
+			bypassDomains: []string{"her.net"},
+			ip:            "198.18.0.3", wantDirect: false, wantHost: "other.net",
+		},
+		{
+			name:          "real address ignores domain rules",
+			route:         []string{"203.0.113.0/24"},
+			bypassDomains: []string{"*.ir"},
+			ip:            "203.0.113.5", wantDirect: false,
+		},
+		{
+			name:         "real address outside restricted cidrs goes direct",
+			route:        []string{"203.0.113.0/24"},
+			routeDomains: []string{"example.com"},
+			ip:           "192.0.2.1", wantDirect: true,
+		},
+		{
+			name:  "fake range stays tunneled when cidrs are restricted",
+			route: []string{"203.0.113.0/24"},
+			ip:    "198.18.0.3", wantDirect: false, wantHost: "other.net",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, err := newRouteTable(tt.bypass, tt.route, tt.bypassDomains, tt.routeDomains, fake.fakeNet, fake)
+			if err != nil {
+				t.Fatal(err)
+			}
+			direct, host := rt.route(net.ParseIP(tt.ip))
+			if direct != tt.wantDirect || host != tt.wantHost {
+				t.Errorf("route(%s) = %v, %q, want %v, %q", tt.ip, direct, host, tt.wantDirect, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestRouteTableErrors(t *testing.T) {
+	fake := newTestFakeDNS(t)
+	tests := []struct {
+		name                        string
+		bypass, route               []string
+		bypassDomains, routeDomains []string
+		noFake                      bool
+	}{
+		{name: "bad cidr", bypass: []string{"198.18.0.0"}},
+		{name: "cidr both ways", bypass: []string{"10.0.0.1/8"}, route: []string{"10.0.0.0/8"}},
+		{name: "domain both ways", bypassDomains: []string{"*.example.com"}, routeDomains: []string{"Example.com."}},
+		{name: "bad domain", bypassDomains: []string{"exa mple.com"}},
+		{name: "empty label", routeDomains: []string{"example..com"}},
+		{name: "domains without fake dns", bypassDomains: []string{"example.com"}, noFake: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.noFake {
+				_, err = newRouteTable(tt.bypass, tt.route, tt.bypassDomains, tt.routeDomains, nil, nil)
+			} else {
+				_, err = newRouteTable(tt.bypass, tt.route, tt.bypassDomains, tt.routeDomains, fake.fakeNet, fake)
+			}
+			if err == nil {
+				t.Error("newRouteTable succeeded")
+			}
+		})
+	}
+}
+
+func TestUpdateRoutesReload(t *testing.T) {
+	fake := newTestFakeDNS(t)
+	rt, err := newRouteTable(nil, []string{"198.18.0.0/15"}, nil, nil, fake.fakeNet, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeRoutes.Store(rt)
+	defer activeRoutes.Store(nil)
+
+	ip := net.ParseIP("198.18.0.1")
+	if direct, _ := activeRoutes.Load().route(ip); direct {
+		t.Fatal("tunneled host goes direct before the reload")
+	}
+	// The host was resolved before the reload; the new rules still apply.
+	if err := UpdateRoutes(nil, []string{"198.18.0.0/15"}, []string{"*.ir"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if direct, _ := activeRoutes.Load().route(ip); !direct {
+		t.Error("bypassed domain is tunneled after the reload")
+	}
+	if err := UpdateRoutes(nil, nil, []string{"ir"}, []string{"ir"}); err == nil {
+		t.Error("conflicting reload succeeded")
+	}
+	got := RoutingRules()
+	if len(got.Domains) != 1 || got.Domains[0] != (Route{Domain: "ir", Direct: true}) {
+		t.Errorf("rules after a failed reload: %+v", got)
+	}
+}
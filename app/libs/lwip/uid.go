@@ -0,0 +1,223 @@
+package lwip
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// uidTableMaxAge is how long a parsed /proc/net table answers lookups;
+	// a miss rereads it once it is older than uidTableMinAge, so a burst of
+	// flows from unknown sockets parses each table at most that often.
+	uidTableMaxAge = time.Second
+	uidTableMinAge = 50 * time.Millisecond
+)
+
+// excludedUIDs are the apps whose flows bypass warp, nil when none are.
+var excludedUIDs atomic.Pointer[map[int]bool]
+
+// SetExcludedUIDs makes new flows from sockets owned by uids connect
+// directly instead of through the SOCKS5 server; an empty list tunnels every
+// app again. Owners are looked up only while the list is not empty, and
+// flows whose owner cannot be found are tunneled.
+func SetExcludedUIDs(uids []int) {
+	if len(uids) == 0 {
+		excludedUIDs.Store(nil)
+		return
+	}
+	m := make(map[int]bool, len(uids))
+	for _, uid := range uids {
+		m[uid] = true
+	}
+	excludedUIDs.Store(&m)
+}
+
+// excludedFlow reports whether the flow from src to dst belongs to an
+// excluded app.
+func excludedFlow(proto string, src, dst net.Addr) bool {
+	m := excludedUIDs.Load()
+	if m == nil || src == nil {
+		return false
+	}
+	uid, ok := socketOwner(proto, src, dst)
+	return ok && (*m)[uid]
+}
+
+// flowSource returns the app side of a tun TCP connection, whichever of its
+// addresses is not the target.
+func flowSource(conn net.Conn, target *net.TCPAddr) net.Addr {
+	if a, ok := conn.LocalAddr().(*net.TCPAddr); ok && a.IP.Equal(target.IP) && a.Port == target.Port {
+		return conn.RemoteAddr()
+	}
+	return conn.LocalAddr()
+}
+
+type uidTable struct {
+	read    time.Time
+	sockets map[string]int // "local>remote" -> uid
+}
+
+// uidTableCache holds the latest parse of one protocol's tables. Lookups
+// load it without locking; mu only serializes rereads, so misses that arrive
+// while one is under way wait for it instead of parsing again.
+type uidTableCache struct {
+	mu    sync.Mutex
+	table atomic.Pointer[uidTable]
+}
+
+// procNet is where the socket tables are read from; tests point it elsewhere.
+var procNet = "/proc/net"
+
+var uidTables = map[string]*uidTableCache{"tcp": {}, "udp": {}}
+
+// get returns the table, rereading it if it is older than maxAge.
+func (c *uidTableCache) get(proto string, maxAge time.Duration) *uidTable {
+	if t := c.table.Load(); t != nil && time.Since(t.read) <= maxAge {
+		return t
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Another lookup may have reread it meanwhile.
+	if t := c.table.Load(); t != nil && time.Since(t.read) <= maxAge {
+		return t
+	}
+	t := readUIDTable(proto)
+	c.table.Store(t)
+	return t
+}
+
+// connectionOwner is the function set with SetConnectionOwnerLookup, nil when
+// none is.
+var connectionOwner atomic.Pointer[func(proto string, src, dst net.Addr) (int, bool)]
+
+// SetConnectionOwnerLookup makes the owners of flows be looked up with owner
+// before /proc/net, which apps cannot read on Android 10 and later; nil
+// removes it. On Android owner is ConnectivityManager.getConnectionOwnerUid.
+func SetConnectionOwnerLookup(owner func(proto string, src, dst net.Addr) (int, bool)) {
+	if owner == nil {
+		connectionOwner.Store(nil)
+		return
+	}
+	connectionOwner.Store(&owner)
+}
+
+// socketOwner returns the uid owning the socket of the flow from src to dst,
+// as the lookup set with SetConnectionOwnerLookup tells or as listed in
+// /proc/net/<proto> and /proc/net/<proto>6.
+func socketOwner(proto string, src, dst net.Addr) (int, bool) {
+	if owner := connectionOwner.Load(); owner != nil {
+		if uid, ok := (*owner)(proto, src, dst); ok {
+			return uid, true
+		}
+	}
+	srcIP, srcPort := splitAddr(src)
+	dstIP, dstPort := splitAddr(dst)
+	cache := uidTables[proto]
+	if srcIP == nil || cache == nil {
+		return 0, false
+	}
+	keys := []string{socketKey(srcIP, srcPort, dstIP, dstPort)}
+	if proto == "udp" {
+		// Unconnected UDP sockets list no remote, and often no local address.
+		keys = append(keys,
+			socketKey(srcIP, srcPort, nil, 0),
+			socketKey(nil, srcPort, nil, 0))
+	}
+	lookup := func(t *uidTable) (int, bool) {
+		for _, k := range keys {
+			if uid, ok := t.sockets[k]; ok {
+				return uid, true
+			}
+		}
+		return 0, false
+	}
+	if uid, ok := lookup(cache.get(proto, uidTableMaxAge)); ok {
+		return uid, true
+	}
+	// The socket may be newer than the table. However many flows miss, the
+	// table is reread at most once per uidTableMinAge.
+	return lookup(cache.get(proto, uidTableMinAge))
+}
+
+func splitAddr(a net.Addr) (net.IP, int) {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// socketKey keys a socket by its addresses; a nil or unspecified IP stands
+// for any address.
+func socketKey(localIP net.IP, localPort int, remoteIP net.IP, remotePort int) string {
+	ipString := func(ip net.IP) string {
+		if ip == nil || ip.IsUnspecified() {
+			return "*"
+		}
+		if v4 := ip.To4(); v4 != nil {
+			return v4.String()
+		}
+		return ip.String()
+	}
+	return ipString(localIP) + ":" + strconv.Itoa(localPort) + ">" + ipString(remoteIP) + ":" + strconv.Itoa(remotePort)
+}
+
+func readUIDTable(proto string) *uidTable {
+	t := &uidTable{read: time.Now(), sockets: make(map[string]int)}
+	for _, name := range []string{proto, proto + "6"} {
+		f, err := os.Open(filepath.Join(procNet, name))
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		sc.Scan() // header
+		for sc.Scan() {
+			// sl local_address rem_address st tx:rx tr:when retrnsmt uid ...
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 8 {
+				continue
+			}
+			lip, lport, ok1 := parseProcAddr(fields[1])
+			rip, rport, ok2 := parseProcAddr(fields[2])
+			uid, err := strconv.Atoi(fields[7])
+			if !ok1 || !ok2 || err != nil {
+				continue
+			}
+			t.sockets[socketKey(lip, lport, rip, rport)] = uid
+		}
+		f.Close()
+	}
+	return t
+}
+
+// parseProcAddr parses a /proc/net address such as "0100007F:0035". The
+// kernel prints each 32-bit word of the address in host byte order, which is
+// little-endian on every platform the app ships for.
+func parseProcAddr(s string) (net.IP, int, bool) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, 0, false
+	}
+	b, err := hex.DecodeString(s[:i])
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, 0, false
+	}
+	for w := 0; w < len(b); w += 4 {
+		b[w], b[w+1], b[w+2], b[w+3] = b[w+3], b[w+2], b[w+1], b[w]
+	}
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+	return net.IP(b), int(port), true
+}
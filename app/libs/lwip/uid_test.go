@@ -0,0 +1,167 @@
+package lwip
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseProcAddr(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantIP   string
+		wantPort int
+		ok       bool
+	}{
+		{"0100007F:0035", "127.0.0.1", 53, true},
+		{"00000000:07E8", "0.0.0.0", 2024, true},
+		{"0102A8C0:C350", "192.168.2.1", 50000, true},
+		{"00000000000000000000000001000000:01BB", "::1", 443, true},
+		{"004706260000D0000000000001C09FA2:0968", "2606:4700:d0::a29f:c001", 2408, true},
+		{"0000000000000000FFFF00000100007F:0050", "::ffff:127.0.0.1", 80, true},
+		{"0100007F", "", 0, false},
+		{"0100007:0035", "", 0, false},
+		{"0100007G:0035", "", 0, false},
+		{"01000000007F:0035", "", 0, false},
+		{"0100007F:10000", "", 0, false},
+		{"0100007F:", "", 0, false},
+	}
+	for _, tt := range tests {
+		ip, port, ok := parseProcAddr(tt.in)
+		if ok != tt.ok {
+			t.Errorf("parseProcAddr(%q) ok = %v, want %v", tt.in, ok, tt.ok)
+			continue
+		}
+		if ok && (!ip.Equal(net.ParseIP(tt.wantIP)) || port != tt.wantPort) {
+			t.Errorf("parseProcAddr(%q) = %s, %d, want %s, %d", tt.in, ip, port, tt.wantIP, tt.wantPort)
+		}
+	}
+}
+
+func TestSocketKey(t *testing.T) {
+	tests := []struct {
+		localIP    net.IP
+		localPort  int
+		remoteIP   net.IP
+		remotePort int
+		want       string
+	}{
+		{net.ParseIP("10.0.0.2"), 40000, net.ParseIP("1.1.1.1"), 443, "10.0.0.2:40000>1.1.1.1:443"},
+		// IPv4 keys match whether the address came as 4 or 16 bytes.
+		{net.ParseIP("10.0.0.2").To4(), 40000, net.ParseIP("::ffff:1.1.1.1"), 443, "10.0.0.2:40000>1.1.1.1:443"},
+		{net.ParseIP("fd00::2"), 5353, net.ParseIP("2606:4700::1111"), 53, "fd00::2:5353>2606:4700::1111:53"},
+		{net.ParseIP("10.0.0.2"), 5353, nil, 0, "10.0.0.2:5353>*:0"},
+		{net.IPv4zero, 5353, net.IPv6unspecified, 0, "*:5353>*:0"},
+		{nil, 5353, nil, 0, "*:5353>*:0"},
+	}
+	for _, tt := range tests {
+		if got := socketKey(tt.localIP, tt.localPort, tt.remoteIP, tt.remotePort); got != tt.want {
+			t.Errorf("socketKey(%s, %d, %s, %d) = %q, want %q", tt.localIP, tt.localPort, tt.remoteIP, tt.remotePort, got, tt.want)
+		}
+	}
+}
+
+// testProcNet points procNet at a fresh directory holding tcp as
+// /proc/net/tcp and clears the cached tables.
+func testProcNet(t *testing.T, tcp string) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeProcTable(t, dir, tcp)
+	orig := procNet
+	procNet = dir
+	resetUIDTables := func() {
+		for _, c := range uidTables {
+			c.table.Store(nil)
+		}
+	}
+	resetUIDTables()
+	t.Cleanup(func() {
+		procNet = orig
+		resetUIDTables()
+	})
+	return dir
+}
+
+func writeProcTable(t *testing.T, dir, tcp string) {
+	t.Helper()
+	header := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	if err := os.WriteFile(filepath.Join(dir, "tcp"), []byte(header+tcp), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const (
+	procLine1 = "   0: 0200000A:9C40 01010101:01BB 01 00000000:00000000 00:00000000 00000000 10123        0 1111 1\n"
+	procLine2 = "   1: 0200000A:9C41 01010101:01BB 01 00000000:00000000 00:00000000 00000000 10456        0 1112 1\n"
+)
+
+func TestSocketOwnerProcNet(t *testing.T) {
+	dir := testProcNet(t, procLine1)
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("1.1.1.1"), Port: 443}
+	if uid, ok := socketOwner("tcp", src, dst); !ok || uid != 10123 {
+		t.Fatalf("socketOwner = %d, %v, want 10123", uid, ok)
+	}
+
+	// A socket opened after the table was read is found once the table is
+	// older than uidTableMinAge, but a miss on a fresh table does not
+	// reread it.
+	writeProcTable(t, dir, procLine1+procLine2)
+	src2 := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40001}
+	cache := uidTables["tcp"]
+	fresh := cache.table.Load()
+	fresh.read = time.Now()
+	if _, ok := socketOwner("tcp", src2, dst); ok {
+		t.Error("a miss on a fresh table reread it")
+	}
+	if cache.table.Load() != fresh {
+		t.Error("a miss on a fresh table replaced it")
+	}
+	fresh.read = time.Now().Add(-2 * uidTableMinAge)
+	if uid, ok := socketOwner("tcp", src2, dst); !ok || uid != 10456 {
+		t.Errorf("socketOwner of a new socket = %d, %v, want 10456", uid, ok)
+	}
+
+	if _, ok := socketOwner("tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 40000}, dst); ok {
+		t.Error("socketOwner found an unknown socket")
+	}
+	if _, ok := socketOwner("icmp", src, dst); ok {
+		t.Error("socketOwner answered for an unsupported protocol")
+	}
+}
+
+func TestSocketOwnerLookup(t *testing.T) {
+	testProcNet(t, procLine1)
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("1.1.1.1"), Port: 443}
+	var asked []string
+	SetConnectionOwnerLookup(func(proto string, s, d net.Addr) (int, bool) {
+		asked = append(asked, proto+" "+s.String()+">"+d.String())
+		if s.String() == "10.0.0.2:40000" {
+			return 10999, true
+		}
+		return 0, false
+	})
+	defer SetConnectionOwnerLookup(nil)
+
+	// The lookup takes precedence over /proc/net.
+	if uid, ok := socketOwner("tcp", src, dst); !ok || uid != 10999 {
+		t.Errorf("socketOwner = %d, %v, want the lookup's 10999", uid, ok)
+	}
+	if len(asked) != 1 || asked[0] != "tcp 10.0.0.2:40000>1.1.1.1:443" {
+		t.Errorf("lookup asked for %q", asked)
+	}
+	// What it does not know is looked up in /proc/net.
+	SetConnectionOwnerLookup(func(string, net.Addr, net.Addr) (int, bool) { return 0, false })
+	if uid, ok := socketOwner("tcp", src, dst); !ok || uid != 10123 {
+		t.Errorf("socketOwner with an unknowing lookup = %d, %v, want 10123 from /proc/net", uid, ok)
+	}
+
+	SetExcludedUIDs([]int{10123})
+	defer SetExcludedUIDs(nil)
+	if !excludedFlow("tcp", src, dst) {
+		t.Error("flow of an excluded uid is tunneled")
+	}
+}
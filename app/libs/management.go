@@ -0,0 +1,185 @@
+package tun2socks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const managementTimeout = 10 * time.Second
+
+// managementServer is the REST/JSON API on Config.ManagementAddr. It lives as
+// long as the run that started it:
+//
+//	POST /start   apply {"args": "..."} to warp, see Reconfigure
+//	POST /stop    stop the client
+//	GET  /status  state, last error, session, retry attempt, endpoint and region
+//	GET  /logs    buffered lines, ?since=<unix-ms> for newer ones only
+//	GET  /stats   log and traffic counters
+type managementServer struct {
+	c  *Client
+	ln net.Listener
+}
+
+func listenManagement(c *Client, addr string) (*managementServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &managementServer{c: c, ln: ln}, nil
+}
+
+// serve handles requests until ctx is done.
+func (m *managementServer) serve(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", m.handleStart)
+	mux.HandleFunc("/stop", m.handleStop)
+	mux.HandleFunc("/status", m.handleStatus)
+	mux.HandleFunc("/logs", m.handleLogs)
+	mux.HandleFunc("/stats", m.handleStats)
+	srv := &http.Server{
+		Handler:      http.TimeoutHandler(mux, managementTimeout, `{"error":"timeout"}`),
+		ReadTimeout:  managementTimeout,
+		WriteTimeout: managementTimeout + time.Second,
+		BaseContext:  func(net.Listener) context.Context { return ctx },
+		ErrorLog:     log.New(log.Writer(), "[management] ", 0),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), managementTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.Serve(m.ln); err != nil && err != http.ErrServerClosed {
+		log.Println("[management] serve failed:", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func allow(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return false
+	}
+	return true
+}
+
+func (m *managementServer) handleStart(w http.ResponseWriter, req *http.Request) {
+	if !allow(w, req, http.MethodPost) {
+		return
+	}
+	var body struct {
+		Args string `json:"args"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	cfg, err := ParseArgString(body.Args)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// Keep serving on the same address unless the args move it.
+	m.c.mu.Lock()
+	if cfg.ManagementAddr == "" {
+		cfg.ManagementAddr = m.c.cfg.ManagementAddr
+	}
+	m.c.mu.Unlock()
+	if err := m.c.Reconfigure(cfg); err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, ErrRestartRequired) {
+			code = http.StatusConflict
+		}
+		writeError(w, code, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"state": m.c.State().String()})
+}
+
+func (m *managementServer) handleStop(w http.ResponseWriter, req *http.Request) {
+	if !allow(w, req, http.MethodPost) {
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"state": StateDisconnecting.String()})
+	// Stop waits for this server to shut down, so it cannot run in the handler.
+	go m.c.Stop()
+}
+
+func (m *managementServer) handleStatus(w http.ResponseWriter, req *http.Request) {
+	if !allow(w, req, http.MethodGet) {
+		return
+	}
+	status := struct {
+		State          string `json:"state"`
+		LastError      string `json:"lastError,omitempty"`
+		Session        string `json:"session"`
+		RetryAttempt   int    `json:"retryAttempt"`
+		ActiveEndpoint string `json:"activeEndpoint,omitempty"`
+		PsiphonRegion  string `json:"psiphonRegion,omitempty"`
+	}{
+		State:          m.c.State().String(),
+		Session:        m.c.SessionID(),
+		RetryAttempt:   m.c.RetryAttempt(),
+		ActiveEndpoint: m.c.ActiveEndpoint(),
+		PsiphonRegion:  m.c.PsiphonRegion(),
+	}
+	if err := m.c.LastError(); err != nil {
+		status.LastError = err.Error()
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleLogs returns the buffered lines as JSON objects without draining them,
+// so it can be polled next to GetLogMessages. Lines already drained by
+// GetLogMessages are not returned.
+func (m *managementServer) handleLogs(w http.ResponseWriter, req *http.Request) {
+	if !allow(w, req, http.MethodGet) {
+		return
+	}
+	var since time.Time
+	if v := req.URL.Query().Get("since"); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("since must be a unix timestamp in milliseconds"))
+			return
+		}
+		since = time.UnixMilli(ms)
+	}
+	evs := m.c.logs.since(since)
+	lines := make([]json.RawMessage, 0, len(evs))
+	for _, ev := range evs {
+		lines = append(lines, json.RawMessage(ev.JSON()))
+	}
+	writeJSON(w, http.StatusOK, lines)
+}
+
+func (m *managementServer) handleStats(w http.ResponseWriter, req *http.Request) {
+	if !allow(w, req, http.MethodGet) {
+		return
+	}
+	s := m.c.Stats()
+	writeJSON(w, http.StatusOK, struct {
+		TrafficStats
+		DroppedLogs       uint64 `json:"droppedLogs"`
+		DroppedLogCount   uint64 `json:"droppedLogCount"`
+		HTTPProxyRequests uint64 `json:"httpProxyRequests"`
+		HTTPProxyRx       uint64 `json:"httpProxyRx"`
+		HTTPProxyTx       uint64 `json:"httpProxyTx"`
+	}{m.c.TrafficStats(), s.DroppedLogs, s.DroppedLogCount, s.HTTPProxyRequests, s.HTTPProxyRx, s.HTTPProxyTx})
+}
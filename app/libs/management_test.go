@@ -0,0 +1,90 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestManagementLogsSince(t *testing.T) {
+	c := NewClient(NewConfig())
+	base := time.UnixMilli(1700000000000)
+	c.logs.mu.Lock()
+	for i, msg := range []string{"first", "second", "third"} {
+		c.logs.messages.push(LogEvent{Time: base.Add(time.Duration(i) * time.Second), Level: "info", Source: sourceApp, Message: msg})
+	}
+	c.logs.mu.Unlock()
+	m := &managementServer{c: c}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"first", "second", "third"}},
+		{"?since=0", []string{"first", "second", "third"}},
+		{"?since=" + strconv.FormatInt(base.UnixMilli()-1, 10), []string{"first", "second", "third"}},
+		// since is exclusive: the line logged at exactly that time is old.
+		{"?since=" + strconv.FormatInt(base.UnixMilli(), 10), []string{"second", "third"}},
+		{"?since=" + strconv.FormatInt(base.Add(1500*time.Millisecond).UnixMilli(), 10), []string{"third"}},
+		{"?since=" + strconv.FormatInt(base.Add(time.Hour).UnixMilli(), 10), []string{}},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		m.handleLogs(w, httptest.NewRequest(http.MethodGet, "/logs"+tt.query, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("GET /logs%s: %d %s", tt.query, w.Code, w.Body)
+			continue
+		}
+		var lines []struct {
+			Msg string `json:"msg"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &lines); err != nil {
+			t.Errorf("GET /logs%s: %v in %s", tt.query, err, w.Body)
+			continue
+		}
+		got := make([]string, len(lines))
+		for i, l := range lines {
+			got[i] = l.Msg
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("GET /logs%s = %v, want %v", tt.query, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("GET /logs%s = %v, want %v", tt.query, got, tt.want)
+				break
+			}
+		}
+	}
+	// Polling does not drain.
+	if n := c.logs.count(); n != 3 {
+		t.Errorf("%d lines buffered after polling, want 3", n)
+	}
+}
+
+func TestManagementLogsBadSince(t *testing.T) {
+	m := &managementServer{c: NewClient(NewConfig())}
+	for _, q := range []string{"abc", "1.5", "2024-01-01T00:00:00Z", "-"} {
+		w := httptest.NewRecorder()
+		m.handleLogs(w, httptest.NewRequest(http.MethodGet, "/logs?since="+q, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET /logs?since=%s: status %d, want 400", q, w.Code)
+		}
+		var body struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error == "" {
+			t.Errorf("GET /logs?since=%s: body %s, want a JSON error", q, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	m.handleLogs(w, httptest.NewRequest(http.MethodPost, "/logs", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /logs: status %d, want 405", w.Code)
+	}
+}
@@ -0,0 +1,94 @@
+package tun2socks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// metricsServer serves GET /metrics on Config.MetricsAddr in the Prometheus
+// text exposition format, for as long as the run that started it. Every
+// sample carries the session_id label.
+type metricsServer struct {
+	c  *Client
+	ln net.Listener
+}
+
+func listenMetrics(c *Client, addr string) (*metricsServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsServer{c: c, ln: ln}, nil
+}
+
+// serve handles requests until ctx is done.
+func (m *metricsServer) serve(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.handleMetrics)
+	srv := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  managementTimeout,
+		WriteTimeout: managementTimeout,
+		BaseContext:  func(net.Listener) context.Context { return ctx },
+		ErrorLog:     log.New(log.Writer(), "[metrics] ", 0),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), managementTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.Serve(m.ln); err != nil && err != http.ErrServerClosed {
+		log.Println("[metrics] serve failed:", err)
+	}
+}
+
+// metricState is the value of oblivion_state for s.
+func metricState(s State) int {
+	switch s {
+	case StateConnected:
+		return 1
+	case StateReconnecting:
+		return 2
+	case StateConnecting:
+		return 3
+	case StatePaused:
+		return 4
+	case StateError:
+		return 5
+	default:
+		return 0
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metricsServer) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	labels := `{session_id="` + labelEscaper.Replace(m.c.SessionID()) + `"}`
+	var b bytes.Buffer
+	metric := func(name, typ, help string, v int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s%s %d\n", name, help, name, typ, name, labels, v)
+	}
+	t := m.c.TrafficStats()
+	metric("oblivion_bytes_rx_total", "counter", "Bytes received on the tun device.", t.BytesReceived)
+	metric("oblivion_bytes_tx_total", "counter", "Bytes sent on the tun device.", t.BytesSent)
+	metric("oblivion_reconnect_total", "counter", "Times the client started reconnecting.", int64(m.c.reconnects.Load()))
+	metric("oblivion_state", "gauge",
+		"Connection state: 0 idle or stopped, 1 connected, 2 reconnecting, 3 connecting, 4 paused, 5 error.",
+		int64(metricState(m.c.State())))
+	if ms := m.c.latency.Load(); ms >= 0 {
+		metric("oblivion_latency_ms", "gauge", "Round trip of the last successful Ping through the tunnel.", ms)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,100 @@
+package tun2socks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics returns the body of GET /metrics for c.
+func scrapeMetrics(t *testing.T, c *Client) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	(&metricsServer{c: c}).handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics: %d %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the text exposition format", ct)
+	}
+	return w.Body.String()
+}
+
+func TestMetricsExposition(t *testing.T) {
+	c := NewClient(NewConfig())
+	c.mu.Lock()
+	c.session = "0123456789abcdef"
+	c.mu.Unlock()
+	c.reconnects.Add(3)
+	c.latency.Store(42)
+
+	body := scrapeMetrics(t, c)
+	want := map[string]string{
+		"oblivion_bytes_rx_total":  "counter",
+		"oblivion_bytes_tx_total":  "counter",
+		"oblivion_reconnect_total": "counter",
+		"oblivion_state":           "gauge",
+		"oblivion_latency_ms":      "gauge",
+	}
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	if len(lines) != 3*len(want) {
+		t.Fatalf("%d lines, want HELP, TYPE and a sample for each of %d metrics:\n%s", len(lines), len(want), body)
+	}
+	samples := map[string]string{}
+	for i := 0; i < len(lines); i += 3 {
+		help, typ, sample := lines[i], lines[i+1], lines[i+2]
+		name, value, ok := strings.Cut(sample, `{session_id="0123456789abcdef"} `)
+		if !ok {
+			t.Errorf("sample %q lacks the session_id label", sample)
+			continue
+		}
+		if !strings.HasPrefix(help, "# HELP "+name+" ") || len(help) == len("# HELP "+name+" ") {
+			t.Errorf("%s: HELP line %q", name, help)
+		}
+		if typ != "# TYPE "+name+" "+want[name] {
+			t.Errorf("%s: TYPE line %q, want %s", name, typ, want[name])
+		}
+		samples[name] = value
+	}
+	for name, value := range map[string]string{
+		"oblivion_bytes_rx_total":  "0",
+		"oblivion_reconnect_total": "3",
+		"oblivion_state":           "0",
+		"oblivion_latency_ms":      "42",
+	} {
+		if samples[name] != value {
+			t.Errorf("%s = %q, want %s", name, samples[name], value)
+		}
+	}
+}
+
+func TestMetricsWithoutLatency(t *testing.T) {
+	c := NewClient(NewConfig())
+	c.latency.Store(-1)
+	body := scrapeMetrics(t, c)
+	if strings.Contains(body, "oblivion_latency_ms") {
+		t.Errorf("latency exported before a ping:\n%s", body)
+	}
+	// Before the first start the session is empty but still labeled.
+	if !strings.Contains(body, "\noblivion_state{session_id=\"\"} 0\n") {
+		t.Errorf("state sample without an empty session_id label:\n%s", body)
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	c := NewClient(NewConfig())
+	c.mu.Lock()
+	c.session = "a\"b\\c\nd"
+	c.mu.Unlock()
+	body := scrapeMetrics(t, c)
+	if !strings.Contains(body, `oblivion_state{session_id="a\"b\\c\nd"} 0`) {
+		t.Errorf("session_id not escaped:\n%s", body)
+	}
+
+	w := httptest.NewRecorder()
+	(&metricsServer{c: c}).handleMetrics(w, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /metrics: status %d, want 405", w.Code)
+	}
+}
@@ -0,0 +1,140 @@
+package tun2socks
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// probeEchoes is how many ICMP echoes measure an endpoint.
+	probeEchoes = 3
+	// probeTimeout is how long an echo may take before it counts as lost.
+	probeTimeout = time.Second
+	// probeWorkers bounds how many endpoints are probed at once.
+	probeWorkers = 16
+)
+
+// probeEndpoint measures the round trip to ip; tests replace it so they
+// never ping Cloudflare.
+var probeEndpoint = pingEndpoint
+
+// pingEndpoint sends probeEchoes ICMP echoes to ip from an unprivileged ping
+// socket and returns the mean round trip of the answered ones and the
+// fraction that went unanswered. Where ping sockets are not allowed, e.g.
+// Linux with the default net.ipv4.ping_group_range, it returns an error.
+func pingEndpoint(ctx context.Context, ip net.IP) (time.Duration, float64, error) {
+	network, proto := "udp4", 1
+	var echo icmp.Type = ipv4.ICMPTypeEcho
+	var reply icmp.Type = ipv4.ICMPTypeEchoReply
+	if ip.To4() == nil {
+		network, proto = "udp6", 58
+		echo, reply = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	conn, err := icmp.ListenPacket(network, "")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	var total time.Duration
+	answered := 0
+	buf := make([]byte, 1500)
+	for seq := 1; seq <= probeEchoes && ctx.Err() == nil; seq++ {
+		msg, _ := (&icmp.Message{
+			Type: echo,
+			Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: seq, Data: []byte("oblivion")},
+		}).Marshal(nil)
+		sent := time.Now()
+		if _, err := conn.WriteTo(msg, &net.UDPAddr{IP: ip}); err != nil {
+			return 0, 0, err
+		}
+		conn.SetReadDeadline(sent.Add(probeTimeout))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break // lost
+			}
+			m, err := icmp.ParseMessage(proto, buf[:n])
+			if err != nil || m.Type != reply {
+				continue
+			}
+			// The kernel rewrites the ID of ping sockets, so only the
+			// sequence number tells replies apart.
+			if e, ok := m.Body.(*icmp.Echo); ok && e.Seq == seq {
+				total += time.Since(sent)
+				answered++
+				break
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	loss := float64(probeEchoes-answered) / probeEchoes
+	if answered == 0 {
+		return 0, loss, nil
+	}
+	return total / time.Duration(answered), loss, nil
+}
+
+// probeResults fills in RTT and Loss of every result with probeEndpoint. A
+// result that cannot be probed keeps zero for both; the first such error is
+// returned so the caller can report it once.
+func probeResults(ctx context.Context, results []EndpointResult) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	next := make(chan int)
+	for w := 0; w < probeWorkers && w < len(results); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				ip := net.ParseIP(results[i].IP)
+				if ip == nil {
+					continue
+				}
+				rtt, loss, err := probeEndpoint(ctx, ip)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				results[i].RTT, results[i].Loss = rtt, loss
+			}
+		}()
+	}
+	for i := range results {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(next)
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
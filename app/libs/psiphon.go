@@ -0,0 +1,76 @@
+package tun2socks
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// psiphonRegions are the countries psiphon can exit in over warp.
+var psiphonRegions = []string{
+	"AT", "BE", "BG", "BR", "CA", "CH", "CZ", "DE", "DK", "EE", "ES",
+	"FI", "FR", "GB", "HR", "HU", "IE", "IN", "IT", "JP", "LV", "NL",
+	"NO", "PL", "PT", "RO", "RS", "SE", "SG", "SK", "US",
+}
+
+// defaultRegionTimeout is how long a psiphon region gets to connect before
+// the next one in Config.Country is tried.
+const defaultRegionTimeout = 30 * time.Second
+
+// validatePsiphonRegion checks that code is a country code psiphon can exit
+// in.
+func validatePsiphonRegion(code string) error {
+	if err := ValidateCountryCode(code); err != nil {
+		return err
+	}
+	upper := strings.ToUpper(strings.TrimSpace(code))
+	for _, r := range psiphonRegions {
+		if r == upper {
+			return nil
+		}
+	}
+	return fmt.Errorf("psiphon has no region %q (%s): expected one of %s", code, countries[upper], strings.Join(psiphonRegions, ", "))
+}
+
+// regions returns the country codes in Country, in priority order.
+func (c *Config) regions() []string {
+	var list []string
+	for _, code := range strings.Split(c.Country, ",") {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+			list = append(list, code)
+		}
+	}
+	return list
+}
+
+func (c *Config) regionTimeout() time.Duration {
+	if c.RegionTimeoutSecs <= 0 {
+		return defaultRegionTimeout
+	}
+	return time.Duration(c.RegionTimeoutSecs) * time.Second
+}
+
+// setRegion records the psiphon region of r's current warp attempt and tells
+// the RegionListener when it changed.
+func (c *Client) setRegion(r *run, region string) {
+	if prev := r.region.Swap(&region); prev != nil && *prev == region {
+		return
+	}
+	log.Println("[psiphon] region:", region)
+	events.regionChanged(region)
+}
+
+// PsiphonRegion returns the country psiphon is exiting in, the entry of
+// Config.Country warp is currently trying. It is empty when psiphon is off or
+// the client is not running.
+func (c *Client) PsiphonRegion() string {
+	r := c.currentRun()
+	if r == nil || r.finished() {
+		return ""
+	}
+	if region := r.region.Load(); region != nil {
+		return *region
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package tun2socks
+
+// ring is a fixed-capacity FIFO of log events that overwrites the oldest one
+// when full. It is not safe for concurrent use.
+type ring struct {
+	lines   []LogEvent
+	start   int // index of the oldest line
+	n       int // number of lines held
+	dropped int // lines overwritten since the last drain
+}
+
+func newRing(size int) *ring {
+	if size <= 0 {
+		size = 1
+	}
+	return &ring{lines: make([]LogEvent, size)}
+}
+
+// push appends ev and reports whether the oldest event was overwritten.
+func (r *ring) push(ev LogEvent) bool {
+	if r.n < len(r.lines) {
+		r.lines[(r.start+r.n)%len(r.lines)] = ev
+		r.n++
+		return false
+	}
+	r.lines[r.start] = ev
+	r.start = (r.start + 1) % len(r.lines)
+	r.dropped++
+	return true
+}
+
+// snapshot returns the held events oldest first without removing them.
+func (r *ring) snapshot() []LogEvent {
+	out := make([]LogEvent, r.n)
+	for i := range out {
+		out[i] = r.lines[(r.start+i)%len(r.lines)]
+	}
+	return out
+}
+
+// drain returns the held lines oldest first, the number of lines dropped since
+// the previous drain, and empties the ring.
+func (r *ring) drain() ([]LogEvent, int) {
+	out := make([]LogEvent, r.n)
+	for i := range out {
+		out[i] = r.lines[(r.start+i)%len(r.lines)]
+		r.lines[(r.start+i)%len(r.lines)] = LogEvent{}
+	}
+	dropped := r.dropped
+	r.start, r.n, r.dropped = 0, 0, 0
+	return out, dropped
+}
+
+// resize changes the capacity, keeping the newest lines that still fit.
+func (r *ring) resize(size int) {
+	if size <= 0 {
+		size = 1
+	}
+	lines, dropped := r.drain()
+	if len(lines) > size {
+		dropped += len(lines) - size
+		lines = lines[len(lines)-size:]
+	}
+	r.lines = make([]LogEvent, size)
+	copy(r.lines, lines)
+	r.n = len(lines)
+	r.dropped = dropped
+}
@@ -0,0 +1,77 @@
+package tun2socks
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRingDropsOldest(t *testing.T) {
+	r := newRing(3)
+	for i := 0; i < 5; i++ {
+		r.push(LogEvent{Message: fmt.Sprint(i)})
+	}
+	evs, dropped := r.drain()
+	if dropped != 2 {
+		t.Errorf("dropped = %d, want 2", dropped)
+	}
+	var got []string
+	for _, ev := range evs {
+		got = append(got, ev.Message)
+	}
+	if fmt.Sprint(got) != "[2 3 4]" {
+		t.Errorf("drained %v, want [2 3 4]", got)
+	}
+	if evs, dropped := r.drain(); len(evs) != 0 || dropped != 0 {
+		t.Errorf("second drain = %d lines, %d dropped; want none", len(evs), dropped)
+	}
+}
+
+func TestRingResizeKeepsNewest(t *testing.T) {
+	r := newRing(4)
+	for i := 0; i < 4; i++ {
+		r.push(LogEvent{Message: fmt.Sprint(i)})
+	}
+	r.resize(2)
+	evs, dropped := r.drain()
+	if len(evs) != 2 || evs[0].Message != "2" || evs[1].Message != "3" || dropped != 2 {
+		t.Errorf("after resize drained %v with %d dropped, want [2 3] with 2", evs, dropped)
+	}
+}
+
+// BenchmarkRingPush shows that a full ring does not allocate per line.
+func BenchmarkRingPush(b *testing.B) {
+	r := newRing(defaultLogBufferSize)
+	ev := LogEvent{Time: time.Now(), Level: "info", Source: sourceApp, Message: "benchmark line"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.push(ev)
+	}
+}
+
+// BenchmarkLogWriterSustained logs without ever draining, as when the app
+// stops polling, and reports the live heap afterwards: it stays at the size
+// of the full buffers however many lines go through.
+func BenchmarkLogWriterSustained(b *testing.B) {
+	writer := newLogWriter(defaultLogBufferSize, 0)
+	msg := "sustained benchmark line with some typical length to it"
+	// Fill the buffer and the event store first, so only growth past their
+	// limits would show.
+	for i := 0; i < 2*eventStoreSize; i++ {
+		writer.writeLine(sourceApp, msg)
+	}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writer.writeLine(sourceApp, msg)
+	}
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)), "heap-growth-bytes")
+	runtime.KeepAlive(writer)
+}
@@ -0,0 +1,182 @@
+package tun2socks
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const routingRulesFile = "routing-rules.txt"
+
+// routingRules are split-tunnel rules from routingRulesFile under the path
+// passed to Start. Each line is "bypass <pattern>" or "route <pattern>", the
+// pattern a CIDR or a domain suffix; blank lines and # comments are skipped.
+// They add to the rules in Config and can be reloaded while running.
+type routingRules struct {
+	BypassCIDRs   []string
+	RouteCIDRs    []string
+	BypassDomains []string
+	RouteDomains  []string
+}
+
+// loadRoutingRules reads the rules file in dir. A missing file means no
+// rules.
+func loadRoutingRules(dir string) (routingRules, error) {
+	var rules routingRules
+	path := filepath.Join(dir, routingRulesFile)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return rules, nil
+	}
+	if err != nil {
+		return rules, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return rules, fmt.Errorf("%s:%d: expected \"bypass <pattern>\" or \"route <pattern>\"", path, n)
+		}
+		action, pattern := fields[0], fields[1]
+		_, _, cidrErr := net.ParseCIDR(pattern)
+		if cidrErr != nil {
+			if err := validateDomainPattern(pattern); err != nil {
+				return rules, fmt.Errorf("%s:%d: %q is neither a cidr nor a domain", path, n, pattern)
+			}
+		}
+		switch {
+		case action == "bypass" && cidrErr == nil:
+			rules.BypassCIDRs = append(rules.BypassCIDRs, pattern)
+		case action == "route" && cidrErr == nil:
+			rules.RouteCIDRs = append(rules.RouteCIDRs, pattern)
+		case action == "bypass":
+			rules.BypassDomains = append(rules.BypassDomains, pattern)
+		case action == "route":
+			rules.RouteDomains = append(rules.RouteDomains, pattern)
+		default:
+			return rules, fmt.Errorf("%s:%d: unknown action %q, expected bypass or route", path, n, action)
+		}
+	}
+	return rules, sc.Err()
+}
+
+// RoutingRule is a split-tunnel rule of the tun stack for a CIDR or a domain
+// suffix; Action is "direct" or "tunnel".
+type RoutingRule struct {
+	CIDR   string `json:"cidr,omitempty"`
+	Domain string `json:"domain,omitempty"`
+	Action string `json:"action"`
+}
+
+// RoutingTable is the split-tunnel rule set of the tun stack. Hosts behind
+// fake IPs are matched against Domains first, the longest suffix winning. If
+// none matches they take DomainDefault when it is set; otherwise they, like
+// every other destination, go by the first of Rules whose CIDR contains the
+// address, and by Default when none does.
+type RoutingTable struct {
+	Domains       []RoutingRule `json:"domains"`
+	Rules         []RoutingRule `json:"rules"`
+	DomainDefault string        `json:"domainDefault,omitempty"`
+	Default       string        `json:"default"`
+}
+
+func routeAction(direct bool) string {
+	if direct {
+		return "direct"
+	}
+	return "tunnel"
+}
+
+func emptyRoutingTable() RoutingTable {
+	return RoutingTable{Domains: []RoutingRule{}, Rules: []RoutingRule{}, Default: routeAction(false)}
+}
+
+// RoutingRules returns the rules the running tun stack applies, in the order
+// it applies them. Without a tun stack or rules, everything is tunneled.
+func (c *Client) RoutingRules() RoutingTable {
+	t := emptyRoutingTable()
+	rt, ok := c.stack.(router)
+	if !ok {
+		return t
+	}
+	routes := rt.RoutingRules()
+	for _, r := range routes.Domains {
+		t.Domains = append(t.Domains, RoutingRule{Domain: r.Domain, Action: routeAction(r.Direct)})
+	}
+	for _, r := range routes.CIDRs {
+		t.Rules = append(t.Rules, RoutingRule{CIDR: r.CIDR, Action: routeAction(r.Direct)})
+	}
+	if routes.DomainsDirect {
+		t.DomainDefault = routeAction(true)
+	}
+	t.Default = routeAction(routes.Direct)
+	return t
+}
+
+// ReloadRoutingRules reads routingRulesFile under the path passed to Start
+// again and applies it, together with the rules in Config, to the running tun
+// stack; open flows keep their route. On error the current rules stay. It
+// returns ErrNotRunning when there is no active run.
+func (c *Client) ReloadRoutingRules() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.run
+	if r == nil || r.finished() || r.closing {
+		return ErrNotRunning
+	}
+	routes, err := loadRoutingRules(c.path)
+	if err != nil {
+		return err
+	}
+	merged := routes.merged(&c.cfg)
+	if rt, ok := c.stack.(router); ok && r.fd >= 0 {
+		if err := rt.UpdateRoutes(merged.BypassCIDRs, merged.RouteCIDRs, merged.BypassDomains, merged.RouteDomains); err != nil {
+			return err
+		}
+	}
+	r.routes = routes
+	log.Println("Reloaded", routingRulesFile)
+	logRoutingRules(merged)
+	return nil
+}
+
+func logRoutingRules(r routingRules) {
+	if len(r.BypassCIDRs) > 0 {
+		log.Println("Bypassing warp for:", strings.Join(r.BypassCIDRs, ", "))
+	}
+	if len(r.RouteCIDRs) > 0 {
+		log.Println("Only tunneling:", strings.Join(r.RouteCIDRs, ", "))
+	}
+	if len(r.BypassDomains) > 0 {
+		log.Println("Bypassing warp for domains:", strings.Join(r.BypassDomains, ", "))
+	}
+	if len(r.RouteDomains) > 0 {
+		log.Println("Only tunneling domains:", strings.Join(r.RouteDomains, ", "))
+	}
+}
+
+// merged returns the rules of cfg followed by r.
+func (r routingRules) merged(cfg *Config) routingRules {
+	join := func(a, b []string) []string {
+		return append(append([]string(nil), a...), b...)
+	}
+	return routingRules{
+		BypassCIDRs:   join(cfg.BypassCIDRs, r.BypassCIDRs),
+		RouteCIDRs:    join(cfg.RouteCIDRs, r.RouteCIDRs),
+		BypassDomains: join(cfg.BypassDomains, r.BypassDomains),
+		RouteDomains:  join(cfg.RouteDomains, r.RouteDomains),
+	}
+}
@@ -0,0 +1,247 @@
+package tun2socks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/wiresocks"
+)
+
+// ErrNoEndpointFound is returned by BestEndpoint when no endpoint answers
+// within Config.RTT.
+var ErrNoEndpointFound = errors.New("no endpoint found within the rtt threshold")
+
+// runScan is wiresocks.RunScan; tests replace it so they never probe
+// Cloudflare.
+var runScan = wiresocks.RunScan
+
+// warpIPv6Prefixes are the IPv6 ranges of warp's endpoints. ScanIPv6 probes
+// them directly, as the bundled scanner may not cover them.
+var warpIPv6Prefixes = []string{"2606:4700:d0::/48", "2606:4700:d1::/48"}
+
+const (
+	// warpIPv6Host is the interface id of the well-known endpoint in each
+	// of warpIPv6Prefixes, e.g. 2606:4700:d0::a29f:c001.
+	warpIPv6Host = "::a29f:c001"
+	// ipv6ScanCandidates is how many random addresses of each prefix are
+	// probed besides the well-known one.
+	ipv6ScanCandidates = 8
+	// defaultWarpPort is probed when ScanPorts is empty.
+	defaultWarpPort = 2408
+)
+
+// EndpointResult is one warp endpoint found by the scanner. The bundled
+// scanner reports bare addresses, so RTT and Loss come from ICMP echoes sent
+// to each result after the scan; they are zero where ping sockets are not
+// allowed.
+type EndpointResult struct {
+	IP   string
+	Port int
+	// RTT is the mean round trip of the answered echoes, zero when none was.
+	RTT time.Duration
+	// Loss is the fraction of echoes that went unanswered, from 0 to 1.
+	Loss float64
+}
+
+// Endpoint returns the result as a host:port string suitable for Config.Endpoint.
+func (r EndpointResult) Endpoint() string {
+	return net.JoinHostPort(r.IP, strconv.Itoa(r.Port))
+}
+
+// ScanEndpoints runs the warp scanner on its own, without setting up a tunnel,
+// and returns the endpoints that answered within maxRTT, fastest first, those
+// that could not be measured last in scanner order. A non-positive maxRTT
+// uses Config.RTT. With
+// Config.ScanPorts set, only endpoints on those ports are returned, and with
+// Config.ScanIPv6 only IPv6 ones, including those of warp's IPv6 ranges that
+// answer an echo within maxRTT. The scanner uses the warp identity stored by
+// an earlier run.
+func (c *Client) ScanEndpoints(ctx context.Context, maxRTT time.Duration) ([]EndpointResult, error) {
+	c.mu.Lock()
+	cfg := c.cfg
+	c.mu.Unlock()
+	if ms := int(maxRTT / time.Millisecond); ms > 0 {
+		cfg.RTT = ms
+	}
+	return c.scanEndpoints(ctx, &cfg)
+}
+
+// scanEndpoints is ScanEndpoints for a copy of the config, so it can run
+// without c.mu.
+func (c *Client) scanEndpoints(ctx context.Context, cfg *Config) ([]EndpointResult, error) {
+	addrs, err := runScan(&ctx, cfg.rttThreshold())
+	if err != nil {
+		if !cfg.ScanIPv6 || ctx.Err() != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		// On an IPv6-only network the scanner may find nothing to
+		// reach; the IPv6 ranges are still probed below.
+		log.Println("[scanner] Warning: scan failed:", err)
+	}
+	results := make([]EndpointResult, 0, len(addrs))
+	for _, addr := range addrs {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("scan returned invalid endpoint %q: %w", addr, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, fmt.Errorf("scan returned invalid endpoint %q: %w", addr, err)
+		}
+		if len(cfg.ScanPorts) > 0 && !containsPort(cfg.ScanPorts, port) {
+			continue
+		}
+		if ip := net.ParseIP(host); cfg.ScanIPv6 && (ip == nil || ip.To4() != nil) {
+			continue
+		}
+		results = append(results, EndpointResult{IP: host, Port: port})
+	}
+	err = probeResults(ctx, results)
+	if cfg.ScanIPv6 && ctx.Err() == nil {
+		found, err6 := probeIPv6Ranges(ctx, cfg, results)
+		results = append(results, found...)
+		if err == nil {
+			err = err6
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("scan: %w", ctx.Err())
+		}
+		log.Println("[scanner] Warning: cannot measure endpoint latency:", err)
+	}
+	sortByRTT(results)
+
+	c.scanMu.Lock()
+	c.scan = append([]EndpointResult(nil), results...)
+	c.scanMu.Unlock()
+	events.scanComplete(scanResultsJSON(results))
+	return results, nil
+}
+
+// probeIPv6Ranges probes the well-known and ipv6ScanCandidates random
+// addresses of each of warpIPv6Prefixes, skipping those in known, and returns
+// the ones that answered within cfg's RTT threshold on every port of
+// ScanPorts, or on defaultWarpPort.
+func probeIPv6Ranges(ctx context.Context, cfg *Config, known []EndpointResult) ([]EndpointResult, error) {
+	seen := make(map[string]bool, len(known))
+	for _, r := range known {
+		if ip := net.ParseIP(r.IP); ip != nil {
+			seen[ip.String()] = true
+		}
+	}
+	var probed []EndpointResult
+	for _, ip := range ipv6Candidates() {
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			probed = append(probed, EndpointResult{IP: ip.String()})
+		}
+	}
+	err := probeResults(ctx, probed)
+
+	ports := cfg.ScanPorts
+	if len(ports) == 0 {
+		ports = []int{defaultWarpPort}
+	}
+	maxRTT := time.Duration(cfg.rttThreshold()) * time.Millisecond
+	var results []EndpointResult
+	for _, r := range probed {
+		if r.RTT == 0 || r.RTT > maxRTT {
+			continue
+		}
+		for _, port := range ports {
+			r.Port = port
+			results = append(results, r)
+		}
+	}
+	return results, err
+}
+
+// ipv6Candidates returns the addresses probeIPv6Ranges probes.
+func ipv6Candidates() []net.IP {
+	var ips []net.IP
+	host := net.ParseIP(warpIPv6Host)
+	for _, prefix := range warpIPv6Prefixes {
+		_, n, err := net.ParseCIDR(prefix)
+		if err != nil {
+			panic(err)
+		}
+		ones, _ := n.Mask.Size()
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, n.IP)
+		copy(ip[ones/8:], host[ones/8:])
+		ips = append(ips, ip)
+		for i := 0; i < ipv6ScanCandidates; i++ {
+			ip := make(net.IP, net.IPv6len)
+			rand.Read(ip[ones/8:])
+			copy(ip, n.IP[:ones/8])
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// sortByRTT orders results by RTT, keeping the order of equal ones. Results
+// with no RTT, because no echo was answered or none could be sent, go last.
+func sortByRTT(results []EndpointResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i].RTT, results[j].RTT
+		if a == 0 || b == 0 {
+			return b == 0 && a != 0
+		}
+		return a < b
+	})
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// ScanResults returns the endpoints found by the latest scan, fastest first.
+// They are kept until the next scan finishes.
+func (c *Client) ScanResults() []EndpointResult {
+	c.scanMu.Lock()
+	defer c.scanMu.Unlock()
+	return append([]EndpointResult(nil), c.scan...)
+}
+
+// scanResultsJSON encodes results as the array returned by GetScanResults.
+func scanResultsJSON(results []EndpointResult) string {
+	type entry struct {
+		Endpoint  string `json:"endpoint"`
+		RTTMillis int64  `json:"rttMillis"`
+	}
+	list := make([]entry, len(results))
+	for i, r := range results {
+		list[i] = entry{Endpoint: r.Endpoint(), RTTMillis: r.RTT.Milliseconds()}
+	}
+	b, _ := json.Marshal(list)
+	return string(b)
+}
+
+// BestEndpoint scans for endpoints within Config.RTT and returns the fastest
+// as host:port. It can be called before Start, e.g. to pick a server up front, or
+// while running to feed the result into Reconfigure.
+func (c *Client) BestEndpoint(ctx context.Context) (string, error) {
+	results, err := c.ScanEndpoints(ctx, 0)
+	if err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return "", ErrNoEndpointFound
+	}
+	return results[0].Endpoint(), nil
+}
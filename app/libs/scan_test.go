@@ -0,0 +1,247 @@
+package tun2socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEndpointResultFormatting(t *testing.T) {
+	tests := []struct {
+		r    EndpointResult
+		want string
+	}{
+		{EndpointResult{IP: "162.159.192.1", Port: 2408}, "162.159.192.1:2408"},
+		{EndpointResult{IP: "2606:4700:d0::a29f:c001", Port: 2408}, "[2606:4700:d0::a29f:c001]:2408"},
+		{EndpointResult{IP: "2606:4700:d1::1", Port: 500}, "[2606:4700:d1::1]:500"},
+		{EndpointResult{IP: "::ffff:162.159.192.1", Port: 4500}, "[::ffff:162.159.192.1]:4500"},
+		{EndpointResult{IP: "engage.cloudflareclient.com", Port: 2408}, "engage.cloudflareclient.com:2408"},
+	}
+	for _, tt := range tests {
+		got := tt.r.Endpoint()
+		if got != tt.want {
+			t.Errorf("Endpoint() = %q, want %q", got, tt.want)
+		}
+		// Whatever the scanner picks must be accepted as -e.
+		if err := validateHostPort(got); err != nil {
+			t.Errorf("validateHostPort(%q): %v", got, err)
+		}
+	}
+}
+
+func TestBracketedIPv6Endpoint(t *testing.T) {
+	cfg, err := ParseArgString("-e [2606:4700:d0::a29f:c001]:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Endpoint != "[2606:4700:d0::a29f:c001]:2408" {
+		t.Errorf("Endpoint = %q", cfg.Endpoint)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+
+	cfg.Endpoint = "2606:4700:d0::a29f:c001:2408"
+	err = cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "must be in brackets") {
+		t.Errorf("Validate of an unbracketed ipv6 endpoint = %v, want the bracket hint", err)
+	}
+}
+
+// fakeScan replaces runScan for the rest of the test with one returning addrs.
+func fakeScan(t *testing.T, addrs ...string) {
+	t.Helper()
+	orig := runScan
+	runScan = func(*context.Context, int) ([]string, error) { return addrs, nil }
+	t.Cleanup(func() { runScan = orig })
+}
+
+// fakeProbe replaces probeEndpoint for the rest of the test with one that
+// answers the addresses in rtts after that long and loses every echo to any
+// other.
+func fakeProbe(t *testing.T, rtts map[string]time.Duration) {
+	t.Helper()
+	orig := probeEndpoint
+	probeEndpoint = func(ctx context.Context, ip net.IP) (time.Duration, float64, error) {
+		if rtt, ok := rtts[ip.String()]; ok {
+			return rtt, 0, nil
+		}
+		return 0, 1, nil
+	}
+	t.Cleanup(func() { probeEndpoint = orig })
+}
+
+func TestScanEndpointsSortsByRTT(t *testing.T) {
+	fakeScan(t, "162.159.192.1:2408", "162.159.192.2:2408", "162.159.192.3:500", "162.159.192.4:2408", "162.159.192.5:4500")
+	fakeProbe(t, map[string]time.Duration{
+		"162.159.192.1": 90 * time.Millisecond,
+		"162.159.192.3": 20 * time.Millisecond,
+		"162.159.192.4": 90 * time.Millisecond,
+		"162.159.192.5": 45 * time.Millisecond,
+	})
+	c := NewClient(NewConfig())
+	results, err := c.ScanEndpoints(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EndpointResult{
+		{IP: "162.159.192.3", Port: 500, RTT: 20 * time.Millisecond},
+		{IP: "162.159.192.5", Port: 4500, RTT: 45 * time.Millisecond},
+		{IP: "162.159.192.1", Port: 2408, RTT: 90 * time.Millisecond},
+		{IP: "162.159.192.4", Port: 2408, RTT: 90 * time.Millisecond},
+		{IP: "162.159.192.2", Port: 2408, Loss: 1},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("ScanEndpoints = %+v, want %+v", results, want)
+	}
+	if best, err := c.BestEndpoint(context.Background()); err != nil || best != "162.159.192.3:500" {
+		t.Errorf("BestEndpoint = %q, %v, want the fastest endpoint", best, err)
+	}
+	wantJSON := `[{"endpoint":"162.159.192.3:500","rttMillis":20},{"endpoint":"162.159.192.5:4500","rttMillis":45},` +
+		`{"endpoint":"162.159.192.1:2408","rttMillis":90},{"endpoint":"162.159.192.4:2408","rttMillis":90},` +
+		`{"endpoint":"162.159.192.2:2408","rttMillis":0}]`
+	if got := scanResultsJSON(c.ScanResults()); got != wantJSON {
+		t.Errorf("scan results = %s, want %s", got, wantJSON)
+	}
+}
+
+func TestScanEndpointsWithoutProbe(t *testing.T) {
+	fakeScan(t, "162.159.192.1:2408", "162.159.192.2:2408")
+	orig := probeEndpoint
+	probeEndpoint = func(context.Context, net.IP) (time.Duration, float64, error) {
+		return 0, 0, os.ErrPermission
+	}
+	defer func() { probeEndpoint = orig }()
+
+	results, err := NewClient(NewConfig()).ScanEndpoints(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EndpointResult{{IP: "162.159.192.1", Port: 2408}, {IP: "162.159.192.2", Port: 2408}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("ScanEndpoints = %+v, want scanner order with no RTT, %+v", results, want)
+	}
+}
+
+func TestScanIPv6Filter(t *testing.T) {
+	fakeScan(t, "162.159.192.1:2408", "[2606:4700:d0::a29f:c001]:2408", "[2606:4700:d1::1]:500")
+	fakeProbe(t, nil)
+
+	cfg := NewConfig()
+	cfg.ScanIPv6 = true
+	c := NewClient(cfg)
+	best, err := c.BestEndpoint(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best != "[2606:4700:d0::a29f:c001]:2408" {
+		t.Errorf("BestEndpoint = %q, want the first ipv6 result", best)
+	}
+	if got, want := scanResultsJSON(c.ScanResults()),
+		`[{"endpoint":"[2606:4700:d0::a29f:c001]:2408","rttMillis":0},{"endpoint":"[2606:4700:d1::1]:500","rttMillis":0}]`; got != want {
+		t.Errorf("scan results = %s, want %s", got, want)
+	}
+
+	cfg.ScanIPv6, cfg.ScanPorts = false, []int{500}
+	c = NewClient(cfg)
+	results, err := c.ScanEndpoints(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []EndpointResult{{IP: "2606:4700:d1::1", Port: 500, Loss: 1}}; !reflect.DeepEqual(results, want) {
+		t.Errorf("ScanEndpoints with -scan-ports 500 = %+v, want %+v", results, want)
+	}
+}
+
+func TestScanIPv6ProbesRanges(t *testing.T) {
+	fakeScan(t, "162.159.192.1:2408", "[2606:4700:d0::a29f:c001]:2408")
+	_, d1, _ := net.ParseCIDR("2606:4700:d1::/48")
+	var mu sync.Mutex
+	probed := map[string]bool{}
+	orig := probeEndpoint
+	probeEndpoint = func(ctx context.Context, ip net.IP) (time.Duration, float64, error) {
+		mu.Lock()
+		probed[ip.String()] = true
+		mu.Unlock()
+		switch {
+		case ip.Equal(net.ParseIP("2606:4700:d0::a29f:c001")):
+			return 80 * time.Millisecond, 0, nil
+		case ip.Equal(net.ParseIP("2606:4700:d1::a29f:c001")):
+			return 30 * time.Millisecond, 0, nil
+		case d1.Contains(ip):
+			return 2 * time.Second, 0, nil // over the rtt threshold
+		}
+		return 0, 1, nil
+	}
+	defer func() { probeEndpoint = orig }()
+
+	cfg := NewConfig()
+	cfg.ScanIPv6 = true
+	results, err := NewClient(cfg).ScanEndpoints(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EndpointResult{
+		{IP: "2606:4700:d1::a29f:c001", Port: 2408, RTT: 30 * time.Millisecond},
+		{IP: "2606:4700:d0::a29f:c001", Port: 2408, RTT: 80 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("ScanEndpoints = %+v, want %+v", results, want)
+	}
+	_, d0, _ := net.ParseCIDR("2606:4700:d0::/48")
+	in := map[*net.IPNet]int{}
+	for s := range probed {
+		for _, n := range []*net.IPNet{d0, d1} {
+			if n.Contains(net.ParseIP(s)) {
+				in[n]++
+			}
+		}
+	}
+	// The scanner already reported d0's well-known address; its random
+	// ones are new.
+	if in[d0] != ipv6ScanCandidates+1 || in[d1] != ipv6ScanCandidates+1 {
+		t.Errorf("probed %d addresses in d0 and %d in d1, want %d each", in[d0], in[d1], ipv6ScanCandidates+1)
+	}
+
+	// Found addresses are used on every -scan-ports port, including the one
+	// the scanner reported on another port.
+	cfg.ScanPorts = []int{500, 4500}
+	results, err = NewClient(cfg).ScanEndpoints(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []EndpointResult{
+		{IP: "2606:4700:d1::a29f:c001", Port: 500, RTT: 30 * time.Millisecond},
+		{IP: "2606:4700:d1::a29f:c001", Port: 4500, RTT: 30 * time.Millisecond},
+		{IP: "2606:4700:d0::a29f:c001", Port: 500, RTT: 80 * time.Millisecond},
+		{IP: "2606:4700:d0::a29f:c001", Port: 4500, RTT: 80 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("ScanEndpoints with -scan-ports 500,4500 = %+v, want %+v", results, want)
+	}
+}
+
+func TestScanIPv6WithoutScanner(t *testing.T) {
+	orig := runScan
+	runScan = func(*context.Context, int) ([]string, error) { return nil, errors.New("network is unreachable") }
+	defer func() { runScan = orig }()
+	fakeProbe(t, map[string]time.Duration{"2606:4700:d0::a29f:c001": 50 * time.Millisecond})
+
+	cfg := NewConfig()
+	cfg.ScanIPv6 = true
+	best, err := NewClient(cfg).BestEndpoint(context.Background())
+	if err != nil || best != "[2606:4700:d0::a29f:c001]:2408" {
+		t.Errorf("BestEndpoint = %q, %v, want the probed ipv6 endpoint", best, err)
+	}
+
+	cfg.ScanIPv6 = false
+	if _, err := NewClient(cfg).ScanEndpoints(context.Background(), 0); err == nil {
+		t.Error("ScanEndpoints succeeded with a failing scanner")
+	}
+}
@@ -0,0 +1,119 @@
+package tun2socks
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// selfTestTimeout bounds the whole self-test, including the wait for
+	// warp's SOCKS5 server to come up, so CI gets an answer within ten
+	// seconds; selfTestRetry is the pause between attempts until it does.
+	selfTestTimeout = 10 * time.Second
+	selfTestRetry   = time.Second
+)
+
+// SelfTestResult is the outcome of the Config.SelfTest check. Warp is the
+// warp field of the Cloudflare trace, e.g. "on", "plus" or "off".
+type SelfTestResult struct {
+	OK            bool   `json:"ok"`
+	Warp          string `json:"warp,omitempty"`
+	LatencyMillis int64  `json:"latencyMillis"`
+	Error         string `json:"error,omitempty"`
+}
+
+// selfTest fetches the Cloudflare trace through the SOCKS5 proxy once the
+// run is up and checks that the request left through warp. On failure the
+// run ends with ErrSelfTestFailed; on success it keeps running.
+func (c *Client) selfTest(r *run) {
+	ctx, cancel := context.WithTimeout(r.ctx, selfTestTimeout)
+	defer cancel()
+	start := time.Now()
+	var warp string
+	var err error
+retry:
+	for {
+		attemptCtx, attemptCancel := context.WithTimeout(ctx, healthCheckTimeout)
+		warp, err = c.traceWarp(attemptCtx)
+		attemptCancel()
+		if err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break retry
+		case <-time.After(selfTestRetry):
+		}
+	}
+	if r.ctx.Err() != nil {
+		return
+	}
+	res := SelfTestResult{Warp: warp, LatencyMillis: time.Since(start).Milliseconds()}
+	switch {
+	case err != nil:
+		res.Error = err.Error()
+	case warp != "on" && warp != "plus":
+		res.Error = fmt.Sprintf("traffic does not go through warp (warp=%s)", warp)
+	default:
+		res.OK = true
+	}
+	r.selfTest.Store(&res)
+	if res.OK {
+		log.Printf("Self-test passed: warp=%s after %dms", warp, res.LatencyMillis)
+		return
+	}
+	log.Println("Self-test failed:", res.Error)
+	select {
+	case r.errCh <- fmt.Errorf("%w: %s", ErrSelfTestFailed, res.Error):
+	default:
+		// The run already failed for another reason.
+	}
+	r.cancel()
+}
+
+// traceWarp fetches connectivityTraceURL through the SOCKS5 proxy and returns
+// its warp field.
+func (c *Client) traceWarp(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, connectivityTraceURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := socksHTTPClient(c.socksAddr()).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("trace: %s", resp.Status)
+	}
+	sc := bufio.NewScanner(io.LimitReader(resp.Body, 16<<10))
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "warp="); ok {
+			return v, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("trace: no warp field")
+}
+
+// SelfTestResult returns the outcome of the latest run's self-test, and false
+// while it has not finished or Config.SelfTest is off.
+func (c *Client) SelfTestResult() (SelfTestResult, bool) {
+	r := c.currentRun()
+	if r == nil {
+		return SelfTestResult{}, false
+	}
+	res := r.selfTest.Load()
+	if res == nil {
+		return SelfTestResult{}, false
+	}
+	return *res, true
+}
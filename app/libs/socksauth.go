@@ -0,0 +1,238 @@
+package tun2socks
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const socksHandshakeTimeout = 30 * time.Second
+
+// SOCKS5 reply codes (RFC 1928, section 6).
+const (
+	socksReplySucceeded        = 0
+	socksReplyHostUnreachable  = 4
+	socksReplyCmdNotSupported  = 7
+	socksReplyAddrNotSupported = 8
+)
+
+// socksAuthServer is a SOCKS5 front-end on Config.BindAddress that requires
+// RFC 1929 username/password authentication. Accepted CONNECT requests are
+// relayed through the warp SOCKS listener at upstream, which then only
+// listens on loopback. UDP ASSOCIATE is not supported; tun traffic reaches
+// upstream directly and does not need it.
+//
+// It keeps other devices out, not other processes: app.RunWarp takes nothing
+// but an address to listen on, so the listener at upstream accepts anyone on
+// this device who finds its port.
+type socksAuthServer struct {
+	ln         net.Listener
+	upstream   string
+	user, pass []byte
+	wg         sync.WaitGroup
+}
+
+func listenSocksAuth(addr, upstream, user, pass string) (*socksAuthServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &socksAuthServer{ln: ln, upstream: upstream, user: []byte(user), pass: []byte(pass)}, nil
+}
+
+// freeLoopbackAddr returns a loopback address with a currently unused port.
+// The port is released before warp binds it, so another process may take it
+// first. Warp then fails to listen and is retried, while the front-end and
+// the tun stack keep sending to whatever holds the port.
+func freeLoopbackAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// serve accepts connections until ctx is done, then closes the listener and
+// every open connection and waits for their handlers to return.
+func (s *socksAuthServer) serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.ln.Close()
+	}()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("SOCKS accept failed:", err)
+			}
+			break
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+				case <-done:
+				}
+			}()
+			s.handle(ctx, conn)
+		}()
+	}
+	s.wg.Wait()
+}
+
+func (s *socksAuthServer) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	if err := s.authenticate(conn); err != nil {
+		log.Printf("SOCKS client %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	target, err := readSocksRequest(conn)
+	if err != nil {
+		log.Printf("SOCKS client %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, socksHandshakeTimeout)
+	upstream, err := dialSocks5(dialCtx, s.upstream, target)
+	cancel()
+	if err != nil {
+		writeSocksReply(conn, socksReplyHostUnreachable)
+		log.Printf("SOCKS connect to %s failed: %v", target, err)
+		return
+	}
+	defer upstream.Close()
+	if err := writeSocksReply(conn, socksReplySucceeded); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// authenticate runs method negotiation and the RFC 1929 sub-negotiation.
+// The credentials themselves are never logged.
+func (s *socksAuthServer) authenticate(conn net.Conn) error {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[0] != 5 {
+		return fmt.Errorf("unsupported socks version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	var offered bool
+	for _, m := range methods {
+		offered = offered || m == 2
+	}
+	if !offered {
+		conn.Write([]byte{5, 0xff})
+		return errors.New("client does not offer username/password authentication")
+	}
+	if _, err := conn.Write([]byte{5, 2}); err != nil {
+		return err
+	}
+
+	var ver [2]byte
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		return err
+	}
+	if ver[0] != 1 {
+		return fmt.Errorf("unsupported auth version %d", ver[0])
+	}
+	user := make([]byte, ver[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(conn, plen[:]); err != nil {
+		return err
+	}
+	pass := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return err
+	}
+	userOK := subtle.ConstantTimeCompare(user, s.user) == 1
+	passOK := subtle.ConstantTimeCompare(pass, s.pass) == 1
+	if !userOK || !passOK {
+		conn.Write([]byte{1, 1})
+		return errors.New("authentication failed")
+	}
+	_, err := conn.Write([]byte{1, 0})
+	return err
+}
+
+// readSocksRequest reads a CONNECT request and returns its target as
+// host:port. Other commands are answered with "command not supported".
+func readSocksRequest(conn net.Conn) (string, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return "", err
+	}
+	if head[1] != 1 {
+		writeSocksReply(conn, socksReplyCmdNotSupported)
+		return "", fmt.Errorf("unsupported command %d", head[1])
+	}
+	var host string
+	switch head[3] {
+	case 1, 4:
+		ip := make(net.IP, net.IPv4len)
+		if head[3] == 4 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeSocksReply(conn, socksReplyAddrNotSupported)
+		return "", fmt.Errorf("unknown address type %d", head[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeSocksReply sends a reply with an unspecified IPv4 bound address.
+func writeSocksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,299 @@
+package tun2socks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// listenEcho starts a TCP server that echoes everything back.
+func listenEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// listenUpstreamSocks starts a SOCKS5 server without authentication, standing
+// in for warp's listener behind the auth front-end.
+func listenUpstreamSocks(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var greeting [3]byte
+				if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				target, err := readSocksRequest(conn)
+				if err != nil {
+					return
+				}
+				dst, err := net.Dial("tcp", target)
+				if err != nil {
+					writeSocksReply(conn, socksReplyHostUnreachable)
+					return
+				}
+				defer dst.Close()
+				writeSocksReply(conn, socksReplySucceeded)
+				go io.Copy(dst, conn)
+				io.Copy(conn, dst)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startSocksAuth serves a socksAuthServer for user and pass in front of a
+// fresh upstream and returns its address.
+func startSocksAuth(t *testing.T, user, pass string) string {
+	t.Helper()
+	s, err := listenSocksAuth("127.0.0.1:0", listenUpstreamSocks(t), user, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.serve(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return s.ln.Addr().String()
+}
+
+// lockedBuffer is a bytes.Buffer safe for the logger and the test to share.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends the standard logger to a buffer for the rest of the test.
+func captureLog(t *testing.T) *lockedBuffer {
+	t.Helper()
+	buf := &lockedBuffer{}
+	prev := log.Writer()
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(prev) })
+	return buf
+}
+
+func TestSocksAuthSuccess(t *testing.T) {
+	echo := listenEcho(t)
+	addr := startSocksAuth(t, "alice", "s3cret")
+	dialer, err := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "alice", Password: "s3cret"}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("dial through the proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ping" {
+		t.Errorf("echo = %q, want ping", reply)
+	}
+}
+
+func TestSocksAuthFailure(t *testing.T) {
+	logs := captureLog(t)
+	echo := listenEcho(t)
+	addr := startSocksAuth(t, "alice", "s3cret")
+	for _, auth := range []*proxy.Auth{
+		{User: "alice", Password: "wrong-pass"},
+		{User: "mallory", Password: "s3cret"},
+	} {
+		dialer, err := proxy.SOCKS5("tcp", addr, auth, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := dialer.Dial("tcp", echo); err == nil {
+			conn.Close()
+			t.Errorf("dial as %s/%s succeeded, want an auth failure", auth.User, auth.Password)
+		}
+	}
+	// Without credentials the client only offers "no authentication".
+	dialer, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := dialer.Dial("tcp", echo); err == nil {
+		conn.Close()
+		t.Error("dial without credentials succeeded")
+	}
+
+	// Give the handlers time to log before checking what they wrote.
+	time.Sleep(50 * time.Millisecond)
+	for _, secret := range []string{"s3cret", "wrong-pass"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("log contains the credential %q:\n%s", secret, logs)
+		}
+	}
+}
+
+// TestSocksAuthReplyCodes checks the bytes on the wire: 0xff when no
+// acceptable method is offered and status 1 for bad credentials.
+func TestSocksAuthReplyCodes(t *testing.T) {
+	captureLog(t)
+	addr := startSocksAuth(t, "alice", "s3cret")
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	read2 := func(conn net.Conn) [2]byte {
+		var b [2]byte
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	conn := dial()
+	conn.Write([]byte{5, 1, 0})
+	if got := read2(conn); got != [2]byte{5, 0xff} {
+		t.Errorf("no-auth greeting got %v, want [5 255]", got)
+	}
+
+	conn = dial()
+	conn.Write([]byte{5, 1, 2})
+	if got := read2(conn); got != [2]byte{5, 2} {
+		t.Fatalf("greeting got %v, want [5 2]", got)
+	}
+	conn.Write(append(append([]byte{1, 5}, "alice"...), append([]byte{3}, "bad"...)...))
+	if got := read2(conn); got != [2]byte{1, 1} {
+		t.Errorf("bad credentials got %v, want [1 1]", got)
+	}
+}
+
+// TestSocksAuthBackendLoopbackOnly starts a client with credentials on a
+// wildcard BindAddress and checks that warp's unauthenticated listener is
+// only reachable on loopback, while the front-end is reachable everywhere.
+func TestSocksAuthBackendLoopbackOnly(t *testing.T) {
+	var lanIPs []net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+			lanIPs = append(lanIPs, n.IP)
+		}
+	}
+	if len(lanIPs) == 0 {
+		t.Skip("no non-loopback ipv4 address to dial from")
+	}
+
+	warpAddrs := make(chan string, 1)
+	orig := runWarp
+	runWarp = func(psiphonEnabled, gool, scan, verbose bool, country, bindAddress, endpoint, license string, ctx context.Context, rtt int) error {
+		ln, err := net.Listen("tcp", bindAddress)
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		warpAddrs <- bindAddress
+		<-ctx.Done()
+		return nil
+	}
+	defer func() { runWarp = orig }()
+
+	free, err := freeLoopbackAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(free)
+	cfg := NewConfig()
+	cfg.BindAddress = "0.0.0.0:" + port
+	cfg.Socks5User, cfg.Socks5Pass = "alice", "s3cret"
+	c := NewClient(cfg)
+	if err := c.Start(testDir(t), -1); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	var backend string
+	select {
+	case backend = <-warpAddrs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("warp was not started")
+	}
+	host, backendPort, _ := net.SplitHostPort(backend)
+	if host != "127.0.0.1" {
+		t.Fatalf("warp listens on %s, want loopback", backend)
+	}
+	if conn, err := net.DialTimeout("tcp", backend, time.Second); err != nil {
+		t.Errorf("backend not reachable on loopback: %v", err)
+	} else {
+		conn.Close()
+	}
+	for _, ip := range lanIPs {
+		if conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), backendPort), time.Second); err == nil {
+			conn.Close()
+			t.Errorf("backend reachable on %s", ip)
+		}
+		if conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), time.Second); err != nil {
+			t.Errorf("front-end not reachable on %s: %v", ip, err)
+		} else {
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package tun2socks
+
+import "tun2socks/lwip"
+
+// TunStack is the network stack runServer runs on top of the tun device. The
+// default wraps the lwip package; Client.SetTunStack plugs in another one,
+// e.g. for tests or platforms without the cgo lwip build.
+type TunStack interface {
+	Start(opts *lwip.Tun2socksStartOptions) error
+	Stop() error
+}
+
+// trafficCounter is implemented by TunStacks that count tun device traffic.
+type trafficCounter interface {
+	BytesTransferred() (rx, tx uint64)
+	PacketsTransferred() (rx, tx uint64)
+	ResetCounters()
+}
+
+// flowLister is implemented by TunStacks that track open connections.
+type flowLister interface {
+	Flows(limit int) []lwip.Flow
+}
+
+// router is implemented by TunStacks with split-tunnel rules.
+type router interface {
+	RoutingRules() lwip.Routes
+	UpdateRoutes(bypassCIDRs, routeCIDRs, bypassDomains, routeDomains []string) error
+}
+
+// pauser is implemented by TunStacks that can reject traffic while warp is
+// stopped without tearing the stack down.
+type pauser interface {
+	SetPaused(paused bool)
+}
+
+// SetTunStack makes the client run s on the tun device instead of the lwip
+// package; nil restores the default. It returns ErrAlreadyRunning while the
+// client is running.
+func (c *Client) SetTunStack(s TunStack) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.run != nil && !c.run.finished() {
+		return ErrAlreadyRunning
+	}
+	if s == nil {
+		s = lwipStack{}
+	}
+	c.stack = s
+	return nil
+}
+
+// lwipStack is the production TunStack.
+type lwipStack struct{}
+
+func (lwipStack) Start(opts *lwip.Tun2socksStartOptions) error {
+	return lwip.Start(opts)
+}
+
+func (lwipStack) Stop() error {
+	lwip.Stop()
+	return nil
+}
+
+func (lwipStack) BytesTransferred() (rx, tx uint64) {
+	return lwip.BytesTransferred()
+}
+
+func (lwipStack) PacketsTransferred() (rx, tx uint64) {
+	return lwip.PacketsTransferred()
+}
+
+func (lwipStack) ResetCounters() {
+	lwip.ResetCounters()
+}
+
+func (lwipStack) Flows(limit int) []lwip.Flow {
+	return lwip.Flows(limit)
+}
+
+func (lwipStack) RoutingRules() lwip.Routes {
+	return lwip.RoutingRules()
+}
+
+func (lwipStack) UpdateRoutes(bypassCIDRs, routeCIDRs, bypassDomains, routeDomains []string) error {
+	return lwip.UpdateRoutes(bypassCIDRs, routeCIDRs, bypassDomains, routeDomains)
+}
+
+func (lwipStack) SetPaused(paused bool) {
+	lwip.SetPaused(paused)
+}
@@ -0,0 +1,164 @@
+package tun2socks
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"tun2socks/lwip"
+)
+
+// MockTunStack is a TunStack that records its calls instead of touching a
+// tun device.
+type MockTunStack struct {
+	mu       sync.Mutex
+	started  []*lwip.Tun2socksStartOptions
+	stops    int
+	startErr error
+}
+
+func (m *MockTunStack) Start(opts *lwip.Tun2socksStartOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started = append(m.started, opts)
+	return m.startErr
+}
+
+func (m *MockTunStack) Stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stops++
+	return nil
+}
+
+func (m *MockTunStack) calls() (starts, stops int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.started), m.stops
+}
+
+// fakeWarp replaces runWarp for the rest of the test with one that stays up
+// until its context ends.
+func fakeWarp(t *testing.T) {
+	t.Helper()
+	orig := runWarp
+	runWarp = func(psiphonEnabled, gool, scan, verbose bool, country, bindAddress, endpoint, license string, ctx context.Context, rtt int) error {
+		<-ctx.Done()
+		return nil
+	}
+	t.Cleanup(func() { runWarp = orig })
+}
+
+// testDir returns a temporary directory for Start and restores the working
+// directory Start changes once the test ends.
+func testDir(t *testing.T) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return t.TempDir()
+}
+
+// testTunFd returns an open descriptor to stand in for a tun device.
+func testTunFd(t *testing.T) int {
+	t.Helper()
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pr.Close()
+		pw.Close()
+	})
+	return int(pr.Fd())
+}
+
+func waitConnected(t *testing.T, c *Client) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.WaitUntilConnected(ctx); err != nil {
+		t.Fatalf("WaitUntilConnected: %v", err)
+	}
+}
+
+func TestRunServerDrivesTunStack(t *testing.T) {
+	fakeWarp(t)
+	dir := testDir(t)
+	c := NewClient(NewConfig())
+	stack := &MockTunStack{}
+	if err := c.SetTunStack(stack); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(dir, testTunFd(t)); err != nil {
+		t.Fatal(err)
+	}
+	waitConnected(t, c)
+	if err := c.SetTunStack(nil); err != ErrAlreadyRunning {
+		t.Errorf("SetTunStack while running = %v, want ErrAlreadyRunning", err)
+	}
+
+	stack.mu.Lock()
+	opts := stack.started[0]
+	stack.mu.Unlock()
+	if opts.Socks5Server != "127.0.0.1:8086" {
+		t.Errorf("Socks5Server = %q, want 127.0.0.1:8086", opts.Socks5Server)
+	}
+	if opts.FakeIPRange != legacyFakeIPRange {
+		t.Errorf("FakeIPRange = %q, want %q", opts.FakeIPRange, legacyFakeIPRange)
+	}
+
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Wait(); err != nil {
+		t.Errorf("Wait = %v", err)
+	}
+	if starts, stops := stack.calls(); starts != 1 || stops != 1 {
+		t.Errorf("stack started %d and stopped %d times, want 1 and 1", starts, stops)
+	}
+}
+
+func TestRunServerProxyOnlySkipsTunStack(t *testing.T) {
+	fakeWarp(t)
+	dir := testDir(t)
+	c := NewClient(NewConfig())
+	stack := &MockTunStack{}
+	c.SetTunStack(stack)
+	if err := c.Start(dir, -1); err != nil {
+		t.Fatal(err)
+	}
+	waitConnected(t, c)
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if starts, stops := stack.calls(); starts != 0 || stops != 0 {
+		t.Errorf("stack started %d and stopped %d times, want 0 and 0", starts, stops)
+	}
+}
+
+func TestRunServerTunStackStartFails(t *testing.T) {
+	fakeWarp(t)
+	dir := testDir(t)
+	c := NewClient(NewConfig())
+	stack := &MockTunStack{startErr: os.ErrInvalid}
+	c.SetTunStack(stack)
+	if err := c.Start(dir, testTunFd(t)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Wait = nil, want the tun stack error")
+		}
+	case <-time.After(5 * time.Second):
+		c.Stop()
+		t.Fatal("run did not stop after the tun stack failed to start")
+	}
+}
@@ -0,0 +1,103 @@
+package tun2socks
+
+import "sync"
+
+// State is the connection state of a Client.
+type State int
+
+const (
+	StateIdle State = iota
+	StateConnecting
+	StateConnected
+	StateReconnecting
+	StateDisconnecting
+	StateDisconnected
+	StateError
+	StatePaused
+)
+
+const stateChannelSize = 16
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateDisconnecting:
+		return "disconnecting"
+	case StateDisconnected:
+		return "disconnected"
+	case StateError:
+		return "error"
+	case StatePaused:
+		return "paused"
+	default:
+		return "unknown"
+	}
+}
+
+// stateTracker holds the current state and publishes every transition.
+type stateTracker struct {
+	mu      sync.Mutex
+	state   State
+	lastErr error
+	changes chan State
+	// onChange, if set, is called with every transition while mu is held.
+	onChange func(State)
+}
+
+func newStateTracker() *stateTracker {
+	return &stateTracker{changes: make(chan State, stateChannelSize)}
+}
+
+func (t *stateTracker) get() State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// lastError returns the error recorded by the latest fail call.
+func (t *stateTracker) lastError() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastErr
+}
+
+// fail records err and moves to StateError.
+func (t *stateTracker) fail(err error) {
+	t.mu.Lock()
+	t.lastErr = err
+	t.mu.Unlock()
+	t.set(StateError)
+}
+
+// set moves to s and publishes it, dropping the oldest queued transition if
+// nobody is reading. Setting the current state again is a no-op.
+func (t *stateTracker) set(s State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == s {
+		return
+	}
+	t.state = s
+	events.stateChanged(s)
+	if t.onChange != nil {
+		t.onChange(s)
+	}
+	for {
+		select {
+		case t.changes <- s:
+			return
+		default:
+		}
+		select {
+		case <-t.changes:
+		default:
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package tun2socks
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// statsStaleAge is how old the last line of Config.StatsFile may be at
+	// Start before a warning says the tunnel may have been inactive.
+	statsStaleAge = 24 * time.Hour
+	// statsTailSize is how much of the end of the file is read to find it.
+	statsTailSize = 4 << 10
+)
+
+// handshakeRecord is a line of Config.StatsFile.
+type handshakeRecord struct {
+	TS          int64  `json:"ts"`
+	Endpoint    string `json:"endpoint"`
+	SessionID   string `json:"session_id"`
+	HandshakeMS int64  `json:"handshake_ms"`
+	RxBytes     int64  `json:"rx_bytes"`
+	TxBytes     int64  `json:"tx_bytes"`
+}
+
+// statsFile appends handshakeRecords as JSON lines. It writes unbuffered, so
+// every line reaches the file as soon as it is written.
+type statsFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openStatsFile(path string) (*statsFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &statsFile{f: f}, nil
+}
+
+func (s *statsFile) write(rec handshakeRecord) {
+	if s == nil {
+		return
+	}
+	b, _ := json.Marshal(rec)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return
+	}
+	if _, err := s.f.Write(append(b, '\n')); err != nil {
+		log.Println("Failed to write stats file:", err)
+	}
+}
+
+func (s *statsFile) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+}
+
+// warnStaleStats logs a warning when the last line of the stats file at path
+// is older than statsStaleAge. A missing or unreadable file is not reported.
+func warnStaleStats(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return
+	}
+	off := info.Size() - statsTailSize
+	if off < 0 {
+		off = 0
+	}
+	tail := make([]byte, info.Size()-off)
+	if _, err := f.ReadAt(tail, off); err != nil && err != io.EOF {
+		return
+	}
+	tail = bytes.TrimRight(tail, "\n")
+	if i := bytes.LastIndexByte(tail, '\n'); i >= 0 {
+		tail = tail[i+1:]
+	}
+	var rec handshakeRecord
+	if json.Unmarshal(tail, &rec) != nil || rec.TS == 0 {
+		return
+	}
+	if last := time.Unix(rec.TS, 0); time.Since(last) > statsStaleAge {
+		log.Printf("Warning: the last handshake in %s is from %s, the tunnel may have been inactive",
+			path, last.Format(time.RFC3339))
+	}
+}
+
+// recordHandshake notes that warp came up on endpoint, took after RunWarp
+// was called, and appends it to the stats file.
+func (c *Client) recordHandshake(r *run, endpoint string, took time.Duration) {
+	now := time.Now()
+	r.handshake.Store(now.UnixNano())
+	t := c.TrafficStats()
+	r.stats.write(handshakeRecord{
+		TS:          now.Unix(),
+		Endpoint:    endpoint,
+		SessionID:   c.SessionID(),
+		HandshakeMS: took.Milliseconds(),
+		RxBytes:     t.BytesReceived,
+		TxBytes:     t.BytesSent,
+	})
+}
+
+// LastHandshake returns when warp last came up in the latest run, or the
+// zero time if it has not. app.RunWarp reports no WireGuard handshakes, so
+// this is the first ping through the tunnel after each start of warp; rekeys
+// of a running session are not seen. The probe only runs with
+// Config.StatsFile set, on a cached endpoint or while a psiphon region is on
+// a timeout, so without those it stays zero.
+func (c *Client) LastHandshake() time.Time {
+	r := c.currentRun()
+	if r == nil {
+		return time.Time{}
+	}
+	if ns := r.handshake.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
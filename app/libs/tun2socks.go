@@ -1,183 +1,585 @@
 package tun2socks
 
 import (
-	"bufio"
 	"context"
-	"flag"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"os"
 	"os/signal"
-	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
-	"tun2socks/lwip"
+	"time"
 
-	"github.com/bepass-org/wireguard-go/app"
-	L "github.com/xjasonlyu/tun2socks/v2/log"
+	"tun2socks/lwip"
 )
 
-// Variables to hold flag values.
+// The package-level API drives a single default client for callers that only
+// ever run one stack.
 var (
-	verbose        *bool
-	bindAddress    *string
-	endpoint       *string
-	license        *string
-	country        *string
-	psiphonEnabled *bool
-	gool           *bool
-	scan           *bool
-	rtt            *int
-	logMessages    []string
-	mu             sync.Mutex
-	wg             sync.WaitGroup
-	cancelFunc     context.CancelFunc
+	defaultMu     sync.Mutex
+	defaultClient *Client
+	// shutdownTimeout bounds how long Shutdown waits; zero waits indefinitely.
+	shutdownTimeout time.Duration
+	// logBufferSize, when positive, is applied to every default client.
+	logBufferSize int
 )
 
-type logWriter struct{}
-
-func (writer logWriter) Write(bytes []byte) (int, error) {
-	mu.Lock()
-	defer mu.Unlock()
-	logMessages = append(logMessages, string(bytes))
-	return len(bytes), nil
+// RunWarp parses argStr as command-line flags and starts the warp stack.
+// It is kept for callers that still build a flag string; see RunWarpWithConfig.
+func RunWarp(argStr, path string, fd int) error {
+	cfg, err := ParseArgString(argStr)
+	if err != nil {
+		return err
+	}
+	return RunWarpWithConfig(cfg, path, fd)
 }
 
-func parseCommandLine(argStr string) ([]string, error) {
-	// Regular expression to match flags (like -b or --gool) and their optional values
-	re := regexp.MustCompile(`(--?\w+)([= ]("[^"]*"|'[^']*'|[^ ]+))?`)
-	matches := re.FindAllStringSubmatch(argStr, -1)
+// RunWarpWithConfig starts the warp stack described by cfg on the default
+// client and blocks until it is shut down. Invalid settings are reported as an
+// error before anything starts.
+func RunWarpWithConfig(cfg *Config, path string, fd int) error {
+	if cfg == nil {
+		return fmt.Errorf("config must not be nil")
+	}
+	c := NewClient(cfg)
+
+	defaultMu.Lock()
+	if logBufferSize > 0 {
+		c.SetLogBufferSize(logBufferSize)
+	}
+	if defaultClient != nil {
+		// Stop a previous run before replacing it.
+		defaultClient.Stop()
+	}
+	defaultClient = c
+	if err := c.Start(path, fd); err != nil {
+		defaultMu.Unlock()
+		return err
+	}
+	defaultMu.Unlock()
+
+	// Wait for interrupt signal.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
 
-	var args []string
-	for _, match := range matches {
-		args = append(args, match[1]) // Flag name
-		if match[3] != "" {
-			// Remove surrounding quotes if present
-			value := strings.Trim(match[3], `"'`)
-			args = append(args, value) // Flag value
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-sigCh:
+			// Received an interrupt signal, shut down.
+			log.Println("Shutting down server...")
+			c.Stop()
+		case <-stopped:
+			// Stopped, perhaps from another part of the app calling Shutdown().
 		}
+	}()
+
+	return c.Wait()
+}
+
+func currentClient() *Client {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	return defaultClient
+}
+
+// SetShutdownTimeout sets how long Shutdown waits for the server to exit, in
+// milliseconds. Zero or less waits indefinitely.
+func SetShutdownTimeout(millis int) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	shutdownTimeout = time.Duration(millis) * time.Millisecond
+}
+
+// Shutdown can be called to stop the server from another part of the app.
+// It returns once runServer has exited or the timeout set with
+// SetShutdownTimeout elapses. It is a no-op when nothing is running and safe
+// to call concurrently.
+func Shutdown() error {
+	defaultMu.Lock()
+	d := shutdownTimeout
+	defaultMu.Unlock()
+	return ShutdownWithTimeout(d)
+}
+
+// ShutdownWithTimeout is like Shutdown but gives up waiting after d and returns
+// ErrShutdownTimeout. A non-positive d waits indefinitely.
+func ShutdownWithTimeout(d time.Duration) error {
+	c := currentClient()
+	if c == nil {
+		return nil
 	}
-	return args, nil
+	return c.StopWithTimeout(d)
 }
 
-func RunWarp(argStr, path string, fd int) {
-	logger := logWriter{}
-	log.SetOutput(logger)
-	r, w, _ := os.Pipe()
-	os.Stdout = w
-	os.Stderr = w
+// Reconfigure applies cfg to the default client, restarting only the warp
+// layer if it is running. See Client.Reconfigure.
+func Reconfigure(cfg *Config) error {
+	c := currentClient()
+	if c == nil {
+		return errors.New("not running")
+	}
+	return c.Reconfigure(cfg)
+}
 
-	L.SetLevel(L.DebugLevel)
-	L.SetOutput(logger)
+// UpdateTunFd moves the default client to a new tun fd without restarting
+// warp. See Client.UpdateTunFd.
+func UpdateTunFd(fd int) error {
+	c := currentClient()
+	if c == nil {
+		return ErrNotRunning
+	}
+	return c.UpdateTunFd(fd)
+}
 
-	go func(reader io.Reader) {
-		scanner := bufio.NewScanner(reader)
-		for scanner.Scan() {
-			logger.Write([]byte(scanner.Text()))
-		}
-		if err := scanner.Err(); err != nil {
-			fmt.Fprintln(os.Stderr, "There was an error with the scanner", err)
-		}
-	}(r)
-	if err := os.Chdir(path); err != nil {
-		log.Fatal("Error changing to 'main' directory:", err)
+// NotifyNetworkChanged tells the default client that the default network
+// changed so warp reconnects right away. See Client.NetworkChanged.
+func NotifyNetworkChanged() {
+	if c := currentClient(); c != nil {
+		c.NetworkChanged()
 	}
-	// Parse command-line arguments.
-	args, err := parseCommandLine(argStr)
-	if err != nil {
-		log.Fatal(err)
-	}
-	fs := flag.NewFlagSet("tun2socks", flag.ExitOnError)
-	verbose = fs.Bool("v", false, "verbose")
-	bindAddress = fs.String("b", "127.0.0.1:8086", "socks bind address")
-	endpoint = fs.String("e", "notset", "warp clean ip")
-	license = fs.String("k", "notset", "license key")
-	country = fs.String("country", "", "psiphon country code in ISO 3166-1 alpha-2 format")
-	psiphonEnabled = fs.Bool("cfon", false, "enable psiphonEnabled over warp")
-	gool = fs.Bool("gool", false, "enable warp gooling")
-	scan = fs.Bool("scan", false, "enable warp scanner(experimental)")
-	rtt = flag.Int("rtt", 1000, "scanner rtt threshold, default 1000")
-
-	err = fs.Parse(args)
-	if err != nil {
-		log.Fatalf("Failed to parse flags: %v", err)
+}
+
+// NotifyNetworkLost tells the default client that there is no network. See
+// Client.NetworkLost.
+func NotifyNetworkLost() {
+	if c := currentClient(); c != nil {
+		c.NetworkLost()
 	}
+}
 
-	// Setup context with cancellation.
-	ctx, cancel := context.WithCancel(context.Background())
-	cancelFunc = cancel
-	wg.Add(1)
+// Pause stops warp on the default client while keeping the tun device up. See
+// Client.Pause.
+func Pause() error {
+	c := currentClient()
+	if c == nil {
+		return ErrNotRunning
+	}
+	return c.Pause()
+}
 
-	// Start your long-running process.
-	go runServer(ctx, fd)
+// Resume restarts warp on the default client after Pause.
+func Resume() error {
+	c := currentClient()
+	if c == nil {
+		return ErrNotRunning
+	}
+	return c.Resume()
+}
 
-	// Wait for interrupt signal.
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+// Stop cancels the running stack and blocks until runServer, lwip and the warp
+// goroutine have all exited, so the caller can safely close the tun fd. It
+// returns ErrShutdownTimeout if that takes longer than timeoutMillis; zero or
+// less waits indefinitely. Captured logs remain readable afterwards.
+func Stop(timeoutMillis int) error {
+	return ShutdownWithTimeout(time.Duration(timeoutMillis) * time.Millisecond)
+}
 
-	select {
-	case <-sigCh:
-		// Received an interrupt signal, shut down.
-		log.Println("Shutting down server...")
-		cancelFunc()
-	case <-ctx.Done():
-		// Context was cancelled, perhaps from another part of the app calling Shutdown().
+// GetState returns the state of the default client, e.g. "connecting" or
+// "connected". It is "idle" before the first run.
+func GetState() string {
+	c := currentClient()
+	if c == nil {
+		return StateIdle.String()
 	}
+	return c.State().String()
+}
 
-	// Wait for the server goroutine to finish.
-	wg.Wait()
-	log.Println("Server shut down gracefully.")
+// GetRetryAttempt returns the default client's latest warp retry attempt,
+// to show alongside the "reconnecting" state. See Client.RetryAttempt.
+func GetRetryAttempt() int {
+	c := currentClient()
+	if c == nil {
+		return 0
+	}
+	return c.RetryAttempt()
 }
 
-func runServer(ctx context.Context, fd int) {
-	// Ensuring a cleanup operation even in the case of an error
-	defer func() {
-		// Perform cleanup and exit.
-		lwip.Stop()
-		log.Println("Cleanup done, exiting runServer goroutine.")
+// GetActiveEndpoint returns the WireGuard endpoint the default client's warp
+// is running on, empty when it is not known.
+func GetActiveEndpoint() string {
+	c := currentClient()
+	if c == nil {
+		return ""
+	}
+	return c.ActiveEndpoint()
+}
 
-		defer wg.Done()
-	}()
+// GetPsiphonRegions returns the countries psiphon can exit in, for -country,
+// as a JSON array of {"code", "name"} objects in code order.
+func GetPsiphonRegions() string {
+	type region struct {
+		Code string `json:"code"`
+		Name string `json:"name"`
+	}
+	list := make([]region, len(psiphonRegions))
+	for i, code := range psiphonRegions {
+		list[i] = region{Code: code, Name: countries[code]}
+	}
+	b, _ := json.Marshal(list)
+	return string(b)
+}
 
-	// Start wireguard-go and gvisor-tun2socks.
-	go func() {
-		err := app.RunWarp(*psiphonEnabled, *gool, *scan, *verbose, *country, *bindAddress, *endpoint, *license, ctx, *rtt)
-		if err != nil {
-			log.Println(err)
+// GetPsiphonRegion returns the country the default client's psiphon exits
+// in, or "" when psiphon is off or the client is not running.
+func GetPsiphonRegion() string {
+	c := currentClient()
+	if c == nil {
+		return ""
+	}
+	return c.PsiphonRegion()
+}
+
+// GetCurrentLicense returns the license key the default client's warp is
+// using, redacted to its last four characters, or "" on the free tier. See
+// Client.CurrentLicense.
+func GetCurrentLicense() string {
+	c := currentClient()
+	if c == nil {
+		return ""
+	}
+	return c.CurrentLicense()
+}
+
+// GetLastError returns the message of the error that moved the default client
+// to the "error" state, or an empty string.
+func GetLastError() string {
+	c := currentClient()
+	if c == nil {
+		return ""
+	}
+	if err := c.LastError(); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// WaitUntilConnected blocks until the default client is connected, it stops,
+// or timeoutMillis passes (zero or less waits indefinitely).
+func WaitUntilConnected(timeoutMillis int) error {
+	c := currentClient()
+	if c == nil {
+		return ErrNotConnected
+	}
+	ctx := context.Background()
+	if timeoutMillis > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutMillis)*time.Millisecond)
+		defer cancel()
+	}
+	return c.WaitUntilConnected(ctx)
+}
+
+// GetSessionID returns the ID of the default client's latest run, or an empty
+// string before the first run.
+func GetSessionID() string {
+	c := currentClient()
+	if c == nil {
+		return ""
+	}
+	return c.SessionID()
+}
+
+// IsRunning reports whether the default client is running.
+func IsRunning() bool {
+	c := currentClient()
+	return c != nil && c.IsRunning()
+}
+
+// IsLanAllowed reports whether the default client lets LAN traffic bypass the
+// tunnel. Before the first run it returns the default, true.
+func IsLanAllowed() bool {
+	c := currentClient()
+	if c == nil {
+		return NewConfig().AllowLan
+	}
+	return c.AllowLan()
+}
+
+// GetLanRanges returns the comma-separated CIDRs considered LAN traffic.
+func GetLanRanges() string {
+	return strings.Join(lanRanges, ",")
+}
+
+const defaultConnectivityTimeoutMillis = 15000
+
+// TestConnectivity checks the default client's tunnel through the local SOCKS5
+// proxy in three stages, dns, tcp and http, and returns a JSON object
+// {ok, failedStage, stages: [{name, ok, latencyMillis, error}]}. The whole
+// test is bounded by timeoutMillis (15 seconds when zero or less).
+func TestConnectivity(timeoutMillis int) string {
+	if timeoutMillis <= 0 {
+		timeoutMillis = defaultConnectivityTimeoutMillis
+	}
+	res := ConnectivityResult{FailedStage: "dns", Stages: []ConnectivityStage{}}
+	if c := currentClient(); c != nil && c.IsRunning() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMillis)*time.Millisecond)
+		defer cancel()
+		res = c.TestConnectivity(ctx)
+	} else {
+		res.Stages = append(res.Stages, ConnectivityStage{Name: "dns", Error: ErrNotRunning.Error()})
+	}
+	b, _ := json.Marshal(res)
+	return string(b)
+}
+
+// GetScanResults returns the endpoints found by the default client's latest
+// scan as a JSON array of {endpoint, rttMillis}, fastest first, or an empty
+// array before the first scan. rttMillis is zero when no echo was answered;
+// those endpoints come last, in the order the scanner reported them. The
+// endpoint a run picked is also logged as
+// "[scanner] Scan selected endpoint: host:port".
+func GetScanResults() string {
+	var results []EndpointResult
+	if c := currentClient(); c != nil {
+		results = c.ScanResults()
+	}
+	return scanResultsJSON(results)
+}
+
+// InvalidateEndpointCache forgets the endpoint the default client's last scan
+// picked, so the next start with -scan scans again. It has no effect before
+// the first start in this process.
+func InvalidateEndpointCache() error {
+	if c := currentClient(); c != nil {
+		return c.InvalidateEndpointCache()
+	}
+	return nil
+}
+
+// SetLogBufferSize sets how many lines GetLogMessages keeps between calls
+// (default 4096, also restored by zero or less). Older lines are dropped once
+// the limit is reached.
+func SetLogBufferSize(n int) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	logBufferSize = n
+	if defaultClient != nil {
+		defaultClient.SetLogBufferSize(n)
+	}
+}
+
+// GetStats returns the default client's tun traffic counters as a JSON object
+// with bytesSent, bytesReceived, packetsSent, packetsReceived and
+// uptimeSeconds. It is cheap enough to poll once per second.
+func GetStats() string {
+	var s TrafficStats
+	if c := currentClient(); c != nil {
+		s = c.TrafficStats()
+	}
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// defaultConnectionLimit caps GetConnections when no limit is given.
+const defaultConnectionLimit = 100
+
+// GetConnections returns the open flows of the default client as a JSON array
+// of {protocol, source, destination, host, bytesIn, bytesOut, ageSeconds},
+// oldest first and at most limit entries (100 when limit is zero or less).
+func GetConnections(limit int) string {
+	if limit <= 0 {
+		limit = defaultConnectionLimit
+	}
+	conns := []Connection{}
+	if c := currentClient(); c != nil {
+		if cs := c.Connections(limit); cs != nil {
+			conns = cs
 		}
-	}()
+	}
+	b, _ := json.Marshal(conns)
+	return string(b)
+}
 
-	tun2socksStartOptions := &lwip.Tun2socksStartOptions{
-		TunFd:        fd,
-		Socks5Server: strings.Replace(*bindAddress, "0.0.0.0", "127.0.0.1", -1),
-		FakeIPRange:  "24.0.0.0/8",
-		MTU:          0,
-		EnableIPv6:   true,
-		AllowLan:     true,
+// SetExcludedUids takes a comma-separated list of app UIDs, e.g.
+// "10123,10456", whose new flows through the tun device are connected to
+// directly instead of through warp. It is for setups where VpnService app
+// exclusion does not apply, e.g. routing by UID on rooted devices. An empty
+// string tunnels every app again. The owner of a flow is asked of the
+// resolver set with RegisterConnectionOwnerResolver, then looked up in
+// /proc/net; flows whose owner cannot be found are tunneled.
+func SetExcludedUids(uids string) error {
+	var list []int
+	for _, f := range strings.Split(uids, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		uid, err := strconv.Atoi(f)
+		if err != nil || uid < 0 {
+			return fmt.Errorf("invalid uid %q", f)
+		}
+		list = append(list, uid)
 	}
-	lwip.Start(tun2socksStartOptions)
+	lwip.SetExcludedUIDs(list)
+	if len(list) > 0 {
+		log.Println("Excluding apps from warp by uid:", uids)
+	}
+	return nil
+}
 
-	// Wait for context cancellation.
-	<-ctx.Done()
+// ConnectionOwnerResolver finds the app that owns a flow, like Android's
+// ConnectivityManager.getConnectionOwnerUid. It is meant to be implemented on
+// the host side through gomobile.
+type ConnectionOwnerResolver interface {
+	// GetConnectionOwnerUid returns the uid owning the socket from the local
+	// to the remote address, or -1 if it is not known. protocol is 6 for TCP
+	// and 17 for UDP, as in OsConstants.IPPROTO_TCP and IPPROTO_UDP.
+	GetConnectionOwnerUid(protocol int, localIP string, localPort int, remoteIP string, remotePort int) int
 }
 
-// Shutdown can be called to stop the server from another part of the app.
-func Shutdown() {
-	if cancelFunc != nil {
-		cancelFunc()
-		os.Exit(0)
+// RegisterConnectionOwnerResolver sets the resolver SetExcludedUids asks for
+// the owner of each new flow before it falls back to /proc/net, which apps
+// cannot read on Android 10 and later; nil removes it.
+func RegisterConnectionOwnerResolver(r ConnectionOwnerResolver) {
+	if r == nil {
+		lwip.SetConnectionOwnerLookup(nil)
+		return
+	}
+	lwip.SetConnectionOwnerLookup(func(proto string, src, dst net.Addr) (int, bool) {
+		protocol := syscall.IPPROTO_TCP
+		if proto == "udp" {
+			protocol = syscall.IPPROTO_UDP
+		}
+		srcIP, srcPort := splitNetAddr(src)
+		dstIP, dstPort := splitNetAddr(dst)
+		uid := r.GetConnectionOwnerUid(protocol, srcIP, srcPort, dstIP, dstPort)
+		return uid, uid >= 0
+	})
+}
+
+// splitNetAddr returns the IP and port of a TCP or UDP address.
+func splitNetAddr(a net.Addr) (string, int) {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP.String(), a.Port
+	case *net.UDPAddr:
+		return a.IP.String(), a.Port
+	}
+	return "", 0
+}
+
+// SocketProtector keeps a socket from being routed into the tun device, like
+// Android's VpnService.protect. It is meant to be implemented on the host
+// side through gomobile.
+type SocketProtector interface {
+	Protect(fd int) bool
+}
+
+// RegisterSocketProtector sets the protector for the sockets this library
+// opens to the outside: the direct connections of bypassed flows and excluded
+// apps, and webhook deliveries; nil removes it. A dial whose socket it refuses
+// is logged and fails. It does not make a full-route VPN work on its own:
+// the WireGuard UDP socket, the scanner probes and the API calls of
+// app.RunWarp are created inside the wireguard layer, which offers no hook,
+// and are not protected, so the app must still be excluded from the VPN, or
+// the warp endpoint routed outside it. Start logs a warning saying so once.
+func RegisterSocketProtector(p SocketProtector) {
+	if p == nil {
+		lwip.SetSocketProtector(nil)
+		return
 	}
+	lwip.SetSocketProtector(p.Protect)
 }
 
+// BindToNetwork binds the sockets this library opens to the outside to the
+// Android network with the given handle, as Network.getNetworkHandle returns
+// it, e.g. to keep them on cellular while Wi-Fi is captive; 0 unbinds them.
+// The default client's warp is restarted, as with NetworkChanged, so its
+// session is set up again on the new network. Like Config.OutInterface, which
+// it takes precedence over, it does not reach the sockets app.RunWarp opens,
+// so the WireGuard transport, the scanner and the API calls stay on the
+// default network; to move them, bind the whole process with
+// ConnectivityManager.bindProcessToNetwork instead.
+func BindToNetwork(handle int64) {
+	lwip.SetOutboundNetwork(handle)
+	if handle != 0 {
+		log.Printf("Binding direct flows and webhooks to network %d; warp's WireGuard, scanner and API sockets are not bound", handle)
+	} else {
+		log.Println("Outbound sockets unbound from the network")
+	}
+	if c := currentClient(); c != nil {
+		c.NetworkChanged()
+	}
+}
+
+// GetRoutingRules returns the split-tunnel rules of the default client's tun
+// stack as a JSON object {"domains": [{domain, action}], "rules": [{cidr,
+// action}], "domainDefault": action, "default": action}, with action
+// "direct" or "tunnel" and the rules in the order they apply. See
+// RoutingTable.
+func GetRoutingRules() string {
+	t := emptyRoutingTable()
+	if c := currentClient(); c != nil {
+		t = c.RoutingRules()
+	}
+	b, _ := json.Marshal(t)
+	return string(b)
+}
+
+// ReloadRoutingRules re-reads routing-rules.txt under the path given to Start
+// and applies it to the default client. See Client.ReloadRoutingRules.
+func ReloadRoutingRules() error {
+	c := currentClient()
+	if c == nil {
+		return ErrNotRunning
+	}
+	return c.ReloadRoutingRules()
+}
+
+// ResetStats sets the default client's traffic counters back to zero.
+func ResetStats() {
+	if c := currentClient(); c != nil {
+		c.ResetStats()
+	}
+}
+
+// GetLogMessages returns the log lines captured since the previous call,
+// separated by newlines. It is a polling fallback; Go callers can use
+// Client.LogCh instead. Each line has the stable form
+//
+//	2006-01-02T15:04:05.000Z07:00 [session:id] [source] message
+//
+// with an RFC 3339 millisecond timestamp, the ID of the run (see
+// GetSessionID) and a source of app (standard logger), t2s (tun2socks),
+// stdout or stderr. After SetLogFormat("json") the result is instead a JSON
+// array of {ts, level, source, msg, session} objects. If lines were
+// dropped because the buffer was full, the result starts with a
+// "... N lines dropped ..." line.
 func GetLogMessages() string {
-	mu.Lock()
-	defer mu.Unlock()
-	if len(logMessages) == 0 {
+	c := currentClient()
+	if c == nil {
 		return ""
 	}
-	logs := strings.Join(logMessages, "\n")
-	logMessages = nil // Clear logMessages for better memory management
-	return logs
+	return c.Logs()
+}
+
+// GetLogMessagesByLevel returns the buffered lines at least as severe as level
+// ("error", "warn", "info" or "debug", case-insensitive), formatted like
+// GetLogMessages. Unlike GetLogMessages it leaves the buffer untouched.
+func GetLogMessagesByLevel(level string) string {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return ""
+	}
+	c := currentClient()
+	if c == nil {
+		return ""
+	}
+	return c.logs.filter(lvl)
+}
+
+// GetLogCount returns how many lines GetLogMessages would currently return.
+func GetLogCount() int {
+	c := currentClient()
+	if c == nil {
+		return 0
+	}
+	return c.logs.count()
 }
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package tun2socks
+
+import "errors"
+
+// validateTunFd has nothing to check where there is no fstat.
+func validateTunFd(fd int) error {
+	return nil
+}
+
+// dupTunFd has no dup to call.
+func dupTunFd(fd int) (int, error) {
+	return -1, errors.New("not supported on this platform")
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package tun2socks
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+)
+
+// validateTunFd checks that fd is open before it reaches lwip, which fails
+// deep in C code on a bad descriptor. A tun device is a character device, so
+// anything else only gets a warning.
+func validateTunFd(fd int) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("%w: fd %d: %v", ErrInvalidTunFd, fd, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR {
+		log.Printf("Warning: tun fd %d is not a character device (mode %#o)", fd, st.Mode)
+	}
+	return nil
+}
+
+// dupTunFd duplicates fd with close-on-exec set.
+func dupTunFd(fd int) (int, error) {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	d, err := syscall.Dup(fd)
+	if err != nil {
+		return -1, err
+	}
+	syscall.CloseOnExec(d)
+	return d, nil
+}
@@ -0,0 +1,133 @@
+//go:build unix
+
+package tun2socks
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+// startedTunFd returns the fd the tun stack was last started with.
+func startedTunFd(t *testing.T, stack *MockTunStack) int {
+	t.Helper()
+	stack.mu.Lock()
+	defer stack.mu.Unlock()
+	if len(stack.started) == 0 {
+		t.Fatal("tun stack not started")
+	}
+	return stack.started[len(stack.started)-1].TunFd
+}
+
+// checkTunFdCarries writes through pw and expects to read it back on fd.
+func checkTunFdCarries(t *testing.T, fd int, pw *os.File) {
+	t.Helper()
+	if err := validateTunFd(fd); err != nil {
+		t.Fatalf("tun stack fd: %v", err)
+	}
+	want := []byte("packet")
+	if _, err := pw.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	// Reading through a dup of fd keeps fd itself open for the stack.
+	d, err := dupTunFd(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(d), "tun")
+	defer f.Close()
+	if _, err := io.ReadFull(f, got); err != nil {
+		t.Fatalf("reading the tun stack fd: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
+
+func TestStartSurvivesClosedTunFd(t *testing.T) {
+	fakeWarp(t)
+	dir := testDir(t)
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.Close()
+	orig := int(pr.Fd())
+
+	c := NewClient(NewConfig())
+	stack := &MockTunStack{}
+	c.SetTunStack(stack)
+	if err := c.Start(dir, orig); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	waitConnected(t, c)
+
+	fd := startedTunFd(t, stack)
+	// The mock does not own the fd the way lwip does.
+	defer os.NewFile(uintptr(fd), "tun").Close()
+	if fd == orig {
+		t.Fatalf("tun stack got the caller's fd %d, want a duplicate", orig)
+	}
+	// The caller drops its copy, as when Android collects the
+	// ParcelFileDescriptor.
+	pr.Close()
+	checkTunFdCarries(t, fd, pw)
+
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Wait(); err != nil {
+		t.Errorf("Wait = %v", err)
+	}
+}
+
+func TestUpdateTunFdSurvivesClosedTunFd(t *testing.T) {
+	fakeWarp(t)
+	dir := testDir(t)
+	c := NewClient(NewConfig())
+	stack := &MockTunStack{}
+	c.SetTunStack(stack)
+	if err := c.Start(dir, -1); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	waitConnected(t, c)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.Close()
+	orig := int(pr.Fd())
+	if err := c.UpdateTunFd(orig); err != nil {
+		t.Fatal(err)
+	}
+	fd := startedTunFd(t, stack)
+	defer os.NewFile(uintptr(fd), "tun").Close()
+	if fd == orig {
+		t.Fatalf("tun stack got the caller's fd %d, want a duplicate", orig)
+	}
+	pr.Close()
+	checkTunFdCarries(t, fd, pw)
+}
+
+func TestStartWithoutDupFd(t *testing.T) {
+	fakeWarp(t)
+	dir := testDir(t)
+	cfg := NewConfig()
+	cfg.DupFd = false
+	c := NewClient(cfg)
+	stack := &MockTunStack{}
+	c.SetTunStack(stack)
+	orig := testTunFd(t)
+	if err := c.Start(dir, orig); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	waitConnected(t, c)
+	if fd := startedTunFd(t, stack); fd != orig {
+		t.Errorf("tun stack got fd %d, want the caller's fd %d", fd, orig)
+	}
+}
@@ -0,0 +1,70 @@
+package tun2socks
+
+import (
+	"log"
+	"time"
+)
+
+const watchdogInterval = time.Second
+
+// watchIdle restarts warp when the tun counters have not moved for
+// Config.IdleTimeoutSecs while connected, since a dead WireGuard session does
+// not make RunWarp return. It reads the timeout on every tick, so Reconfigure
+// can change it, and does nothing in proxy-only mode where the counters never
+// move. It returns when r's context is done.
+func (c *Client) watchIdle(r *run) {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	var lastRx, lastTx uint64
+	lastChange := time.Now()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		tc, ok := c.stack.(trafficCounter)
+		if !ok {
+			return
+		}
+		rx, tx := tc.BytesTransferred()
+		if rx != lastRx || tx != lastTx {
+			lastRx, lastTx, lastChange = rx, tx, time.Now()
+			continue
+		}
+
+		if c.State() != StateConnected {
+			// Only count idle time while connected.
+			lastChange = time.Now()
+			continue
+		}
+		c.mu.Lock()
+		timeout := time.Duration(c.cfg.IdleTimeoutSecs) * time.Second
+		tun := r.fd >= 0
+		c.mu.Unlock()
+		idle := time.Since(lastChange)
+		if timeout <= 0 || !tun || idle < timeout {
+			continue
+		}
+		log.Printf("Warning: no tun traffic for %v, restarting warp", idle.Round(time.Second))
+		c.state.set(StateReconnecting)
+		if c.restartWarp(r) {
+			c.state.set(StateConnected)
+		}
+		lastChange = time.Now()
+	}
+}
+
+// restartWarp stops and starts the warp layer of r, leaving the tun stack
+// up. It reports false when r is no longer the active run or is paused.
+func (c *Client) restartWarp(r *run) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.run != r || r.finished() || r.closing || r.paused {
+		return false
+	}
+	r.warpCancel()
+	<-r.warpDone
+	c.startWarpLocked(r)
+	return true
+}
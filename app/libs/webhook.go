@@ -0,0 +1,99 @@
+package tun2socks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"tun2socks/lwip"
+)
+
+const webhookTimeout = 5 * time.Second
+
+// webhook posts state transitions to Config.WebhookURL.
+type webhook struct {
+	url     string
+	secret  string
+	session string
+	client  *http.Client
+}
+
+func newWebhook(cfg *Config, session string) *webhook {
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+	return &webhook{
+		url:     cfg.WebhookURL,
+		secret:  cfg.WebhookSecret,
+		session: session,
+		client: &http.Client{
+			Timeout: webhookTimeout,
+			// Deliveries must not wait on the tunnel they report on.
+			Transport: &http.Transport{
+				Proxy:       http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{Control: lwip.ControlSocket}).DialContext,
+			},
+		},
+	}
+}
+
+// notify posts s in the background if it is one of the reported events.
+func (w *webhook) notify(s State) {
+	switch s {
+	case StateConnected, StateDisconnected, StateReconnecting:
+	default:
+		return
+	}
+	body, _ := json.Marshal(struct {
+		Event   string `json:"event"`
+		Session string `json:"session"`
+		TS      int64  `json:"ts"`
+	}{s.String(), w.session, time.Now().Unix()})
+	go func() {
+		err := w.post(body)
+		if err != nil {
+			// One retry; deliveries are best effort.
+			err = w.post(body)
+		}
+		if err != nil {
+			log.Printf("Webhook %s event failed: %v", s, err)
+		}
+	}()
+}
+
+func (w *webhook) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.secret != "" {
+		req.Header.Set("X-Oblivion-Signature", signWebhook(w.secret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of body keyed by secret.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,152 @@
+package tun2socks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type webhookDelivery struct {
+	body      []byte
+	signature string
+}
+
+// startWebhookServer records every delivery and answers the first fail of
+// them with 500.
+func startWebhookServer(t *testing.T, fail int) (*httptest.Server, <-chan webhookDelivery, *atomic.Int32) {
+	t.Helper()
+	deliveries := make(chan webhookDelivery, 8)
+	var n atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if n.Add(1) <= int32(fail) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		deliveries <- webhookDelivery{body, r.Header.Get("X-Oblivion-Signature")}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, deliveries, &n
+}
+
+func recvDelivery(t *testing.T, deliveries <-chan webhookDelivery) webhookDelivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook delivery")
+		return webhookDelivery{}
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// The HMAC-SHA256 example from Wikipedia.
+	got := signWebhook("key", []byte("The quick brown fox jumps over the lazy dog"))
+	if want := "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"; got != want {
+		t.Errorf("signWebhook = %s, want %s", got, want)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	srv, deliveries, _ := startWebhookServer(t, 0)
+	cfg := NewConfig()
+	cfg.WebhookURL, cfg.WebhookSecret = srv.URL, "s3cret"
+	newWebhook(cfg, "session-1").notify(StateConnected)
+
+	d := recvDelivery(t, deliveries)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(d.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); d.signature != want {
+		t.Errorf("X-Oblivion-Signature = %q, want %q", d.signature, want)
+	}
+	var event struct {
+		Event   string `json:"event"`
+		Session string `json:"session"`
+		TS      int64  `json:"ts"`
+	}
+	if err := json.Unmarshal(d.body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Event != StateConnected.String() || event.Session != "session-1" || event.TS == 0 {
+		t.Errorf("delivered %s", d.body)
+	}
+
+	// Without a secret the header is left out.
+	cfg.WebhookSecret = ""
+	newWebhook(cfg, "session-1").notify(StateDisconnected)
+	if d := recvDelivery(t, deliveries); d.signature != "" {
+		t.Errorf("unsigned delivery has X-Oblivion-Signature %q", d.signature)
+	}
+}
+
+func TestWebhookRetriesOnce(t *testing.T) {
+	srv, deliveries, _ := startWebhookServer(t, 1)
+	cfg := NewConfig()
+	cfg.WebhookURL = srv.URL
+	newWebhook(cfg, "s").notify(StateReconnecting)
+	first, second := recvDelivery(t, deliveries), recvDelivery(t, deliveries)
+	if string(first.body) != string(second.body) {
+		t.Errorf("retry posted %s, first attempt %s", second.body, first.body)
+	}
+
+	logs := captureLog(t)
+	srv, deliveries, n := startWebhookServer(t, 100)
+	cfg.WebhookURL = srv.URL
+	newWebhook(cfg, "s").notify(StateDisconnected)
+	recvDelivery(t, deliveries)
+	recvDelivery(t, deliveries)
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "event failed") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), "event failed") {
+		t.Errorf("failed delivery not logged: %q", logs)
+	}
+	if got := n.Load(); got != 2 {
+		t.Errorf("%d attempts for a failing webhook, want 2", got)
+	}
+}
+
+func TestWebhookSkipsOtherStates(t *testing.T) {
+	srv, deliveries, _ := startWebhookServer(t, 0)
+	cfg := NewConfig()
+	cfg.WebhookURL = srv.URL
+	w := newWebhook(cfg, "s")
+	w.notify(StateConnecting)
+	w.notify(StateConnected)
+	var event struct {
+		Event string `json:"event"`
+	}
+	json.Unmarshal(recvDelivery(t, deliveries).body, &event)
+	if event.Event != StateConnected.String() {
+		t.Errorf("first delivery is %q, want only %s to be reported", event.Event, StateConnected)
+	}
+}
+
+func TestWebhookEmptyURL(t *testing.T) {
+	if w := newWebhook(NewConfig(), "s"); w != nil {
+		t.Errorf("newWebhook without a url = %+v, want nil", w)
+	}
+
+	fakeWarp(t)
+	c := NewClient(NewConfig())
+	c.SetTunStack(&MockTunStack{})
+	if err := c.Start(testDir(t), -1); err != nil {
+		t.Fatal(err)
+	}
+	waitConnected(t, c)
+	if w := c.webhook.Load(); w != nil {
+		t.Errorf("client without a webhook url has webhook %+v", w)
+	}
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
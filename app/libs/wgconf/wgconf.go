@@ -0,0 +1,198 @@
+// Package wgconf parses WireGuard configuration files in the wg-quick
+// (wg0.conf) format.
+package wgconf
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// KeyLen is the length of a decoded WireGuard key.
+const KeyLen = 32
+
+// Interface is the [Interface] section.
+type Interface struct {
+	PrivateKey string
+	Address    []string
+	DNS        []string
+	ListenPort int
+	MTU        int
+}
+
+// Peer is one [Peer] section.
+type Peer struct {
+	PublicKey           string
+	PresharedKey        string
+	Endpoint            string
+	AllowedIPs          []string
+	PersistentKeepalive int
+}
+
+// WGConfig is a parsed configuration file.
+type WGConfig struct {
+	Interface Interface
+	Peers     []Peer
+}
+
+// Parse reads a configuration from r. Section and key names are
+// case-insensitive, lines starting with # or ; are comments, and list values
+// are comma-separated. Unknown keys, such as wg-quick's PostUp, are ignored.
+func Parse(r io.Reader) (WGConfig, error) {
+	var (
+		cfg     WGConfig
+		section string
+		haveIf  bool
+		lineNo  int
+	)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return WGConfig{}, fmt.Errorf("line %d: malformed section header %q", lineNo, line)
+			}
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+				if haveIf {
+					return WGConfig{}, fmt.Errorf("line %d: duplicate [Interface] section", lineNo)
+				}
+				haveIf = true
+			case "peer":
+				cfg.Peers = append(cfg.Peers, Peer{})
+			default:
+				return WGConfig{}, fmt.Errorf("line %d: unknown section [%s]", lineNo, section)
+			}
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return WGConfig{}, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:eq]))
+		value := strings.TrimSpace(line[eq+1:])
+		var err error
+		switch section {
+		case "interface":
+			err = cfg.Interface.set(key, value)
+		case "peer":
+			err = cfg.Peers[len(cfg.Peers)-1].set(key, value)
+		default:
+			err = fmt.Errorf("%q outside of a section", key)
+		}
+		if err != nil {
+			return WGConfig{}, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return WGConfig{}, err
+	}
+
+	if !haveIf {
+		return WGConfig{}, fmt.Errorf("missing [Interface] section")
+	}
+	if cfg.Interface.PrivateKey == "" {
+		return WGConfig{}, fmt.Errorf("[Interface] has no PrivateKey")
+	}
+	for i, p := range cfg.Peers {
+		if p.PublicKey == "" {
+			return WGConfig{}, fmt.Errorf("[Peer] %d has no PublicKey", i+1)
+		}
+	}
+	return cfg, nil
+}
+
+func (i *Interface) set(key, value string) error {
+	var err error
+	switch key {
+	case "privatekey":
+		i.PrivateKey, err = parseKey("PrivateKey", value)
+	case "address":
+		i.Address, err = parsePrefixes("Address", value)
+	case "dns":
+		i.DNS = splitList(value)
+	case "listenport":
+		i.ListenPort, err = parseInt("ListenPort", value, 0, 65535)
+	case "mtu":
+		i.MTU, err = parseInt("MTU", value, 0, 65535)
+	}
+	return err
+}
+
+func (p *Peer) set(key, value string) error {
+	var err error
+	switch key {
+	case "publickey":
+		p.PublicKey, err = parseKey("PublicKey", value)
+	case "presharedkey":
+		p.PresharedKey, err = parseKey("PresharedKey", value)
+	case "endpoint":
+		if _, _, e := net.SplitHostPort(value); e != nil {
+			return fmt.Errorf("invalid Endpoint %q: %w", value, e)
+		}
+		p.Endpoint = value
+	case "allowedips":
+		p.AllowedIPs, err = parsePrefixes("AllowedIPs", value)
+	case "persistentkeepalive":
+		if strings.EqualFold(value, "off") {
+			p.PersistentKeepalive = 0
+			return nil
+		}
+		p.PersistentKeepalive, err = parseInt("PersistentKeepalive", value, 0, 65535)
+	}
+	return err
+}
+
+// parseKey checks that value is a base64-encoded 32-byte key.
+func parseKey(name, value string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(b) != KeyLen {
+		return "", fmt.Errorf("%s must be a base64-encoded %d-byte key", name, KeyLen)
+	}
+	return value, nil
+}
+
+// parsePrefixes accepts CIDRs and bare addresses, as wg-quick does.
+func parsePrefixes(name, value string) ([]string, error) {
+	list := splitList(value)
+	for _, v := range list {
+		if _, _, err := net.ParseCIDR(v); err == nil {
+			continue
+		}
+		if net.ParseIP(v) == nil {
+			return nil, fmt.Errorf("invalid %s entry %q", name, v)
+		}
+	}
+	return list, nil
+}
+
+func parseInt(name, value string, min, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("invalid %s %q: must be a number between %d and %d", name, value, min, max)
+	}
+	return n, nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,108 @@
+package wgconf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testPriv = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	testPub  = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	testPSK  = "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw="
+)
+
+func TestParse(t *testing.T) {
+	conf := `
+# wg-quick config
+[Interface]
+PrivateKey = ` + testPriv + `
+Address = 172.16.0.2/32, 2606:4700:110:8a36::1/128
+DNS = 1.1.1.1, 2606:4700:4700::1111, example.com
+ListenPort = 51820
+MTU = 1280
+PostUp = iptables -A FORWARD ; ignored
+
+[Peer]
+PublicKey = ` + testPub + `
+PresharedKey = ` + testPSK + `
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = engage.cloudflareclient.com:2408
+PersistentKeepalive = 25
+`
+	got, err := Parse(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := WGConfig{
+		Interface: Interface{
+			PrivateKey: testPriv,
+			Address:    []string{"172.16.0.2/32", "2606:4700:110:8a36::1/128"},
+			DNS:        []string{"1.1.1.1", "2606:4700:4700::1111", "example.com"},
+			ListenPort: 51820,
+			MTU:        1280,
+		},
+		Peers: []Peer{{
+			PublicKey:           testPub,
+			PresharedKey:        testPSK,
+			Endpoint:            "engage.cloudflareclient.com:2408",
+			AllowedIPs:          []string{"0.0.0.0/0", "::/0"},
+			PersistentKeepalive: 25,
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestParseCaseAndPeers(t *testing.T) {
+	conf := "[interface]\nprivatekey=" + testPriv + "\n" +
+		"[PEER]\nPUBLICKEY = " + testPub + "\nendpoint = [2606:4700:d0::a29f:c001]:2408\npersistentkeepalive = off\n" +
+		"[Peer]\nPublicKey = " + testPub + "\n"
+	got, err := Parse(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Peers) != 2 {
+		t.Fatalf("got %d peers, want 2", len(got.Peers))
+	}
+	if got.Peers[0].Endpoint != "[2606:4700:d0::a29f:c001]:2408" {
+		t.Errorf("Endpoint = %q", got.Peers[0].Endpoint)
+	}
+	if got.Peers[0].PersistentKeepalive != 0 || got.Peers[1].Endpoint != "" {
+		t.Errorf("unexpected peers %+v", got.Peers)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	iface := "[Interface]\nPrivateKey = " + testPriv + "\n"
+	tests := []struct {
+		name, conf, want string
+	}{
+		{"empty", "", "missing [Interface] section"},
+		{"no private key", "[Interface]\nMTU = 1280\n", "has no PrivateKey"},
+		{"bad key", "[Interface]\nPrivateKey = abc\n", "PrivateKey must be a base64-encoded 32-byte key"},
+		{"short key", "[Interface]\nPrivateKey = AAAA\n", "PrivateKey must be a base64-encoded 32-byte key"},
+		{"duplicate interface", iface + iface, "line 3: duplicate [Interface] section"},
+		{"unknown section", iface + "[Tunnel]\n", "line 3: unknown section [tunnel]"},
+		{"malformed header", iface + "[Peer\n", "line 3: malformed section header"},
+		{"no equals", iface + "MTU 1280\n", "line 3: expected key = value"},
+		{"outside section", "MTU = 1280\n" + iface, `line 1: "mtu" outside of a section`},
+		{"bad mtu", iface + "MTU = big\n", "invalid MTU"},
+		{"mtu out of range", iface + "MTU = 70000\n", "invalid MTU"},
+		{"bad address", iface + "Address = 10.0.0.300/32\n", `invalid Address entry "10.0.0.300/32"`},
+		{"peer without key", iface + "[Peer]\nEndpoint = 1.2.3.4:2408\n", "[Peer] 1 has no PublicKey"},
+		{"endpoint without port", iface + "[Peer]\nPublicKey = " + testPub + "\nEndpoint = 1.2.3.4\n", "invalid Endpoint"},
+		{"bare ipv6 endpoint", iface + "[Peer]\nPublicKey = " + testPub + "\nEndpoint = 2606:4700::1:2408\n", "invalid Endpoint"},
+		{"bad allowed ips", iface + "[Peer]\nPublicKey = " + testPub + "\nAllowedIPs = everything\n", "invalid AllowedIPs entry"},
+		{"bad keepalive", iface + "[Peer]\nPublicKey = " + testPub + "\nPersistentKeepalive = -1\n", "invalid PersistentKeepalive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.conf))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Parse error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package tun2socks
+
+import (
+	"fmt"
+	"os"
+	"tun2socks/wgconf"
+)
+
+// loadWireGuardFile parses the wg-quick file at path. It returns nil when path
+// is empty. Start and Reconfigure read it again every time, so edits to the
+// file take effect on the next call.
+func loadWireGuardFile(path string) (*wgconf.WGConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wireguard config: %w", err)
+	}
+	defer f.Close()
+	wg, err := wgconf.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wireguard config %s: %w", path, err)
+	}
+	return &wg, nil
+}
+
+// applyWireGuardFile fills the fields of cfg left at their defaults from wg:
+// Endpoint from the first peer that has one, MTU from the interface and
+// DNSServers from the interface's DNS addresses (its search domains are
+// skipped). It returns what it took from the file, for logging. Warp
+// authenticates with its own identity and routes everything through the
+// tunnel, so the keys and AllowedIPs of the file are checked but not used.
+func applyWireGuardFile(cfg *Config, wg *wgconf.WGConfig) (used []string) {
+	if wg == nil {
+		return nil
+	}
+	if cfg.Endpoint == "" || cfg.Endpoint == "notset" {
+		for _, p := range wg.Peers {
+			if p.Endpoint != "" {
+				cfg.Endpoint = p.Endpoint
+				used = append(used, "endpoint "+p.Endpoint)
+				break
+			}
+		}
+	}
+	if cfg.MTU == 0 && wg.Interface.MTU != 0 {
+		cfg.MTU = wg.Interface.MTU
+		used = append(used, fmt.Sprintf("mtu %d", wg.Interface.MTU))
+	}
+	if len(cfg.DNSServers) == 0 {
+		for _, server := range wg.Interface.DNS {
+			if _, err := normalizeDNSServer(server); err == nil {
+				cfg.DNSServers = append(cfg.DNSServers, server)
+				used = append(used, "dns "+server)
+			}
+		}
+	}
+	return used
+}
+
+// config returns c.cfg with r's wireguard file applied. It must be called
+// with c.mu held.
+func (c *Client) config(r *run) Config {
+	cfg := c.cfg
+	applyWireGuardFile(&cfg, r.wgFile)
+	return cfg
+}
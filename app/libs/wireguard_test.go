@@ -0,0 +1,89 @@
+package tun2socks
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"tun2socks/wgconf"
+)
+
+func writeWireGuardFile(t *testing.T, path, endpoint string) {
+	t.Helper()
+	conf := "[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\nMTU = 1280\nDNS = 1.1.1.1, corp.example\n" +
+		"[Peer]\nPublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=\nEndpoint = " + endpoint + "\n"
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyWireGuardFile(t *testing.T) {
+	wg := &wgconf.WGConfig{
+		Interface: wgconf.Interface{MTU: 1280, DNS: []string{"1.1.1.1", "corp.example", "2606:4700:4700::1111"}},
+		Peers:     []wgconf.Peer{{}, {Endpoint: "162.159.192.1:2408"}},
+	}
+
+	cfg := NewConfig()
+	used := applyWireGuardFile(cfg, wg)
+	if cfg.Endpoint != "162.159.192.1:2408" || cfg.MTU != 1280 {
+		t.Errorf("Endpoint, MTU = %q, %d", cfg.Endpoint, cfg.MTU)
+	}
+	if want := []string{"1.1.1.1", "2606:4700:4700::1111"}; !reflect.DeepEqual(cfg.DNSServers, want) {
+		t.Errorf("DNSServers = %q, want %q without the search domain", cfg.DNSServers, want)
+	}
+	if len(used) != 4 {
+		t.Errorf("used = %q, want endpoint, mtu and two dns servers", used)
+	}
+
+	cfg = NewConfig()
+	cfg.Endpoint, cfg.MTU, cfg.DNSServers = "1.2.3.4:500", 1400, []string{"9.9.9.9"}
+	if used := applyWireGuardFile(cfg, wg); len(used) != 0 {
+		t.Errorf("used = %q with every field set, want none", used)
+	}
+	if cfg.Endpoint != "1.2.3.4:500" || cfg.MTU != 1400 || !reflect.DeepEqual(cfg.DNSServers, []string{"9.9.9.9"}) {
+		t.Errorf("set fields were overwritten: %+v", cfg)
+	}
+
+	if used := applyWireGuardFile(cfg, nil); used != nil {
+		t.Errorf("nil file used %q", used)
+	}
+}
+
+// TestStartRereadsWireGuardFile edits the file between runs; the second
+// Start must pick up the new endpoint and leave the client's config alone.
+func TestStartRereadsWireGuardFile(t *testing.T) {
+	fakeWarp(t)
+	dir := testDir(t)
+	path := filepath.Join(dir, "wg0.conf")
+	writeWireGuardFile(t, path, "162.159.192.1:2408")
+
+	cfg := NewConfig()
+	cfg.WireGuardConfigFile = path
+	c := NewClient(cfg)
+	c.SetTunStack(&MockTunStack{})
+	for _, endpoint := range []string{"162.159.192.1:2408", "162.159.195.7:500"} {
+		writeWireGuardFile(t, path, endpoint)
+		if err := c.Start(dir, -1); err != nil {
+			t.Fatal(err)
+		}
+		waitConnected(t, c)
+		deadline := time.Now().Add(5 * time.Second)
+		for c.ActiveEndpoint() != endpoint && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if got := c.ActiveEndpoint(); got != endpoint {
+			t.Errorf("ActiveEndpoint = %q, want %q from the file", got, endpoint)
+		}
+		if err := c.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		c.mu.Lock()
+		stored := c.cfg
+		c.mu.Unlock()
+		if stored.Endpoint != "notset" || stored.MTU != 0 || stored.DNSServers != nil {
+			t.Errorf("Start changed the client config: %+v", stored)
+		}
+	}
+}
@@ -312,11 +312,23 @@ public class OblivionVpnService extends VpnService {
                 .build();
     }
 
+    private int getMtu() {
+        try {
+            long mtu = Tun2socks.parseArgString(command).getMTU();
+            if (mtu > 0) {
+                return (int) mtu;
+            }
+        } catch (Exception e) {
+            Log.w(TAG, "Could not read mtu from command", e);
+        }
+        return 1500;
+    }
+
     private void configure() {
         VpnService.Builder builder = new VpnService.Builder();
         try {
             builder.setSession("oblivion")
-                    .setMtu(1500)
+                    .setMtu(getMtu())
                     .addAddress(PRIVATE_VLAN4_CLIENT, 30)
                     .addAddress(PRIVATE_VLAN6_CLIENT, 126)
                     .addDnsServer("8.8.8.8")
@@ -333,11 +345,17 @@ public class OblivionVpnService extends VpnService {
         }
         mInterface = builder.establish();
         Log.i(TAG, "Interface created");
-        vpnThread = new Thread(() -> Tun2socks.runWarp(
-                command,
-                getApplicationContext().getFilesDir().getAbsolutePath(),
-                mInterface.getFd()
-        ));
+        vpnThread = new Thread(() -> {
+            try {
+                Tun2socks.runWarp(
+                        command,
+                        getApplicationContext().getFilesDir().getAbsolutePath(),
+                        mInterface.getFd()
+                );
+            } catch (Exception e) {
+                Log.e(TAG, "Tunnel stopped with error", e);
+            }
+        });
         vpnThread.start();
     }
 }
\ No newline at end of file